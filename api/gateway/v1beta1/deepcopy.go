@@ -0,0 +1,264 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRoute) DeepCopyInto(out *HTTPRoute) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPRoute) DeepCopy() *HTTPRoute {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPRoute)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *HTTPRoute) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteList) DeepCopyInto(out *HTTPRouteList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]HTTPRoute, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPRouteList) DeepCopy() *HTTPRouteList {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPRouteList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *HTTPRouteList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteSpec) DeepCopyInto(out *HTTPRouteSpec) {
+	*out = *in
+	if in.ParentRefs != nil {
+		out.ParentRefs = make([]ParentReference, len(in.ParentRefs))
+		for i := range in.ParentRefs {
+			in.ParentRefs[i].DeepCopyInto(&out.ParentRefs[i])
+		}
+	}
+	if in.Rules != nil {
+		out.Rules = make([]HTTPRouteRule, len(in.Rules))
+		for i := range in.Rules {
+			in.Rules[i].DeepCopyInto(&out.Rules[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *ParentReference) DeepCopyInto(out *ParentReference) {
+	*out = *in
+	out.Group = copyPtr(in.Group)
+	out.Kind = copyPtr(in.Kind)
+	out.Namespace = copyPtr(in.Namespace)
+	out.SectionName = copyPtr(in.SectionName)
+	out.Port = copyPtr(in.Port)
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *ParentReference) DeepCopy() *ParentReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ParentReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteRule) DeepCopyInto(out *HTTPRouteRule) {
+	*out = *in
+	if in.Matches != nil {
+		out.Matches = make([]HTTPRouteMatch, len(in.Matches))
+		for i := range in.Matches {
+			in.Matches[i].DeepCopyInto(&out.Matches[i])
+		}
+	}
+	if in.Filters != nil {
+		out.Filters = make([]HTTPRouteFilter, len(in.Filters))
+		for i := range in.Filters {
+			in.Filters[i].DeepCopyInto(&out.Filters[i])
+		}
+	}
+	if in.BackendRefs != nil {
+		out.BackendRefs = make([]HTTPBackendRef, len(in.BackendRefs))
+		for i := range in.BackendRefs {
+			in.BackendRefs[i].DeepCopyInto(&out.BackendRefs[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteMatch) DeepCopyInto(out *HTTPRouteMatch) {
+	*out = *in
+	if in.Path != nil {
+		out.Path = &HTTPPathMatch{
+			Type:  copyPtr(in.Path.Type),
+			Value: copyPtr(in.Path.Value),
+		}
+	}
+	if in.Headers != nil {
+		out.Headers = make([]HTTPHeaderMatch, len(in.Headers))
+		for i, h := range in.Headers {
+			h.Type = copyPtr(h.Type)
+			out.Headers[i] = h
+		}
+	}
+	if in.QueryParams != nil {
+		out.QueryParams = make([]HTTPQueryParamMatch, len(in.QueryParams))
+		for i, q := range in.QueryParams {
+			q.Type = copyPtr(q.Type)
+			out.QueryParams[i] = q
+		}
+	}
+	out.Method = copyPtr(in.Method)
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteFilter) DeepCopyInto(out *HTTPRouteFilter) {
+	*out = *in
+	out.RequestHeaderModifier = in.RequestHeaderModifier.DeepCopy()
+	out.ResponseHeaderModifier = in.ResponseHeaderModifier.DeepCopy()
+	if r := in.RequestRedirect; r != nil {
+		out.RequestRedirect = &HTTPRequestRedirectFilter{
+			Scheme:     copyPtr(r.Scheme),
+			Hostname:   copyPtr(r.Hostname),
+			Path:       r.Path.DeepCopy(),
+			Port:       copyPtr(r.Port),
+			StatusCode: copyPtr(r.StatusCode),
+		}
+	}
+	if r := in.URLRewrite; r != nil {
+		out.URLRewrite = &HTTPURLRewriteFilter{
+			Hostname: copyPtr(r.Hostname),
+			Path:     r.Path.DeepCopy(),
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPHeaderFilter) DeepCopy() *HTTPHeaderFilter {
+	if in == nil {
+		return nil
+	}
+	return &HTTPHeaderFilter{
+		Set:    copySlice(in.Set),
+		Add:    copySlice(in.Add),
+		Remove: copySlice(in.Remove),
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPPathModifier) DeepCopy() *HTTPPathModifier {
+	if in == nil {
+		return nil
+	}
+	return &HTTPPathModifier{
+		Type:               in.Type,
+		ReplaceFullPath:    copyPtr(in.ReplaceFullPath),
+		ReplacePrefixMatch: copyPtr(in.ReplacePrefixMatch),
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPBackendRef) DeepCopyInto(out *HTTPBackendRef) {
+	*out = *in
+	out.Group = copyPtr(in.Group)
+	out.Kind = copyPtr(in.Kind)
+	out.Namespace = copyPtr(in.Namespace)
+	out.Port = copyPtr(in.Port)
+	out.Weight = copyPtr(in.Weight)
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteStatus) DeepCopyInto(out *HTTPRouteStatus) {
+	*out = *in
+	if in.Parents != nil {
+		out.Parents = make([]RouteParentStatus, len(in.Parents))
+		for i := range in.Parents {
+			in.Parents[i].DeepCopyInto(&out.Parents[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPRouteStatus) DeepCopy() *HTTPRouteStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPRouteStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *RouteParentStatus) DeepCopyInto(out *RouteParentStatus) {
+	*out = *in
+	in.ParentRef.DeepCopyInto(&out.ParentRef)
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *RouteParentStatus) DeepCopy() *RouteParentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RouteParentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func copyPtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copySlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append([]T(nil), s...)
+}
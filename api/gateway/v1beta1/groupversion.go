@@ -0,0 +1,24 @@
+// Package v1beta1 contains the minimal subset of the v1beta1 Gateway APIs (see
+// https://gateway-api.sigs.k8s.io), which is used by Caddy Mesh following the
+// GAMMA mesh profile.
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group version of the Gateway API.
+	GroupVersion = schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1beta1"}
+
+	// SchemeBuilder adds the types of the API to a scheme.
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types of the API to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&HTTPRoute{}, &HTTPRouteList{})
+}
@@ -0,0 +1,219 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HTTPRoute routes HTTP requests, sent to its parents, to the backends.
+type HTTPRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   HTTPRouteSpec   `json:"spec,omitempty"`
+	Status HTTPRouteStatus `json:"status,omitempty"`
+}
+
+// HTTPRouteSpec is the specification of an HTTPRoute.
+type HTTPRouteSpec struct {
+	// ParentRefs are the resources to which the route attaches. In the GAMMA
+	// mesh profile, a parent is a Service rather than a Gateway.
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	Rules      []HTTPRouteRule   `json:"rules,omitempty"`
+}
+
+// ParentReference identifies a parent of a route. Group and Kind default to
+// the Gateway kind, so a Service must be referenced with an empty group and
+// the Service kind explicitly.
+type ParentReference struct {
+	Group       *string `json:"group,omitempty"`
+	Kind        *string `json:"kind,omitempty"`
+	Namespace   *string `json:"namespace,omitempty"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName,omitempty"`
+	Port        *int32  `json:"port,omitempty"`
+}
+
+// HTTPRouteRule routes the requests matched by any of Matches, after being
+// processed by Filters, to BackendRefs.
+type HTTPRouteRule struct {
+	Matches     []HTTPRouteMatch  `json:"matches,omitempty"`
+	Filters     []HTTPRouteFilter `json:"filters,omitempty"`
+	BackendRefs []HTTPBackendRef  `json:"backendRefs,omitempty"`
+}
+
+// PathMatchType is the semantics of a path match.
+type PathMatchType string
+
+const (
+	PathMatchExact             PathMatchType = "Exact"
+	PathMatchPathPrefix        PathMatchType = "PathPrefix"
+	PathMatchRegularExpression PathMatchType = "RegularExpression"
+)
+
+// HTTPPathMatch matches the path of a request. Type defaults to PathPrefix,
+// and Value defaults to "/".
+type HTTPPathMatch struct {
+	Type  *PathMatchType `json:"type,omitempty"`
+	Value *string        `json:"value,omitempty"`
+}
+
+// HeaderMatchType is the semantics of a header match.
+type HeaderMatchType string
+
+const (
+	HeaderMatchExact             HeaderMatchType = "Exact"
+	HeaderMatchRegularExpression HeaderMatchType = "RegularExpression"
+)
+
+// HTTPHeaderMatch matches a header of a request. Type defaults to Exact.
+type HTTPHeaderMatch struct {
+	Type  *HeaderMatchType `json:"type,omitempty"`
+	Name  string           `json:"name"`
+	Value string           `json:"value"`
+}
+
+// QueryParamMatchType is the semantics of a query parameter match.
+type QueryParamMatchType string
+
+const (
+	QueryParamMatchExact             QueryParamMatchType = "Exact"
+	QueryParamMatchRegularExpression QueryParamMatchType = "RegularExpression"
+)
+
+// HTTPQueryParamMatch matches a query parameter of a request. Type defaults
+// to Exact.
+type HTTPQueryParamMatch struct {
+	Type  *QueryParamMatchType `json:"type,omitempty"`
+	Name  string               `json:"name"`
+	Value string               `json:"value"`
+}
+
+// HTTPRouteMatch matches a request if all of its conditions are satisfied.
+type HTTPRouteMatch struct {
+	Path        *HTTPPathMatch        `json:"path,omitempty"`
+	Headers     []HTTPHeaderMatch     `json:"headers,omitempty"`
+	QueryParams []HTTPQueryParamMatch `json:"queryParams,omitempty"`
+	Method      *string               `json:"method,omitempty"`
+}
+
+// HTTPRouteFilterType is the type of a filter.
+type HTTPRouteFilterType string
+
+const (
+	FilterRequestHeaderModifier  HTTPRouteFilterType = "RequestHeaderModifier"
+	FilterResponseHeaderModifier HTTPRouteFilterType = "ResponseHeaderModifier"
+	FilterRequestRedirect        HTTPRouteFilterType = "RequestRedirect"
+	FilterURLRewrite             HTTPRouteFilterType = "URLRewrite"
+	FilterRequestMirror          HTTPRouteFilterType = "RequestMirror"
+	FilterExtensionRef           HTTPRouteFilterType = "ExtensionRef"
+)
+
+// HTTPRouteFilter processes the requests, or the responses, of a rule. Only
+// the field corresponding to Type is specified.
+type HTTPRouteFilter struct {
+	Type                   HTTPRouteFilterType        `json:"type"`
+	RequestHeaderModifier  *HTTPHeaderFilter          `json:"requestHeaderModifier,omitempty"`
+	ResponseHeaderModifier *HTTPHeaderFilter          `json:"responseHeaderModifier,omitempty"`
+	RequestRedirect        *HTTPRequestRedirectFilter `json:"requestRedirect,omitempty"`
+	URLRewrite             *HTTPURLRewriteFilter      `json:"urlRewrite,omitempty"`
+}
+
+// HTTPHeader is a header name along with its value.
+type HTTPHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HTTPHeaderFilter modifies the headers of a request, or a response.
+type HTTPHeaderFilter struct {
+	Set    []HTTPHeader `json:"set,omitempty"`
+	Add    []HTTPHeader `json:"add,omitempty"`
+	Remove []string     `json:"remove,omitempty"`
+}
+
+// HTTPPathModifierType is the type of a path modifier.
+type HTTPPathModifierType string
+
+const (
+	FullPathHTTPPathModifier    HTTPPathModifierType = "ReplaceFullPath"
+	PrefixMatchHTTPPathModifier HTTPPathModifierType = "ReplacePrefixMatch"
+)
+
+// HTTPPathModifier replaces either the full path, or the prefix matched by the
+// path match, of a request.
+type HTTPPathModifier struct {
+	Type               HTTPPathModifierType `json:"type"`
+	ReplaceFullPath    *string              `json:"replaceFullPath,omitempty"`
+	ReplacePrefixMatch *string              `json:"replacePrefixMatch,omitempty"`
+}
+
+// HTTPRequestRedirectFilter responds to a request with a redirect, whose
+// location defaults to the URL of the request.
+type HTTPRequestRedirectFilter struct {
+	Scheme     *string           `json:"scheme,omitempty"`
+	Hostname   *string           `json:"hostname,omitempty"`
+	Path       *HTTPPathModifier `json:"path,omitempty"`
+	Port       *int32            `json:"port,omitempty"`
+	StatusCode *int              `json:"statusCode,omitempty"`
+}
+
+// HTTPURLRewriteFilter rewrites the URL of a request before it's proxied.
+type HTTPURLRewriteFilter struct {
+	Hostname *string           `json:"hostname,omitempty"`
+	Path     *HTTPPathModifier `json:"path,omitempty"`
+}
+
+// BackendObjectReference identifies a backend, which defaults to a Service
+// in the namespace of the route.
+type BackendObjectReference struct {
+	Group     *string `json:"group,omitempty"`
+	Kind      *string `json:"kind,omitempty"`
+	Name      string  `json:"name"`
+	Namespace *string `json:"namespace,omitempty"`
+	Port      *int32  `json:"port,omitempty"`
+}
+
+// HTTPBackendRef is a backend along with its weight, which defaults to 1.
+type HTTPBackendRef struct {
+	BackendObjectReference `json:",inline"`
+
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// HTTPRouteStatus is the status of an HTTPRoute.
+type HTTPRouteStatus struct {
+	// Parents are the statuses of the route with respect to its parents,
+	// each of which is written by the controller managing the parent.
+	Parents []RouteParentStatus `json:"parents,omitempty"`
+}
+
+// RouteParentStatus is the status of a route with respect to a parent.
+type RouteParentStatus struct {
+	ParentRef      ParentReference    `json:"parentRef"`
+	ControllerName string             `json:"controllerName"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// The condition types and reasons of a route with respect to a parent.
+const (
+	RouteConditionAccepted     = "Accepted"
+	RouteConditionResolvedRefs = "ResolvedRefs"
+
+	RouteReasonAccepted            = "Accepted"
+	RouteReasonNotAllowedByParents = "NotAllowedByParents"
+	RouteReasonNoMatchingParent    = "NoMatchingParent"
+	RouteReasonUnsupportedValue    = "UnsupportedValue"
+
+	RouteReasonResolvedRefs    = "ResolvedRefs"
+	RouteReasonRefNotPermitted = "RefNotPermitted"
+	RouteReasonInvalidKind     = "InvalidKind"
+	RouteReasonBackendNotFound = "BackendNotFound"
+)
+
+// HTTPRouteList is a list of HTTPRoutes.
+type HTTPRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []HTTPRoute `json:"items"`
+}
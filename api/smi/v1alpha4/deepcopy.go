@@ -0,0 +1,147 @@
+package v1alpha4
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrafficSplit) DeepCopyInto(out *TrafficSplit) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Spec.Backends != nil {
+		out.Spec.Backends = append([]TrafficSplitBackend(nil), in.Spec.Backends...)
+	}
+	if in.Spec.Matches != nil {
+		out.Spec.Matches = make([]corev1.TypedLocalObjectReference, len(in.Spec.Matches))
+		for i := range in.Spec.Matches {
+			in.Spec.Matches[i].DeepCopyInto(&out.Spec.Matches[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *TrafficSplit) DeepCopy() *TrafficSplit {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficSplit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *TrafficSplit) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *TrafficSplitList) DeepCopyInto(out *TrafficSplitList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]TrafficSplit, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *TrafficSplitList) DeepCopy() *TrafficSplitList {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficSplitList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *TrafficSplitList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteGroup) DeepCopyInto(out *HTTPRouteGroup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Spec.Matches != nil {
+		out.Spec.Matches = make([]HTTPMatch, len(in.Spec.Matches))
+		for i := range in.Spec.Matches {
+			in.Spec.Matches[i].DeepCopyInto(&out.Spec.Matches[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPRouteGroup) DeepCopy() *HTTPRouteGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPRouteGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *HTTPRouteGroup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPMatch) DeepCopyInto(out *HTTPMatch) {
+	*out = *in
+	if in.Methods != nil {
+		out.Methods = append([]string(nil), in.Methods...)
+	}
+	if in.Headers != nil {
+		out.Headers = make(map[string]string, len(in.Headers))
+		for k, v := range in.Headers {
+			out.Headers[k] = v
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *HTTPRouteGroupList) DeepCopyInto(out *HTTPRouteGroupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]HTTPRouteGroup, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *HTTPRouteGroupList) DeepCopy() *HTTPRouteGroupList {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPRouteGroupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *HTTPRouteGroupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Package v1alpha4 contains the minimal subset of the v1alpha4 SMI APIs (see
+// https://github.com/servicemeshinterface/smi-spec) supported by Caddy Mesh.
+package v1alpha4
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// SplitGroupVersion is the group version of the Traffic Split API.
+	SplitGroupVersion = schema.GroupVersion{Group: "split.smi-spec.io", Version: "v1alpha4"}
+
+	// SpecsGroupVersion is the group version of the Traffic Specs API.
+	SpecsGroupVersion = schema.GroupVersion{Group: "specs.smi-spec.io", Version: "v1alpha4"}
+
+	splitSchemeBuilder = &scheme.Builder{GroupVersion: SplitGroupVersion}
+	specsSchemeBuilder = &scheme.Builder{GroupVersion: SpecsGroupVersion}
+)
+
+func init() {
+	splitSchemeBuilder.Register(&TrafficSplit{}, &TrafficSplitList{})
+	specsSchemeBuilder.Register(&HTTPRouteGroup{}, &HTTPRouteGroupList{})
+}
+
+// AddToScheme adds the types of both APIs to the given scheme.
+func AddToScheme(s *runtime.Scheme) error {
+	if err := splitSchemeBuilder.AddToScheme(s); err != nil {
+		return err
+	}
+	return specsSchemeBuilder.AddToScheme(s)
+}
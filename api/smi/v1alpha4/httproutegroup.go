@@ -0,0 +1,39 @@
+package v1alpha4
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HTTPRouteGroup is a group of conditions to match HTTP requests.
+type HTTPRouteGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec HTTPRouteGroupSpec `json:"spec,omitempty"`
+}
+
+// HTTPRouteGroupSpec is the specification of an HTTPRouteGroup.
+type HTTPRouteGroupSpec struct {
+	// Matches are the conditions, any of which matches a request.
+	Matches []HTTPMatch `json:"matches,omitempty"`
+}
+
+// HTTPMatch matches a request if all of its conditions are met.
+type HTTPMatch struct {
+	Name string `json:"name,omitempty"`
+	// Methods are the matched HTTP methods, where "*" matches any method.
+	Methods []string `json:"methods,omitempty"`
+	// PathRegex is the regular expression matching the whole path.
+	PathRegex string `json:"pathRegex,omitempty"`
+	// Headers are the regular expressions matching the whole values of the
+	// headers, by the header names.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// HTTPRouteGroupList is a list of HTTPRouteGroups.
+type HTTPRouteGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []HTTPRouteGroup `json:"items"`
+}
@@ -0,0 +1,40 @@
+package v1alpha4
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TrafficSplit splits the requests to the root Service among the backend
+// Services by weight.
+type TrafficSplit struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TrafficSplitSpec `json:"spec,omitempty"`
+}
+
+// TrafficSplitSpec is the specification of a TrafficSplit.
+type TrafficSplitSpec struct {
+	// Service is the name of the root Service, to which the clients connect.
+	Service string `json:"service"`
+	// Backends are the Services among which the requests are split.
+	Backends []TrafficSplitBackend `json:"backends"`
+	// Matches restrict the requests to be split to the ones matched by any
+	// of the referenced route groups (e.g. HTTPRouteGroups).
+	Matches []corev1.TypedLocalObjectReference `json:"matches,omitempty"`
+}
+
+// TrafficSplitBackend is a backend Service along with its weight.
+type TrafficSplitBackend struct {
+	Service string `json:"service"`
+	Weight  int    `json:"weight"`
+}
+
+// TrafficSplitList is a list of TrafficSplits.
+type TrafficSplitList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []TrafficSplit `json:"items"`
+}
@@ -0,0 +1,167 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out.
+func (in *MeshPolicy) DeepCopyInto(out *MeshPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *MeshPolicy) DeepCopy() *MeshPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(MeshPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *MeshPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *MeshPolicyList) DeepCopyInto(out *MeshPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]MeshPolicy, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *MeshPolicyList) DeepCopy() *MeshPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(MeshPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *MeshPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *MeshPolicySpec) DeepCopyInto(out *MeshPolicySpec) {
+	*out = *in
+	if in.TargetRef != nil {
+		out.TargetRef = new(PolicyTargetReference)
+		*out.TargetRef = *in.TargetRef
+	}
+	if in.Selector != nil {
+		out.Selector = in.Selector.DeepCopy()
+	}
+	if in.Timeout != nil {
+		out.Timeout = in.Timeout.DeepCopy()
+	}
+	if in.Retry != nil {
+		out.Retry = in.Retry.DeepCopy()
+	}
+	if in.RateLimit != nil {
+		out.RateLimit = new(RateLimitPolicy)
+		*out.RateLimit = *in.RateLimit
+	}
+	if in.CircuitBreaker != nil {
+		out.CircuitBreaker = in.CircuitBreaker.DeepCopy()
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *MeshPolicySpec) DeepCopy() *MeshPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MeshPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *TimeoutPolicy) DeepCopy() *TimeoutPolicy {
+	if in == nil {
+		return nil
+	}
+	return &TimeoutPolicy{
+		DialTimeout:  copyDuration(in.DialTimeout),
+		ReadTimeout:  copyDuration(in.ReadTimeout),
+		WriteTimeout: copyDuration(in.WriteTimeout),
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *RetryPolicy) DeepCopy() *RetryPolicy {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	out.Duration = copyDuration(in.Duration)
+	return &out
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *CircuitBreakerPolicy) DeepCopy() *CircuitBreakerPolicy {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	out.FailDuration = copyDuration(in.FailDuration)
+	out.UnhealthyLatency = copyDuration(in.UnhealthyLatency)
+	if in.UnhealthyStatus != nil {
+		out.UnhealthyStatus = append([]int32(nil), in.UnhealthyStatus...)
+	}
+	return &out
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *MeshPolicyStatus) DeepCopyInto(out *MeshPolicyStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	if in.Services != nil {
+		out.Services = append([]string(nil), in.Services...)
+	}
+}
+
+// DeepCopy returns a deep copy of the receiver.
+func (in *MeshPolicyStatus) DeepCopy() *MeshPolicyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MeshPolicyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func copyDuration(d *metav1.Duration) *metav1.Duration {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	return &out
+}
@@ -0,0 +1,22 @@
+// Package v1alpha1 contains the v1alpha1 API of the mesh.caddyserver.com group.
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group version of the API.
+	GroupVersion = schema.GroupVersion{Group: "mesh.caddyserver.com", Version: "v1alpha1"}
+
+	// SchemeBuilder adds the types of the API to a scheme.
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types of the API to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&MeshPolicy{}, &MeshPolicyList{})
+}
@@ -0,0 +1,96 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The condition types of a MeshPolicy.
+const (
+	// PolicyConditionAccepted indicates whether the policy is valid, and
+	// thus has been taken into account.
+	PolicyConditionAccepted = "Accepted"
+	// PolicyConditionConflicted indicates whether any setting of the policy
+	// has been overridden by another policy targeting the same Service.
+	PolicyConditionConflicted = "Conflicted"
+)
+
+// MeshPolicy is a policy, applied to the Services in the same namespace, that
+// is shared across them. It takes precedence over the default annotations,
+// while the annotations of a Service take precedence over it.
+type MeshPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MeshPolicySpec   `json:"spec,omitempty"`
+	Status MeshPolicyStatus `json:"status,omitempty"`
+}
+
+// MeshPolicySpec is the desired behavior of the targeted Services. Exactly one
+// of TargetRef and Selector must be specified.
+type MeshPolicySpec struct {
+	// TargetRef targets a single Service by name.
+	TargetRef *PolicyTargetReference `json:"targetRef,omitempty"`
+	// Selector targets all the Services whose labels match it.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	Timeout        *TimeoutPolicy        `json:"timeout,omitempty"`
+	Retry          *RetryPolicy          `json:"retry,omitempty"`
+	RateLimit      *RateLimitPolicy      `json:"rateLimit,omitempty"`
+	CircuitBreaker *CircuitBreakerPolicy `json:"circuitBreaker,omitempty"`
+}
+
+// PolicyTargetReference identifies the target of a policy.
+type PolicyTargetReference struct {
+	// Group is the group of the target, which must be "" (i.e. the core group).
+	Group string `json:"group"`
+	// Kind is the kind of the target, which must be "Service".
+	Kind string `json:"kind"`
+	// Name is the name of the target.
+	Name string `json:"name"`
+}
+
+// TimeoutPolicy is the counterpart of the timeout-* annotations.
+type TimeoutPolicy struct {
+	DialTimeout  *metav1.Duration `json:"dialTimeout,omitempty"`
+	ReadTimeout  *metav1.Duration `json:"readTimeout,omitempty"`
+	WriteTimeout *metav1.Duration `json:"writeTimeout,omitempty"`
+}
+
+// RetryPolicy is the counterpart of the retry-* annotations.
+type RetryPolicy struct {
+	Count    int32            `json:"count,omitempty"`
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	On       string           `json:"on,omitempty"`
+}
+
+// RateLimitPolicy is the counterpart of the rate-limit-* annotations.
+type RateLimitPolicy struct {
+	Key      string `json:"key,omitempty"`
+	Rate     string `json:"rate,omitempty"`
+	ZoneSize int32  `json:"zoneSize,omitempty"`
+}
+
+// CircuitBreakerPolicy is the counterpart of the circuit-breaker-* annotations.
+type CircuitBreakerPolicy struct {
+	MaxFails         int32            `json:"maxFails,omitempty"`
+	MaxRequests      int32            `json:"maxRequests,omitempty"`
+	FailDuration     *metav1.Duration `json:"failDuration,omitempty"`
+	UnhealthyStatus  []int32          `json:"unhealthyStatus,omitempty"`
+	UnhealthyLatency *metav1.Duration `json:"unhealthyLatency,omitempty"`
+}
+
+// MeshPolicyStatus is the observed state of a MeshPolicy.
+type MeshPolicyStatus struct {
+	// Conditions are the latest observations of the policy.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Services are the names of the Services targeted by the policy.
+	Services []string `json:"services,omitempty"`
+}
+
+// MeshPolicyList is a list of MeshPolicies.
+type MeshPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []MeshPolicy `json:"items"`
+}
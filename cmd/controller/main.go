@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/go-logr/logr"
@@ -17,14 +18,36 @@ type Context struct {
 }
 
 type RunCmd struct {
-	ProxyNamespace    string   `arg:"" name:"proxy-namespace" help:"the namespace of caddy-mesh-proxy service"`
-	IgnoredNamespaces []string `name:"ignored-namespace" help:"the namespaces to ignore"`
+	ProxyNamespace    string        `arg:"" name:"proxy-namespace" help:"the namespace of caddy-mesh-proxy service"`
+	IgnoredNamespaces []string      `name:"ignored-namespace" help:"the namespaces to ignore"`
+	HealthProbeAddr   string        `name:"health-probe-address" default:":8081" help:"the address the health probes (/healthz and /readyz) bind to"`
+	PushConcurrency   int           `name:"push-concurrency" default:"8" help:"the maximum number of proxies to push the configuration to in parallel"`
+	CoalesceWindow    time.Duration `name:"coalesce-window" default:"${coalesce_window}" help:"how long to wait for further changes before pushing the configuration, 0 disables coalescing (not recommended)"`
+	CoalesceMaxDelay  time.Duration `name:"coalesce-max-delay" default:"10s" help:"the maximum time a change can be delayed by coalescing"`
+	AnnotationMode    string        `name:"annotation-mode" enum:"warn,reject" default:"warn" help:"how to handle unknown mesh annotations: warn or reject"`
+	WebhookPort       int           `name:"webhook-port" default:"0" help:"the port the admission webhook binds to, 0 disables the webhook"`
+	WebhookCertDir    string        `name:"webhook-cert-dir" help:"the directory containing the serving certificate (tls.crt and tls.key) of the admission webhook"`
+	DefaultsConfigMap string        `name:"defaults-configmap" default:"caddy-mesh-defaults" help:"the name of the ConfigMap, in the proxy namespace, holding the mesh-wide default annotations"`
+	EnableMeshPolicy  bool          `name:"mesh-policy" help:"enable the support for MeshPolicies (v1alpha1), whose CRD must be installed"`
+	EnableSMI         bool          `name:"smi" help:"enable the support for SMI TrafficSplits (v1alpha4), whose CRDs must be installed"`
+	EnableGatewayAPI  bool          `name:"gateway-api" help:"enable the support for Gateway API HTTPRoutes (v1beta1) attaching to Services, whose CRD must be installed"`
 }
 
 func (r *RunCmd) Run(ctx *Context) error {
 	config := &controller.Config{
-		ProxyNamespace:    r.ProxyNamespace,
-		IgnoredNamespaces: r.IgnoredNamespaces,
+		ProxyNamespace:     r.ProxyNamespace,
+		IgnoredNamespaces:  r.IgnoredNamespaces,
+		HealthProbeAddress: r.HealthProbeAddr,
+		PushConcurrency:    r.PushConcurrency,
+		CoalesceWindow:     r.CoalesceWindow,
+		CoalesceMaxDelay:   r.CoalesceMaxDelay,
+		AnnotationMode:     controller.AnnotationMode(r.AnnotationMode),
+		WebhookPort:        r.WebhookPort,
+		WebhookCertDir:     r.WebhookCertDir,
+		DefaultsConfigMap:  r.DefaultsConfigMap,
+		EnableMeshPolicy:   r.EnableMeshPolicy,
+		EnableSMI:          r.EnableSMI,
+		EnableGatewayAPI:   r.EnableGatewayAPI,
 	}
 	c, err := controller.New(ctx.logger, config)
 	if err != nil {
@@ -54,7 +77,9 @@ func main() {
 	logf.SetLogger(zap.New())
 	logger := logf.Log.WithName("caddy-mesh-controller")
 
-	ctx := kong.Parse(&CLI)
+	ctx := kong.Parse(&CLI, kong.Vars{
+		"coalesce_window": controller.DefaultCoalesceWindow.String(),
+	})
 	err := ctx.Run(&Context{logger: logger})
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// AnnotationPrefix is the prefix of all the annotations of Caddy Mesh.
+const AnnotationPrefix = "mesh.caddyserver.com/"
+
+// AnnotationMode determines how unknown annotations are handled.
+type AnnotationMode string
+
+const (
+	// AnnotationModeWarn warns about unknown annotations, which are ignored.
+	AnnotationModeWarn AnnotationMode = "warn"
+	// AnnotationModeReject rejects all annotations of a Service, if any of
+	// them is unknown.
+	AnnotationModeReject AnnotationMode = "reject"
+)
+
+// knownAnnotations are all the annotations under AnnotationPrefix that are
+// known to Caddy Mesh.
+var knownAnnotations = newKnownAnnotations()
+
+func newKnownAnnotations() map[string]bool {
+	known := map[string]bool{
+		StatusAnnotation: true,
+	}
+	t := reflect.TypeOf(Definitions{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if strings.HasPrefix(name, AnnotationPrefix) {
+			known[name] = true
+		}
+	}
+	return known
+}
+
+// expressionAnnotations are the annotations whose values are expressions.
+var expressionAnnotations = map[string]bool{
+	"mesh.caddyserver.com/retry-on":                 true,
+	"mesh.caddyserver.com/traffic-split-expression": true,
+}
+
+// CheckAnnotations checks every annotation under AnnotationPrefix against the
+// known ones, and reports the unknown ones along with suggestions, if any.
+func CheckAnnotations(annotations map[string]string) error {
+	var unknown []string
+	for name := range annotations {
+		if strings.HasPrefix(name, AnnotationPrefix) && !knownAnnotations[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+
+	var msgs []string
+	for _, name := range unknown {
+		msg := fmt.Sprintf("unknown annotation '%s'", name)
+		if suggestion := suggestAnnotation(name); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+		}
+		msgs = append(msgs, msg)
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// unknownAnnotationDetail describes the unknown annotation name, along with a
+// suggestion if any.
+func unknownAnnotationDetail(name string) string {
+	detail := "unknown annotation"
+	if suggestion := suggestAnnotation(name); suggestion != "" {
+		detail += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+	}
+	return detail
+}
+
+// ValidateAnnotations validates each annotation under AnnotationPrefix, and
+// reports the errors by field. Unknown annotations are only reported in
+// AnnotationModeReject.
+func ValidateAnnotations(annotations map[string]string, mode AnnotationMode) field.ErrorList {
+	path := field.NewPath("metadata", "annotations")
+
+	var errs field.ErrorList
+	for _, name := range sortedKeys(annotations) {
+		if !strings.HasPrefix(name, AnnotationPrefix) {
+			continue
+		}
+		value := annotations[name]
+
+		switch {
+		case !knownAnnotations[name]:
+			if mode == AnnotationModeReject {
+				errs = append(errs, field.Invalid(path.Key(name), value, unknownAnnotationDetail(name)))
+			}
+		case expressionAnnotations[name]:
+			if err := validateExpression(value); err != nil {
+				errs = append(errs, field.Invalid(path.Key(name), value, fmt.Sprintf("invalid expression: %v", err)))
+			}
+		default:
+			if _, err := NewDefinitions(map[string]string{name: value}); err != nil {
+				errs = append(errs, field.Invalid(path.Key(name), value, decodingDetail(name, err)))
+			}
+		}
+	}
+	return errs
+}
+
+// decodingDetail returns the detail of the error occurred when decoding the
+// annotation name alone.
+func decodingDetail(name string, err error) string {
+	var decodingErr *mapstructure.Error
+	if errors.As(err, &decodingErr) && len(decodingErr.Errors) == 1 {
+		return strings.TrimPrefix(decodingErr.Errors[0], fmt.Sprintf("error decoding '%s': ", name))
+	}
+	return err.Error()
+}
+
+// suggestAnnotation returns the known annotation closest to name, or an empty
+// string if none of them is close enough.
+func suggestAnnotation(name string) string {
+	s := strings.TrimPrefix(name, AnnotationPrefix)
+
+	// Allow roughly one typo per four characters.
+	best, bestDistance := "", len(s)/4+1
+	for known := range knownAnnotations {
+		d := levenshtein(s, strings.TrimPrefix(known, AnnotationPrefix))
+		if d < bestDistance || (d == bestDistance && best != "" && known < best) {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
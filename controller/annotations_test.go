@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestCheckAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      map[string]string
+		wantErr string
+	}{
+		{
+			name: "nil",
+			in:   nil,
+		},
+		{
+			name: "known",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-count":    "2",
+				"mesh.caddyserver.com/rate-limit-key": "{remote_host}",
+				"mesh.caddyserver.com/status":         `{"appliedGeneration":1,"proxies":1}`,
+			},
+		},
+		{
+			name: "other prefix",
+			in: map[string]string{
+				"example.com/retry-cout": "2",
+			},
+		},
+		{
+			name: "misspelled",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-cout": "2",
+			},
+			wantErr: "unknown annotation 'mesh.caddyserver.com/retry-cout' (did you mean 'mesh.caddyserver.com/retry-count'?)",
+		},
+		{
+			name: "unknown",
+			in: map[string]string{
+				"mesh.caddyserver.com/foo": "bar",
+			},
+			wantErr: "unknown annotation 'mesh.caddyserver.com/foo'",
+		},
+		{
+			name: "multiple",
+			in: map[string]string{
+				"mesh.caddyserver.com/timeout-read":             "5s",
+				"mesh.caddyserver.com/traffic-split-new-svc":    "service-2",
+				"mesh.caddyserver.com/traffic-split-expression": "true",
+			},
+			wantErr: "unknown annotation 'mesh.caddyserver.com/timeout-read'; unknown annotation 'mesh.caddyserver.com/traffic-split-new-svc' (did you mean 'mesh.caddyserver.com/traffic-split-new-service'?)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAnnotations(tt.in)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Err: Got (%q) != Want (%q)", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
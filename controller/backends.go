@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gw "github.com/RussellLuo/caddy-mesh/api/gateway/v1beta1"
+	smi "github.com/RussellLuo/caddy-mesh/api/smi/v1alpha4"
+)
+
+// ReferenceGrantAnnotation is the annotation of a Namespace, which grants the
+// Services in the given namespaces the use of the Services in the Namespace as
+// traffic-split backends, much like a ReferenceGrant of the Gateway API. The
+// value is a comma-separated list of namespaces, or "*" for all namespaces.
+const ReferenceGrantAnnotation = "mesh.caddyserver.com/reference-grant"
+
+// grantsReference reports whether the annotations of a Namespace allow the
+// Services in namespace from to use the Services in the Namespace as backends.
+func grantsReference(annotations map[string]string, from string) bool {
+	for _, ns := range strings.Split(annotations[ReferenceGrantAnnotation], ",") {
+		if ns = strings.TrimSpace(ns); ns == "*" || ns == from {
+			return true
+		}
+	}
+	return false
+}
+
+// trafficSplitRefs returns the references to the traffic-split backends of d
+// that may receive traffic, where the invalid ones, which have been reported
+// while decoding, are skipped.
+func trafficSplitRefs(d *Definitions) []BackendRef {
+	var refs []string
+	switch {
+	case len(d.TrafficSplitBackends) > 0:
+		for _, b := range d.TrafficSplitBackends {
+			if b.Weight > 0 {
+				refs = append(refs, b.Service)
+			}
+		}
+	case d.TrafficSplitExpression != "":
+		refs = []string{d.TrafficSplitNewService, d.TrafficSplitOldService}
+	}
+
+	var backends []BackendRef
+	for _, ref := range refs {
+		if r, err := parseBackendRef(ref); err == nil {
+			backends = append(backends, r)
+		}
+	}
+	return backends
+}
+
+// checkReferenceGrants returns a copy of d, in which the traffic split of svc
+// is disabled if any of its backends is in another namespace that does not
+// grant the reference, so that no one can split the traffic to the Services of
+// others. So is the mirroring of svc. The Events about the backends not granted
+// are only raised once until they change.
+func (c *Controller) checkReferenceGrants(ctx context.Context, svc *corev1.Service, d *Definitions) (*Definitions, error) {
+	if d == nil {
+		return nil, nil
+	}
+	d = d.DeepCopy()
+
+	var msgs []string
+	for _, ref := range trafficSplitRefs(d) {
+		granted, err := c.isGranted(ctx, svc, ref)
+		if err != nil {
+			return nil, err
+		}
+		if granted {
+			continue
+		}
+
+		c.logger.Info("Ignoring traffic split with a backend not granted", "name", svc.Name, "namespace", svc.Namespace, "backend", ref.Name, "backendNamespace", ref.Namespace)
+		msgs = append(msgs, fmt.Sprintf("Traffic-split backend %q is in namespace %q, which does not grant references from namespace %q", ref.Name, ref.Namespace, svc.Namespace))
+		d.TrafficSplitExpression = ""
+		d.TrafficSplitNewService = ""
+		d.TrafficSplitOldService = ""
+		d.TrafficSplitBackends = nil
+		break
+	}
+
+	if ref, ok := mirrorRef(d); ok {
+		granted, err := c.isGranted(ctx, svc, ref)
+		if err != nil {
+			return nil, err
+		}
+		if !granted {
+			c.logger.Info("Ignoring mirror service not granted", "name", svc.Name, "namespace", svc.Namespace, "mirror", ref.Name, "mirrorNamespace", ref.Namespace)
+			msgs = append(msgs, fmt.Sprintf("Mirror service %q is in namespace %q, which does not grant references from namespace %q", ref.Name, ref.Namespace, svc.Namespace))
+			d.MirrorService = ""
+		}
+	}
+
+	var notPermittedErr error
+	if len(msgs) > 0 {
+		notPermittedErr = fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	if c.changedAnnotationError("Service", Key{Name: svc.Name, Namespace: svc.Namespace}, ReasonReferenceNotPermitted, notPermittedErr) {
+		for _, msg := range msgs {
+			c.recorder.Event(svc, corev1.EventTypeWarning, ReasonReferenceNotPermitted, msg)
+		}
+	}
+	return d, nil
+}
+
+// isGranted reports whether svc is allowed to use the backend of ref, which is
+// always the case if the backend is in the same namespace.
+func (c *Controller) isGranted(ctx context.Context, svc *corev1.Service, ref BackendRef) (bool, error) {
+	if ref.Namespace == "" || ref.Namespace == svc.Namespace {
+		return true, nil
+	}
+	ns := &corev1.Namespace{}
+	err := c.client.Get(ctx, client.ObjectKey{Name: ref.Namespace}, ns)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	return grantsReference(ns.Annotations, svc.Namespace), nil
+}
+
+// mirrorRef returns the reference to the mirror Service of d, if any requests
+// are mirrored to it.
+func mirrorRef(d *Definitions) (BackendRef, bool) {
+	if d.MirrorService == "" || d.MirrorPercentage <= 0 {
+		return BackendRef{}, false
+	}
+	ref, err := parseBackendRef(d.MirrorService)
+	if err != nil {
+		// Reported while decoding.
+		return BackendRef{}, false
+	}
+	return ref, true
+}
+
+// backendsField is the field index, of Services, TrafficSplits and HTTPRoutes,
+// holding the keys (i.e. "namespace/name") of the backend Services they route
+// to.
+const backendsField = ".mesh.backends"
+
+// backendNamespacesField is the field index of Services holding the namespaces,
+// other than their own, of their backend Services.
+const backendNamespacesField = ".mesh.backendNamespaces"
+
+// indexBackends registers the field indexes from the backend Services to their
+// parents, i.e. the Services splitting or routing traffic to them.
+func (c *Controller) indexBackends(ctx context.Context) error {
+	indexer := c.manager.GetFieldIndexer()
+	if err := indexer.IndexField(ctx, &corev1.Service{}, backendsField, serviceBackends); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &corev1.Service{}, backendNamespacesField, serviceBackendNamespaces); err != nil {
+		return err
+	}
+	if c.config.EnableSMI {
+		if err := indexer.IndexField(ctx, &smi.TrafficSplit{}, backendsField, trafficSplitBackends); err != nil {
+			return err
+		}
+	}
+	if c.config.EnableGatewayAPI {
+		if err := indexer.IndexField(ctx, &gw.HTTPRoute{}, backendsField, httpRouteBackends); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceBackendRefs returns the references to the traffic-split backends, and
+// the mirror Service, of a Service. Only the annotations of the Service itself
+// are consulted, since neither traffic splitting nor mirroring can be defaulted.
+func serviceBackendRefs(obj client.Object) []BackendRef {
+	annotations := obj.GetAnnotations()
+	d := &Definitions{
+		TrafficSplitExpression: annotations["mesh.caddyserver.com/traffic-split-expression"],
+		TrafficSplitNewService: annotations["mesh.caddyserver.com/traffic-split-new-service"],
+		TrafficSplitOldService: annotations["mesh.caddyserver.com/traffic-split-old-service"],
+		MirrorService:          annotations["mesh.caddyserver.com/mirror-service"],
+		MirrorPercentage:       100,
+	}
+	// An invalid list of weighted backends, or an invalid percentage, is
+	// reported while reconciling.
+	d.TrafficSplitBackends, _ = parseTrafficSplitBackends(annotations["mesh.caddyserver.com/traffic-split-backends"])
+	if p, ok := annotations["mesh.caddyserver.com/mirror-percentage"]; ok {
+		d.MirrorPercentage, _ = strconv.Atoi(p)
+	}
+
+	refs := trafficSplitRefs(d)
+	if ref, ok := mirrorRef(d); ok {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// serviceBackends returns the keys of the traffic-split backends, and the
+// mirror Service, of a Service.
+func serviceBackends(obj client.Object) []string {
+	var keys []string
+	for _, ref := range serviceBackendRefs(obj) {
+		keys = append(keys, backendKey(ref.Key(obj.GetNamespace())))
+	}
+	return uniqueNames(keys)
+}
+
+// serviceBackendNamespaces returns the namespaces, other than its own, of the
+// traffic-split backends and the mirror Service of a Service.
+func serviceBackendNamespaces(obj client.Object) []string {
+	var namespaces []string
+	for _, ref := range serviceBackendRefs(obj) {
+		if ref.Namespace != obj.GetNamespace() {
+			namespaces = append(namespaces, ref.Namespace)
+		}
+	}
+	return uniqueNames(namespaces)
+}
+
+// trafficSplitBackends returns the keys of the backends of a TrafficSplit.
+func trafficSplitBackends(obj client.Object) []string {
+	split, ok := obj.(*smi.TrafficSplit)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for _, b := range split.Spec.Backends {
+		keys = append(keys, backendKey(Key{Name: b.Service, Namespace: split.Namespace}))
+	}
+	return uniqueNames(keys)
+}
+
+// httpRouteBackends returns the keys of the backends, in the same namespace,
+// of an HTTPRoute.
+func httpRouteBackends(obj client.Object) []string {
+	route, ok := obj.(*gw.HTTPRoute)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for _, r := range route.Spec.Rules {
+		for _, ref := range r.BackendRefs {
+			if backendRefProblem(route.Namespace, &ref.BackendObjectReference) == "" {
+				keys = append(keys, backendKey(Key{Name: ref.Name, Namespace: route.Namespace}))
+			}
+		}
+	}
+	return uniqueNames(keys)
+}
+
+// backendKey returns the value of backendsField for the backend of key.
+func backendKey(key Key) string {
+	return key.Namespace + "/" + key.Name
+}
+
+// uniqueNames returns the non-empty names in ascending order, without any
+// duplicates.
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// mapBackend maps a Service, or one of its EndpointSlices, to the eligible
+// parents of the Service. Thus a parent is rebuilt whenever any backend is
+// created, changed or deleted, which might happen after the parent has been
+// reconciled, or on a port served by a different Caddy server.
+func (c *Controller) mapBackend(obj client.Object) []reconcile.Request {
+	name := obj.GetName()
+	if _, ok := obj.(*v1beta1.EndpointSlice); ok {
+		name = obj.GetLabels()[v1beta1.LabelServiceName]
+	}
+	if name == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	matching := client.MatchingFields{backendsField: backendKey(Key{Name: name, Namespace: obj.GetNamespace()})}
+	// The parent Services may be in other namespaces.
+	requests := c.eligibleServices(matching)
+
+	if c.config.EnableSMI {
+		splits := &smi.TrafficSplitList{}
+		if err := c.client.List(ctx, splits, client.InNamespace(obj.GetNamespace()), matching); err != nil {
+			c.logger.Error(err, "could not list traffic splits", "namespace", obj.GetNamespace())
+		}
+		for i := range splits.Items {
+			requests = append(requests, c.mapTrafficSplit(&splits.Items[i])...)
+		}
+	}
+
+	if c.config.EnableGatewayAPI {
+		routes := &gw.HTTPRouteList{}
+		if err := c.client.List(ctx, routes, client.InNamespace(obj.GetNamespace()), matching); err != nil {
+			c.logger.Error(err, "could not list http routes", "namespace", obj.GetNamespace())
+		}
+		for i := range routes.Items {
+			requests = append(requests, c.mapHTTPRoute(&routes.Items[i])...)
+		}
+	}
+
+	return requests
+}
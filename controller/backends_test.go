@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gw "github.com/RussellLuo/caddy-mesh/api/gateway/v1beta1"
+	smi "github.com/RussellLuo/caddy-mesh/api/smi/v1alpha4"
+)
+
+func TestBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		obj     client.Object
+		indexer func(client.Object) []string
+		want    []string
+	}{
+		{
+			name: "service with new and old services",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "{http.request.uri.query.canary} == 'true'",
+				"mesh.caddyserver.com/traffic-split-new-service": "canary/server-v2:8080",
+				"mesh.caddyserver.com/traffic-split-old-service": "server-v1",
+			}}},
+			indexer: serviceBackends,
+			want:    []string{"canary/server-v2", "test/server-v1"},
+		},
+		{
+			name: "service without expression",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-new-service": "server-v2",
+				"mesh.caddyserver.com/traffic-split-old-service": "server-v1",
+			}}},
+			indexer: serviceBackends,
+		},
+		{
+			name: "service with weighted backends",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "server-v2=5,server-v1=95,server-v2=0,test/server-v1:8080=1",
+			}}},
+			indexer: serviceBackends,
+			want:    []string{"test/server-v1", "test/server-v2"},
+		},
+		{
+			name: "service with backends in other namespaces",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "server-v1=95,canary/server-v2=4,staging/server-v2=1,test/server-v3=0",
+			}}},
+			indexer: serviceBackendNamespaces,
+			want:    []string{"canary", "staging"},
+		},
+		{
+			name: "service with mirror",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "server-v1=95,server-v2=5",
+				"mesh.caddyserver.com/mirror-service":         "canary/server-v3:8080",
+			}}},
+			indexer: serviceBackends,
+			want:    []string{"canary/server-v3", "test/server-v1", "test/server-v2"},
+		},
+		{
+			name: "service with mirror disabled",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/mirror-service":    "canary/server-v3",
+				"mesh.caddyserver.com/mirror-percentage": "0",
+			}}},
+			indexer: serviceBackendNamespaces,
+		},
+		{
+			name: "service with invalid backends",
+			obj: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Annotations: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "server-v1",
+			}}},
+			indexer: serviceBackends,
+		},
+		{
+			name: "traffic split",
+			obj: &smi.TrafficSplit{ObjectMeta: metav1.ObjectMeta{Namespace: "test"}, Spec: smi.TrafficSplitSpec{
+				Service: "server",
+				Backends: []smi.TrafficSplitBackend{
+					{Service: "server-v2", Weight: 5},
+					{Service: "server-v1", Weight: 95},
+				},
+			}},
+			indexer: trafficSplitBackends,
+			want:    []string{"test/server-v1", "test/server-v2"},
+		},
+		{
+			name: "http route",
+			obj: &gw.HTTPRoute{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test"},
+				Spec: gw.HTTPRouteSpec{Rules: []gw.HTTPRouteRule{
+					{BackendRefs: []gw.HTTPBackendRef{backendRef("server-v1", 80, 1)}},
+					{BackendRefs: []gw.HTTPBackendRef{
+						backendRef("server-v1", 80, 1),
+						{BackendObjectReference: gw.BackendObjectReference{Name: "other", Namespace: ptr("other")}},
+						{BackendObjectReference: gw.BackendObjectReference{Group: ptr("example.com"), Kind: ptr("Bucket"), Name: "bucket"}},
+					}},
+				}},
+			},
+			indexer: httpRouteBackends,
+			want:    []string{"test/server-v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.indexer(tt.obj)
+			if !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestGrantsReference(t *testing.T) {
+	tests := []struct {
+		name  string
+		grant string
+		from  string
+		want  bool
+	}{
+		{name: "no grant", from: "test", want: false},
+		{name: "granted", grant: "prod, test", from: "test", want: true},
+		{name: "not granted", grant: "prod,staging", from: "test", want: false},
+		{name: "granted to all", grant: "*", from: "test", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tt.grant != "" {
+				annotations[ReferenceGrantAnnotation] = tt.grant
+			}
+			if got := grantsReference(annotations, tt.from); got != tt.want {
+				t.Errorf("Got (%v) != Want (%v)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestController_CheckReferenceGrants(t *testing.T) {
+	ctx := context.Background()
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "test"}}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "canary"}}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		logger:           testLogger,
+		client:           fake.NewClientBuilder().WithObjects(ns).Build(),
+		recorder:         recorder,
+		annotationErrors: make(map[annotationEvent]string),
+	}
+
+	d := &Definitions{
+		TrafficSplitBackends: []TrafficSplitBackend{{Service: "server-v1", Weight: 95}, {Service: "canary/server-v2", Weight: 5}},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := c.checkReferenceGrants(ctx, svc, d)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(got.TrafficSplitBackends) != 0 {
+			t.Fatalf("Backends: Got (%v) != Want (none)", got.TrafficSplitBackends)
+		}
+	}
+	// The given definitions are left intact.
+	if len(d.TrafficSplitBackends) != 2 {
+		t.Errorf("Backends: Got (%v) != Want (2 backends)", d.TrafficSplitBackends)
+	}
+
+	// The Event is raised only once, as long as the backend is not granted.
+	if got := len(recorder.Events); got != 1 {
+		t.Errorf("Events: Got (%d) != Want (1)", got)
+	}
+}
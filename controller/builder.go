@@ -2,7 +2,11 @@ package controller
 
 import (
 	"fmt"
+	"net/http"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/RussellLuo/caddy-mesh/dnspatcher"
 )
@@ -23,6 +27,16 @@ func (b Builder) Build(servers map[Port]*CaddyServer) map[string]interface{} {
 			break
 		}
 
+		nextRouting := NextMapValueInOrder(s.httpRoutings)
+		var routingRoutes []Route
+		for {
+			r, ok := nextRouting()
+			if !ok {
+				break
+			}
+			routingRoutes = append(routingRoutes, b.buildHTTPRouting(r, s.port))
+		}
+
 		nextTs := NextMapValueInOrder(s.trafficSplits)
 		var tsRoutes []Route
 		for {
@@ -30,7 +44,7 @@ func (b Builder) Build(servers map[Port]*CaddyServer) map[string]interface{} {
 			if !ok {
 				break
 			}
-			tsRoutes = append(tsRoutes, b.buildTrafficSplit(ts))
+			tsRoutes = append(tsRoutes, b.buildTrafficSplit(ts, s.port))
 		}
 
 		nextSvc := NextMapValueInOrder(s.services)
@@ -40,15 +54,18 @@ func (b Builder) Build(servers map[Port]*CaddyServer) map[string]interface{} {
 			if !ok {
 				break
 			}
-			svcRoutes = append(svcRoutes, b.buildService(svc))
+			svcRoutes = append(svcRoutes, b.buildService(svc, s.port))
 		}
 
 		var routes []Route
+		if len(routingRoutes) > 0 {
+			routes = append(routes, b.buildSubRoute(containerID("httproutes", s.port), nil, routingRoutes...))
+		}
 		if len(tsRoutes) > 0 {
-			routes = append(routes, b.buildSubRoute(nil, tsRoutes...))
+			routes = append(routes, b.buildSubRoute(containerID("trafficsplits", s.port), nil, tsRoutes...))
 		}
 		if len(svcRoutes) > 0 {
-			routes = append(routes, b.buildSubRoute(nil, svcRoutes...))
+			routes = append(routes, b.buildSubRoute(containerID("services", s.port), nil, svcRoutes...))
 		}
 
 		cfgServers[fmt.Sprintf("server-%d", s.port)] = map[string]interface{}{
@@ -72,36 +89,362 @@ func (b Builder) Build(servers map[Port]*CaddyServer) map[string]interface{} {
 	}
 }
 
-func (b Builder) buildTrafficSplit(ts *TrafficSplit) Route {
-	matchExpr := Match{
-		"expression": ts.Expression,
-	}
-	routes := []Route{
-		b.buildServiceProxy(matchExpr, ts.NewService),
-		b.buildServiceProxy(nil, ts.OldService),
+func (b Builder) buildTrafficSplit(ts *TrafficSplit, port Port) Route {
+	id := routeID("trafficsplit", ts.Key, port)
+
+	var routes []Route
+	switch {
+	case len(ts.Backends) > 0:
+		routes = b.buildWeightedBackends(id, ts, port)
+	case ts.NewService == nil:
+		// The new service is missing, route all requests to the old one.
+		routes = []Route{
+			b.buildServiceProxy(id+".old.proxy", nil, ts.OldService, backendPort(ts.OldPort, port)),
+		}
+	case ts.OldService == nil:
+		// The old service is missing, route all requests to the new one.
+		routes = []Route{
+			b.buildServiceProxy(id+".new.proxy", nil, ts.NewService, backendPort(ts.NewPort, port)),
+		}
+	default:
+		matchExpr := Match{
+			"expression": ts.Expression,
+		}
+		routes = []Route{
+			b.buildServiceProxy(id+".new.proxy", matchExpr, ts.NewService, backendPort(ts.NewPort, port)),
+			b.buildServiceProxy(id+".old.proxy", nil, ts.OldService, backendPort(ts.OldPort, port)),
+		}
 	}
 
 	matchHost := Match{
 		"host": []string{fullHost(ts.Name, ts.Namespace)},
 	}
-	return b.buildSubRoute(matchHost, routes...)
+	r := b.buildSubRoute("", matchHost, routes...)
+	r["@id"] = id
+	return r
+}
+
+// buildWeightedBackends builds the routes that split the requests among the
+// backends of ts by weight. Each request falls into a bucket by its UUID, which
+// is random and thus uniformly distributed, and the bucket of each backend is
+// sized in proportion to its weight.
+//
+// The backends are rendered in the order of their labels, so the same backends
+// always result in the same routes regardless of how they are listed.
+func (b Builder) buildWeightedBackends(id string, ts *TrafficSplit, port Port) []Route {
+	backends := make([]*WeightedService, len(ts.Backends))
+	copy(backends, ts.Backends)
+	sort.SliceStable(backends, func(i, j int) bool {
+		return backends[i].Label(ts.Key) < backends[j].Label(ts.Key)
+	})
+
+	total := 0
+	for _, backend := range backends {
+		total += backend.Weight
+	}
+
+	sticky := ts.Definitions != nil && ts.Definitions.TrafficSplitSticky
+
+	var routes []Route
+	if sticky {
+		// Keep the clients, who have hit a backend before, on that backend.
+		for _, backend := range backends {
+			label := backend.Label(ts.Key)
+			conditions := []string{fmt.Sprintf("{http.request.cookie.%s} == %q", stickyCookie, label)}
+			if ts.Expression != "" {
+				conditions = append([]string{"(" + ts.Expression + ")"}, conditions...)
+			}
+			match := Match{"expression": strings.Join(conditions, " && ")}
+			proxyID := fmt.Sprintf("%s.%s.sticky.proxy", id, label)
+			routes = append(routes, b.buildServiceProxy(proxyID, match, backend.Service, backendPort(backend.Port, port)))
+		}
+	}
+
+	cumulative := 0
+	for i, backend := range backends {
+		cumulative += backend.Weight
+
+		var conditions []string
+		if ts.Expression != "" {
+			conditions = append(conditions, "("+ts.Expression+")")
+		}
+		if i < len(backends)-1 {
+			conditions = append(conditions, fmt.Sprintf("{http.request.uuid} < %q", uuidBound(cumulative, total)))
+		}
+
+		var match Match
+		if len(conditions) > 0 {
+			match = Match{"expression": strings.Join(conditions, " && ")}
+		}
+		label := backend.Label(ts.Key)
+		proxyID := fmt.Sprintf("%s.%s.proxy", id, label)
+		r := b.buildServiceProxy(proxyID, match, backend.Service, backendPort(backend.Port, port))
+		if sticky {
+			r["handle"] = append([]Handle{b.buildStickyCookie(label)}, r["handle"].([]Handle)...)
+		}
+		routes = append(routes, r)
+	}
+
+	if ts.Expression != "" {
+		// Route the unmatched requests to the root Service.
+		routes = append(routes, b.buildServiceProxy(id+".proxy", nil, ts.Service, port))
+	}
+
+	return routes
+}
+
+// backendPort returns the port of a backend Service, to which the requests to
+// the given port of the server are proxied, where zero means the same port.
+func backendPort(p, port Port) Port {
+	if p != 0 {
+		return p
+	}
+	return port
+}
+
+// stickyCookie is the name of the cookie that remembers the backend, which a
+// client has been routed to by a sticky TrafficSplit.
+const stickyCookie = "caddy-mesh-backend"
+
+// buildStickyCookie builds a handler that sets the sticky cookie to backend
+// in the response.
+func (b Builder) buildStickyCookie(backend string) Handle {
+	return Handle{
+		"handler": "headers",
+		"response": map[string]interface{}{
+			"add": map[string][]string{
+				"Set-Cookie": {stickyCookie + "=" + backend + "; Path=/"},
+			},
+		},
+	}
+}
+
+// buildHTTPRouting builds the routes of the rules of r, in order of precedence.
+// A request unmatched by any rule falls through to the routes built for the
+// Service otherwise.
+func (b Builder) buildHTTPRouting(r *HTTPRouting, port Port) Route {
+	id := routeID("httproute", r.Key, port)
+
+	var routes []Route
+	for i, rule := range r.Rules {
+		routes = append(routes, b.buildRoutingRule(fmt.Sprintf("%s.%d", id, i), rule))
+	}
+
+	matchHost := Match{
+		"host": []string{fullHost(r.Name, r.Namespace)},
+	}
+	route := b.buildSubRoute("", matchHost, routes...)
+	route["@id"] = id
+	return route
+}
+
+// buildRoutingRule builds the route of rule, whose proxies have @ids prefixed
+// with ruleID. The filters of rule are applied in the order of request headers,
+// URL rewrite and response headers, before either the redirect or the proxies.
+func (b Builder) buildRoutingRule(ruleID string, rule *RoutingRule) Route {
+	var handle []Handle
+	if ops := rule.RequestHeaders; ops != nil {
+		handle = append(handle, Handle{
+			"handler": "headers",
+			"request": b.buildHeaderOps(ops),
+		})
+	}
+	if rw := rule.Rewrite; rw != nil {
+		if rw.Hostname != "" {
+			handle = append(handle, Handle{
+				"handler": "headers",
+				"request": map[string]interface{}{
+					"set": map[string][]string{"Host": {rw.Hostname}},
+				},
+			})
+		}
+		if rw.Path != nil {
+			handle = append(handle, b.buildPathRewrite(rw.Path))
+		}
+	}
+	if ops := rule.ResponseHeaders; ops != nil {
+		response := b.buildHeaderOps(ops)
+		// Apply the operations after the headers of the upstream response
+		// have been copied.
+		response["deferred"] = true
+		handle = append(handle, Handle{
+			"handler":  "headers",
+			"response": response,
+		})
+	}
+
+	var backends []*RoutedBackend
+	var ids []string
+	total := 0
+	for i, backend := range rule.Backends {
+		if backend.Weight <= 0 {
+			continue
+		}
+		backends = append(backends, backend)
+		ids = append(ids, fmt.Sprintf("%s.%d.proxy", ruleID, i))
+		total += backend.Weight
+	}
+
+	switch {
+	case rule.Redirect != nil:
+		handle = append(handle, b.buildRedirect(rule.Redirect)...)
+	case len(backends) == 0:
+		handle = append(handle, b.buildStaticResponse(http.StatusInternalServerError))
+	case len(backends) == 1:
+		handle = append(handle, b.buildRoutedBackend(ids[0], nil, backends[0])["handle"].([]Handle)...)
+	default:
+		// Split the requests by weight, just as buildWeightedBackends does.
+		var routes []Route
+		cumulative := 0
+		for i, backend := range backends {
+			cumulative += backend.Weight
+			var match Match
+			if i < len(backends)-1 {
+				match = Match{"expression": fmt.Sprintf("{http.request.uuid} < %q", uuidBound(cumulative, total))}
+			}
+			routes = append(routes, b.buildRoutedBackend(ids[i], match, backend))
+		}
+		handle = append(handle, Handle{
+			"handler": "subroute",
+			"routes":  routes,
+		})
+	}
+
+	r := Route{"handle": handle}
+	if rule.Expression != "" {
+		r["match"] = []Match{{"expression": rule.Expression}}
+	}
+	return r
+}
+
+// buildRoutedBackend builds a route proxying to backend, or rejecting the
+// requests if backend could not be found.
+func (b Builder) buildRoutedBackend(proxyID string, match Match, backend *RoutedBackend) Route {
+	if backend.Service == nil {
+		r := Route{"handle": []Handle{b.buildStaticResponse(http.StatusInternalServerError)}}
+		if len(match) > 0 {
+			r["match"] = []Match{match}
+		}
+		return r
+	}
+	return b.buildServiceProxy(proxyID, match, backend.Service, backend.Port)
+}
+
+func (b Builder) buildHeaderOps(ops *HeaderOps) map[string]interface{} {
+	result := make(map[string]interface{})
+	if len(ops.Set) > 0 {
+		set := make(map[string][]string, len(ops.Set))
+		for name, value := range ops.Set {
+			set[name] = []string{value}
+		}
+		result["set"] = set
+	}
+	if len(ops.Add) > 0 {
+		result["add"] = ops.Add
+	}
+	if len(ops.Remove) > 0 {
+		result["delete"] = ops.Remove
+	}
+	return result
 }
 
-func (b Builder) buildService(svc *Service) Route {
+// buildPathRewrite builds a rewrite handler that modifies the path, while
+// keeping the query, of a request.
+func (b Builder) buildPathRewrite(m *PathModifier) Handle {
+	if m.FullPath != "" {
+		return Handle{
+			"handler": "rewrite",
+			"uri":     m.FullPath,
+		}
+	}
+
+	// Both the prefix and its replacement are taken without the trailing slash,
+	// since a prefix only matches whole path segments.
+	prefix := strings.TrimSuffix(m.Prefix, "/")
+	replace := strings.TrimSuffix(m.ReplacePrefix, "/")
+	find := "^" + regexp.QuoteMeta(prefix)
+	if replace == "" {
+		find += "(/|$)"
+		replace = "/"
+	}
+	return Handle{
+		"handler": "rewrite",
+		"path_regexp": []map[string]string{
+			{"find": find, "replace": strings.ReplaceAll(replace, "$", "$$")},
+		},
+	}
+}
+
+// buildRedirect builds the handlers that respond with the redirect r.
+func (b Builder) buildRedirect(r *HTTPRedirect) []Handle {
+	var handle []Handle
+	if r.Path != nil {
+		handle = append(handle, b.buildPathRewrite(r.Path))
+	}
+
+	scheme := r.Scheme
+	if scheme == "" {
+		scheme = "{http.request.scheme}"
+	}
+	host := r.Hostname
+	if host == "" {
+		host = "{http.request.host}"
+	}
+	switch {
+	case r.Port != 0 && !isWellKnownPort(r.Scheme, r.Port):
+		host += ":" + strconv.Itoa(r.Port)
+	case r.Port == 0 && r.Scheme == "" && r.Hostname == "":
+		host = "{http.request.hostport}"
+	}
+
+	statusCode := r.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusFound
+	}
+	redirect := b.buildStaticResponse(statusCode)
+	redirect["headers"] = map[string][]string{
+		"Location": {scheme + "://" + host + "{http.request.uri}"},
+	}
+	return append(handle, redirect)
+}
+
+func (b Builder) buildStaticResponse(statusCode int) Handle {
+	return Handle{
+		"handler":     "static_response",
+		"status_code": statusCode,
+	}
+}
+
+// isWellKnownPort reports whether port is the default port of scheme, which
+// is omitted from a URL.
+func isWellKnownPort(scheme string, port int) bool {
+	return (scheme == "http" && port == 80) || (scheme == "https" && port == 443)
+}
+
+func (b Builder) buildService(svc *Service, port Port) Route {
+	id := routeID("service", svc.Key, port)
+
 	match := Match{
 		"host": []string{fullHost(svc.Name, svc.Namespace)},
 	}
-	return b.buildServiceProxy(match, svc)
+	r := b.buildServiceProxy(id+".proxy", match, svc, port)
+	r["@id"] = id
+	return r
 }
 
-func (b Builder) buildSubRoute(match Match, routes ...Route) Route {
+// buildSubRoute builds a route with a subroute handler, whose @id will be set
+// to id if it's not empty.
+func (b Builder) buildSubRoute(id string, match Match, routes ...Route) Route {
+	subroute := Handle{
+		"handler": "subroute",
+		"routes":  routes,
+	}
+	if id != "" {
+		subroute["@id"] = id
+	}
+
 	r := Route{
-		"handle": []Handle{
-			{
-				"handler": "subroute",
-				"routes":  routes,
-			},
-		},
+		"handle": []Handle{subroute},
 	}
 	if len(match) > 0 {
 		r["match"] = []Match{match}
@@ -109,17 +452,21 @@ func (b Builder) buildSubRoute(match Match, routes ...Route) Route {
 	return r
 }
 
-func (b Builder) buildServiceProxy(match Match, svc *Service) Route {
-	reverseProxy := b.buildReverseProxy(svc)
-	handle := []Handle{reverseProxy}
+// buildServiceProxy builds a route proxying to svc, whose reverse_proxy handler
+// has an @id of proxyID.
+func (b Builder) buildServiceProxy(proxyID string, match Match, svc *Service, port Port) Route {
+	reverseProxy := b.buildReverseProxy(svc, port)
+	reverseProxy["@id"] = proxyID
 
-	rateLimit := b.buildRateLimit(svc.Definitions)
-	if rateLimit != nil {
-		handle = []Handle{
-			rateLimit,
-			reverseProxy,
-		}
+	var handle []Handle
+	if rateLimit := b.buildRateLimit(svc.Definitions); rateLimit != nil {
+		handle = append(handle, rateLimit)
+	}
+	// Only the requests allowed by the rate limit are mirrored.
+	if mirror := b.buildMirror(svc.Mirror, port); mirror != nil {
+		handle = append(handle, mirror)
 	}
+	handle = append(handle, reverseProxy)
 
 	r := Route{"handle": handle}
 	if len(match) > 0 {
@@ -145,11 +492,45 @@ func (b Builder) buildRateLimit(d *Definitions) Handle {
 	return rateLimit
 }
 
-func (b Builder) buildReverseProxy(svc *Service) Handle {
+// buildMirror builds the handler that mirrors the requests received on port to
+// the pods of m, or nil if there's no pod to mirror to.
+func (b Builder) buildMirror(m *Mirror, port Port) Handle {
+	if m == nil {
+		return nil
+	}
+
+	ups, ok := m.Upstreams(backendPort(m.Port, port))
+	if !ok && m.Port == 0 && len(m.Ports) == 1 {
+		// Fall back to the only port of the mirror Service.
+		ups = m.Ports[0].Upstreams
+	}
+	if len(ups) == 0 {
+		return nil
+	}
+
 	var upstreams []map[string]interface{}
-	for _, ip := range svc.PodIPs {
+	for _, u := range ups {
 		upstreams = append(upstreams, map[string]interface{}{
-			"dial": fmt.Sprintf("%s:%d", ip, svc.PodPort),
+			"dial": u.Dial(),
+		})
+	}
+	mirror := Handle{
+		"handler":   "mirror",
+		"upstreams": upstreams,
+	}
+	if m.Percentage < 100 {
+		mirror["percentage"] = m.Percentage
+	}
+
+	return mirror
+}
+
+func (b Builder) buildReverseProxy(svc *Service, port Port) Handle {
+	var upstreams []map[string]interface{}
+	ups, _ := svc.Upstreams(port)
+	for _, u := range ups {
+		upstreams = append(upstreams, map[string]interface{}{
+			"dial": u.Dial(),
 		})
 	}
 
@@ -192,6 +573,44 @@ func (b Builder) buildReverseProxy(svc *Service) Handle {
 		}
 	}
 
+	var passive map[string]interface{}
+	if d := svc.Definitions; d != nil && d.CircuitBreakerFailDuration > 0 {
+		passive = map[string]interface{}{
+			"fail_duration": d.CircuitBreakerFailDuration,
+		}
+		if d.CircuitBreakerMaxFails > 0 {
+			passive["max_fails"] = d.CircuitBreakerMaxFails
+		}
+		if d.CircuitBreakerMaxRequests > 0 {
+			passive["unhealthy_request_count"] = d.CircuitBreakerMaxRequests
+		}
+		if len(d.CircuitBreakerUnhealthyStatus) > 0 {
+			passive["unhealthy_status"] = d.CircuitBreakerUnhealthyStatus
+		}
+		if d.CircuitBreakerUnhealthyLatency > 0 {
+			passive["unhealthy_latency"] = d.CircuitBreakerUnhealthyLatency
+		}
+	}
+
+	var active map[string]interface{}
+	if hc := svc.HealthCheck; hc != nil {
+		active = map[string]interface{}{
+			"uri": hc.Path,
+		}
+		if hc.Port > 0 {
+			active["port"] = hc.Port
+		}
+		if hc.Interval > 0 {
+			active["interval"] = hc.Interval
+		}
+		if hc.Timeout > 0 {
+			active["timeout"] = hc.Timeout
+		}
+		if len(hc.Headers) > 0 {
+			active["headers"] = hc.Headers
+		}
+	}
+
 	reverseProxy := Handle{
 		"handler":        "reverse_proxy",
 		"load_balancing": loadBalancing,
@@ -200,6 +619,16 @@ func (b Builder) buildReverseProxy(svc *Service) Handle {
 	if len(transport) > 0 {
 		reverseProxy["transport"] = transport
 	}
+	if len(active) > 0 || len(passive) > 0 {
+		healthChecks := make(map[string]interface{})
+		if len(active) > 0 {
+			healthChecks["active"] = active
+		}
+		if len(passive) > 0 {
+			healthChecks["passive"] = passive
+		}
+		reverseProxy["health_checks"] = healthChecks
+	}
 
 	return reverseProxy
 }
@@ -208,8 +637,41 @@ func fullHost(name, namespace string) string {
 	return name + "." + namespace + "." + dnspatcher.CaddyMeshDomain
 }
 
-func makeURL(ip string) string {
-	return fmt.Sprintf("http://%s:2019/load", ip)
+// uuidBound returns the UUID prefix that bounds the first n/total of all UUIDs,
+// which are compared lexicographically as lowercase hexadecimal strings.
+func uuidBound(n, total int) string {
+	return fmt.Sprintf("%04x", n*0x10000/total)
+}
+
+// routeID returns the Caddy @id of the route of the given kind, which is
+// built for the object identified by key, in the server listening on port.
+func routeID(kind string, key Key, port Port) string {
+	return fmt.Sprintf("%s.%s.%s.%d", kind, key.Namespace, key.Name, port)
+}
+
+// parseRouteID parses the @id of a route returned by routeID.
+func parseRouteID(id string) (kind string, key Key, port Port, ok bool) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 4 {
+		return "", Key{}, 0, false
+	}
+	p, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return "", Key{}, 0, false
+	}
+	return parts[0], Key{Namespace: parts[1], Name: parts[2]}, Port(p), true
+}
+
+// containerID returns the Caddy @id of the subroute handler that contains all
+// the routes of the given kind, in the server listening on port.
+func containerID(kind string, port Port) string {
+	return fmt.Sprintf("%s.%d", kind, port)
+}
+
+// makeURL returns the URL of the given path of the admin API of the Caddy
+// instance at ip.
+func makeURL(ip, path string) string {
+	return fmt.Sprintf("http://%s:2019%s", ip, path)
 }
 
 type SortStringer interface {
@@ -239,6 +701,16 @@ func NextMapValueInOrder[T map[K]V, K SortStringer, V any](m T) func() (value V,
 	}
 }
 
+// sortedKeys returns the keys of the given map in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func sortSlice[T SortStringer](s []T) {
 	sort.Slice(s, func(i, j int) bool {
 		return s[i].SortString() < s[j].SortString()
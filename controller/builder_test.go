@@ -12,79 +12,407 @@ import (
 )
 
 func TestBuilder_Build(t *testing.T) {
-	services := []*Service{
+	tests := []struct {
+		name       string
+		inServices []*Service
+		wantGolden string
+	}{
 		{
-			Key:     Key{Name: "service", Namespace: "test"},
-			Port:    Port(80),
-			PodPort: 80,
-			PodIPs:  []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"},
-			Definitions: &Definitions{
-				TrafficSplitExpression: "false",
-				TrafficSplitNewService: "service-2",
-				TrafficSplitOldService: "service-1",
+			name: "services",
+			inServices: []*Service{
+				{
+					Key:   Key{Name: "service", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+					Definitions: &Definitions{
+						TrafficSplitExpression: "false",
+						TrafficSplitNewService: "service-2",
+						TrafficSplitOldService: "service-1",
+					},
+				},
+				{
+					Key:   Key{Name: "service-1", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
+					HealthCheck: &HealthCheck{
+						Path:     "/healthz",
+						Port:     8081,
+						Interval: 10 * time.Second,
+						Timeout:  time.Second,
+					},
+					Definitions: &Definitions{
+						RetryCount:    2,
+						RetryDuration: 5 * time.Second,
+						RetryOn:       "path('/foo/*')",
+					},
+				},
+				{
+					Key:   Key{Name: "service-2", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+					Definitions: &Definitions{
+						RateLimitKey:  "{query.id}",
+						RateLimitRate: "2r/s",
+					},
+				},
+				{
+					Key: Key{Name: "service-3", Namespace: "test"},
+					Ports: []ServicePort{
+						{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.6", Port: 8080}, {IP: "127.0.0.7", Port: 8080}}},
+						{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.6", Port: 9091}, {IP: "127.0.0.7", Port: 9092}}},
+					},
+					Definitions: &Definitions{
+						TimeoutDialTimeout:  10 * time.Second,
+						TimeoutReadTimeout:  10 * time.Second,
+						TimeoutWriteTimeout: 10 * time.Second,
+
+						CircuitBreakerMaxFails:         3,
+						CircuitBreakerMaxRequests:      100,
+						CircuitBreakerFailDuration:     30 * time.Second,
+						CircuitBreakerUnhealthyStatus:  []int{5},
+						CircuitBreakerUnhealthyLatency: 2 * time.Second,
+					},
+				},
 			},
+			wantGolden: "config.json",
 		},
 		{
-			Key:     Key{Name: "service-1", Namespace: "test"},
-			Port:    Port(80),
-			PodPort: 80,
-			PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
-			Definitions: &Definitions{
-				RetryCount:    2,
-				RetryDuration: 5 * time.Second,
-				RetryOn:       "path('/foo/*')",
+			name: "weighted traffic split",
+			inServices: []*Service{
+				{
+					Key:   Key{Name: "service", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+					Definitions: &Definitions{
+						TrafficSplitExpression: "header_regexp('User-Agent', '^(?:.*Firefox.*)$')",
+						TrafficSplitBackends: []TrafficSplitBackend{
+							{Service: "service-1", Weight: 90},
+							{Service: "service-2", Weight: 5},
+							{Service: "service-3", Weight: 5},
+							{Service: "service-4", Weight: 0},
+						},
+					},
+				},
+				{
+					Key:   Key{Name: "service-1", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+				},
+				{
+					Key:   Key{Name: "service-2", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}}}},
+					Definitions: &Definitions{
+						RetryCount: 2,
+						RetryOn:    "true",
+					},
+				},
+				{
+					Key:   Key{Name: "service-3", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.5", Port: 80}}}},
+				},
 			},
+			wantGolden: "config-weighted.json",
 		},
 		{
-			Key:     Key{Name: "service-2", Namespace: "test"},
-			Port:    Port(80),
-			PodPort: 80,
-			PodIPs:  []string{"127.0.0.4", "127.0.0.5"},
-			Definitions: &Definitions{
-				RateLimitKey:  "{query.id}",
-				RateLimitRate: "2r/s",
+			name: "sticky traffic split",
+			inServices: []*Service{
+				{
+					Key:   Key{Name: "service", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+					Definitions: &Definitions{
+						// The backends are not listed in order.
+						TrafficSplitBackends: []TrafficSplitBackend{
+							{Service: "service-2", Weight: 5},
+							{Service: "service-1", Weight: 95},
+						},
+						TrafficSplitSticky: true,
+					},
+				},
+				{
+					Key:   Key{Name: "service-1", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+				},
+				{
+					Key:   Key{Name: "service-2", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}}}},
+				},
 			},
+			wantGolden: "config-sticky.json",
 		},
 		{
-			Key:     Key{Name: "service-3", Namespace: "test"},
-			Port:    Port(8080),
-			PodPort: 8080,
-			PodIPs:  []string{"127.0.0.6", "127.0.0.7"},
-			Definitions: &Definitions{
-				TimeoutDialTimeout:  10 * time.Second,
-				TimeoutReadTimeout:  10 * time.Second,
-				TimeoutWriteTimeout: 10 * time.Second,
+			name: "cross-namespace traffic split",
+			inServices: []*Service{
+				{
+					Key:   Key{Name: "service", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+					Definitions: &Definitions{
+						TrafficSplitBackends: []TrafficSplitBackend{
+							{Service: "service-1", Weight: 90},
+							// The only port of the backend is used.
+							{Service: "canary/service-2", Weight: 5},
+							{Service: "canary/service-3:9090", Weight: 5},
+						},
+					},
+				},
+				{
+					Key:   Key{Name: "service-1", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+				},
+				{
+					Key:   Key{Name: "service-2", Namespace: "canary"},
+					Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 3000}}}},
+				},
+				{
+					Key: Key{Name: "service-3", Namespace: "canary"},
+					Ports: []ServicePort{
+						{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.5", Port: 80}}},
+						{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.5", Port: 3000}}},
+					},
+				},
+			},
+			wantGolden: "config-cross-namespace.json",
+		},
+		{
+			name: "http route",
+			inServices: []*Service{
+				{
+					Key:   Key{Name: "service", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+					Definitions: &Definitions{
+						HTTPRouteRules: []HTTPRouteRule{
+							{
+								Expression: `{http.request.uri.path} == "/login"`,
+								Redirect: &HTTPRedirect{
+									Scheme:     "https",
+									Hostname:   "login.example.com",
+									StatusCode: 301,
+								},
+							},
+							{
+								Port:       80,
+								Expression: `path_regexp("^/api(/.*)?$")`,
+								RequestHeaders: &HeaderOps{
+									Set:    map[string]string{"X-Mesh": "caddy"},
+									Remove: []string{"X-Debug"},
+								},
+								ResponseHeaders: &HeaderOps{
+									Add: map[string][]string{"X-Served-By": {"caddy-mesh"}},
+								},
+								Rewrite: &HTTPRewrite{
+									Hostname: "api.test",
+									Path:     &PathModifier{Prefix: "/api", ReplacePrefix: "/v2"},
+								},
+								BackendRefs: []HTTPRouteBackendRef{
+									{Service: "service-1", Port: 80, Weight: 90},
+									{Service: "service-2", Port: 80, Weight: 10},
+								},
+							},
+							{
+								// Never matched since the Service has no such port.
+								Port:        8080,
+								BackendRefs: []HTTPRouteBackendRef{{Service: "service-1", Port: 80, Weight: 1}},
+							},
+							{
+								BackendRefs: []HTTPRouteBackendRef{{Service: "missing", Port: 80, Weight: 1}},
+							},
+						},
+					},
+				},
+				{
+					Key:   Key{Name: "service-1", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+				},
+				{
+					Key:   Key{Name: "service-2", Namespace: "test"},
+					Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}}}},
+				},
 			},
+			wantGolden: "config-httproute.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCaddyConfigurator(testLogger, func(ctx context.Context, name, namespace string) (*Service, error) {
+				key := Key{Name: name, Namespace: namespace}
+				for _, svc := range tt.inServices {
+					if svc.Key == key {
+						return svc, nil
+					}
+				}
+				return nil, nil
+			}, nil)
+			for _, svc := range tt.inServices {
+				c.Upsert(svc)
+			}
+
+			config := Builder{}.Build(c.servers)
+			got, err := json.MarshalIndent(config, "", "  ")
+			if err != nil {
+				t.Fatalf("err: %v\n", err)
+			}
+
+			want, err := ioutil.ReadFile("./testdata/" + tt.wantGolden)
+			if err != nil {
+				t.Fatalf("err: %v\n", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				diff := cmp.Diff(got, want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestBuilder_BuildTrafficSplit_MissingBackend(t *testing.T) {
+	root := &Service{
+		Key:   Key{Name: "service", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+	}
+	backend := &Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 3000}}}},
+	}
+
+	tests := []struct {
+		name   string
+		ts     *TrafficSplit
+		wantID string
+	}{
+		{
+			name:   "missing new service",
+			ts:     &TrafficSplit{Service: root, Expression: "false", OldService: backend, OldPort: 8080},
+			wantID: "trafficsplit.test.service.80.old.proxy",
+		},
+		{
+			name:   "missing old service",
+			ts:     &TrafficSplit{Service: root, Expression: "false", NewService: backend, NewPort: 8080},
+			wantID: "trafficsplit.test.service.80.new.proxy",
 		},
 	}
 
-	c := NewCaddyConfigurator(testLogger, func(ctx context.Context, name, namespace string) (*Service, error) {
-		key := Key{Name: name, Namespace: namespace}
-		for _, svc := range services {
-			if svc.Key == key {
-				return svc, nil
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Builder{}.buildTrafficSplit(tt.ts, 80)
+
+			// All requests are routed to the remaining backend.
+			routes := r["handle"].([]Handle)[0]["routes"].([]Route)
+			if len(routes) != 1 {
+				t.Fatalf("Routes: Got (%d) != Want (1)", len(routes))
 			}
+			if match, ok := routes[0]["match"]; ok {
+				t.Errorf("Match: Got (%v) != Want (none)", match)
+			}
+			proxy := routes[0]["handle"].([]Handle)[0]
+			if proxy["@id"] != tt.wantID {
+				t.Errorf("ID: Got (%v) != Want (%s)", proxy["@id"], tt.wantID)
+			}
+			wantUpstreams := []map[string]interface{}{{"dial": "127.0.0.3:3000"}}
+			if !cmp.Equal(proxy["upstreams"], wantUpstreams) {
+				diff := cmp.Diff(proxy["upstreams"], wantUpstreams)
+				t.Errorf("Upstreams: Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestBuilder_BuildServiceProxy_Mirror(t *testing.T) {
+	mirror := &Service{
+		Key: Key{Name: "service-2", Namespace: "test"},
+		Ports: []ServicePort{
+			{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}}},
+			{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 3000}}},
+		},
+	}
+	singlePort := &Service{
+		Key:   Key{Name: "service-3", Namespace: "test"},
+		Ports: []ServicePort{{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.5", Port: 9090}}}},
+	}
+	newService := func(m *Mirror) *Service {
+		return &Service{
+			Key:   Key{Name: "service", Namespace: "test"},
+			Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+			Definitions: &Definitions{
+				RateLimitKey:  "{remote_host}",
+				RateLimitRate: "10r/s",
+			},
+			Mirror: m,
 		}
-		return nil, nil
-	})
-	for _, svc := range services {
-		c.Upsert(svc)
 	}
 
-	config := Builder{}.Build(c.servers)
-	got, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		t.Fatalf("err: %v\n", err)
+	tests := []struct {
+		name   string
+		mirror *Mirror
+		want   []Handle
+	}{
+		{
+			name:   "no mirror",
+			mirror: nil,
+		},
+		{
+			name:   "same port",
+			mirror: &Mirror{Service: mirror, Percentage: 100},
+			want: []Handle{{
+				"handler":   "mirror",
+				"upstreams": []map[string]interface{}{{"dial": "127.0.0.3:80"}, {"dial": "127.0.0.4:80"}},
+			}},
+		},
+		{
+			name:   "other port with percentage",
+			mirror: &Mirror{Service: mirror, Port: 8080, Percentage: 10},
+			want: []Handle{{
+				"handler":    "mirror",
+				"upstreams":  []map[string]interface{}{{"dial": "127.0.0.3:3000"}},
+				"percentage": 10,
+			}},
+		},
+		{
+			name:   "only port",
+			mirror: &Mirror{Service: singlePort, Percentage: 100},
+			want: []Handle{{
+				"handler":   "mirror",
+				"upstreams": []map[string]interface{}{{"dial": "127.0.0.5:9090"}},
+			}},
+		},
+		{
+			name:   "missing port",
+			mirror: &Mirror{Service: mirror, Port: 9090, Percentage: 100},
+		},
 	}
 
-	want, err := ioutil.ReadFile("./testdata/config.json")
-	if err != nil {
-		t.Fatalf("err: %v\n", err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Builder{}.buildServiceProxy("service.test.service.80.proxy", nil, newService(tt.mirror), 80)
+
+			// The mirror, if any, is placed between the rate limit and the
+			// reverse proxy.
+			handle := r["handle"].([]Handle)
+			if len(handle) != len(tt.want)+2 {
+				t.Fatalf("Handlers: Got (%d) != Want (%d)", len(handle), len(tt.want)+2)
+			}
+			if handle[0]["handler"] != "rate_limit" || handle[len(handle)-1]["handler"] != "reverse_proxy" {
+				t.Errorf("Handlers: Got (%v)", handle)
+			}
+			got := handle[1 : len(handle)-1]
+			if len(tt.want) > 0 && !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
 	}
+}
 
-	if !bytes.Equal(got, want) {
-		diff := cmp.Diff(got, want)
-		t.Errorf("Want - Got: %s", diff)
+func TestUUIDBound(t *testing.T) {
+	tests := []struct {
+		n, total int
+		want     string
+	}{
+		{n: 0, total: 100, want: "0000"},
+		{n: 5, total: 100, want: "0ccc"},
+		{n: 50, total: 100, want: "8000"},
+		{n: 1, total: 3, want: "5555"},
+		{n: 99, total: 100, want: "fd70"},
+	}
+	for _, tt := range tests {
+		if got := uuidBound(tt.n, tt.total); got != tt.want {
+			t.Errorf("uuidBound(%d, %d): Got (%s) != Want (%s)", tt.n, tt.total, got, tt.want)
+		}
 	}
 }
 
@@ -1,12 +1,14 @@
 package controller
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,25 +17,72 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
+// ServiceGetter gets the Service of the given name and namespace, where a nil
+// Service without any error means the Service does not exist.
 type ServiceGetter func(ctx context.Context, name, namespace string) (*Service, error)
 
 type CaddyConfigurator struct {
 	logger        logr.Logger
 	serviceGetter ServiceGetter
+	options       *PushOptions
 
 	mu           sync.Mutex
 	servers      map[Port]*CaddyServer
-	servicePorts map[Key]Port
-	client       *http.Client
+	servicePorts map[Key][]Port
+	// pending is the number of changes made to the servers since the last
+	// commit, which happened between firstChangeAt and lastChangeAt.
+	pending       int
+	firstChangeAt time.Time
+	lastChangeAt  time.Time
+	// generation is increased whenever the changes have been committed.
+	generation uint64
+	// snapshot is the configuration built from the newest generation of servers.
+	snapshot *Snapshot
+	// good is the newest snapshot that has been accepted by any Caddy instance.
+	good *Snapshot
+	// isolated is the last snapshot from which the rejected routes have been
+	// isolated, to avoid isolating a snapshot repeatedly.
+	isolated    *Snapshot
+	quarantined map[string]*quarantinedRoute
+	proxies     map[string]*proxyState
+
+	// changedKeys are the services whose settings have been changed since the
+	// last commit.
+	changedKeys map[Key]bool
+	// settings are the last settings of each service (see Service.settings),
+	// to tell the changes of the settings from those of the endpoints.
+	settings map[Key]*Service
+	// changedAt is the generation in which each service has been changed,
+	// until the outcome has been reported.
+	changedAt map[Key]uint64
+	// failedAt is the generation whose failure has been reported for each
+	// service, to avoid reporting a failure repeatedly.
+	failedAt map[Key]uint64
+
+	// notifyC is used to wake up the push worker.
+	notifyC chan struct{}
+	client  *http.Client
+	makeURL func(ip, path string) string
+	now     func() time.Time
 }
 
-func NewCaddyConfigurator(logger logr.Logger, getter ServiceGetter) *CaddyConfigurator {
+func NewCaddyConfigurator(logger logr.Logger, getter ServiceGetter, options *PushOptions) *CaddyConfigurator {
 	return &CaddyConfigurator{
 		logger:        logger,
 		serviceGetter: getter,
+		options:       options.withDefaults(),
 		servers:       make(map[Port]*CaddyServer),
-		servicePorts:  make(map[Key]Port),
+		servicePorts:  make(map[Key][]Port),
+		quarantined:   make(map[string]*quarantinedRoute),
+		proxies:       make(map[string]*proxyState),
+		changedKeys:   make(map[Key]bool),
+		settings:      make(map[Key]*Service),
+		changedAt:     make(map[Key]uint64),
+		failedAt:      make(map[Key]uint64),
+		notifyC:       make(chan struct{}, 1),
 		client:        &http.Client{Timeout: 5 * time.Second},
+		makeURL:       makeURL,
+		now:           time.Now,
 	}
 }
 
@@ -41,32 +90,48 @@ func (c *CaddyConfigurator) Upsert(svc *Service) (changed bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	oldPort, ok := c.servicePorts[svc.Key]
-	if ok && oldPort != svc.Port {
-		// port has been changed, update the server associated with oldPort.
-		if s, ok := c.servers[oldPort]; ok {
-			if s.Delete(svc) {
-				changed = true
-			}
-			if s.IsEmpty() {
-				delete(c.servers, oldPort)
-			}
+	newPorts := svc.PortSet()
+	for _, oldPort := range c.servicePorts[svc.Key] {
+		if newPorts[oldPort] {
+			continue
+		}
+		// oldPort has been removed, update the server associated with oldPort.
+		if c.deleteFromServer(oldPort, svc) {
+			changed = true
 		}
 	}
 
-	c.servicePorts[svc.Key] = svc.Port
+	var ports []Port
+	for _, p := range svc.Ports {
+		ports = append(ports, p.Port)
 
-	s, ok := c.servers[svc.Port]
-	if !ok {
-		s = NewCaddyServer(c.logger, c.serviceGetter, svc.Port)
-		c.servers[svc.Port] = s
-		changed = true
+		s, ok := c.servers[p.Port]
+		if !ok {
+			s = NewCaddyServer(c.logger, c.serviceGetter, p.Port)
+			c.servers[p.Port] = s
+			changed = true
+		}
+
+		if s.Upsert(svc) {
+			changed = true
+		}
 	}
 
-	if s.Upsert(svc) {
-		changed = true
+	if len(ports) > 0 {
+		c.servicePorts[svc.Key] = ports
+	} else {
+		delete(c.servicePorts, svc.Key)
 	}
 
+	if changed {
+		// Only the changes of the settings are reported, rather than those of
+		// the endpoints, which change frequently (e.g. in a rolling update).
+		if settings := svc.settings(); !cmp.Equal(settings, c.settings[svc.Key]) {
+			c.settings[svc.Key] = settings
+			c.changedKeys[svc.Key] = true
+		}
+		c.markChanged()
+	}
 	return changed
 }
 
@@ -74,56 +139,101 @@ func (c *CaddyConfigurator) Delete(svc *Service) (changed bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	port := c.servicePorts[svc.Key]
-	s, ok := c.servers[port]
-	if !ok {
-		return false
+	for _, port := range c.servicePorts[svc.Key] {
+		if c.deleteFromServer(port, svc) {
+			changed = true
+		}
 	}
+	delete(c.servicePorts, svc.Key)
 
-	changed = s.Delete(svc)
-	if s.IsEmpty() {
-		delete(c.servers, svc.Port)
+	// Stop proxying to svc, if it's a backend of any Service, instead of
+	// keeping its stale pods.
+	for port, s := range c.servers {
+		for _, parent := range s.deleteBackend(svc.Key) {
+			c.changedKeys[parent] = true
+			changed = true
+		}
+		if s.IsEmpty() {
+			delete(c.servers, port)
+		}
+	}
+
+	if changed {
+		// There's no outcome to report for a deleted service.
+		delete(c.settings, svc.Key)
+		delete(c.changedKeys, svc.Key)
+		delete(c.changedAt, svc.Key)
+		delete(c.failedAt, svc.Key)
+		c.markChanged()
 	}
 	return changed
 }
 
-func (c *CaddyConfigurator) Apply(ips []string) (n int, err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// markChanged records a change made to the servers. The change is committed
+// immediately if coalescing is disabled, otherwise it's left to the push worker.
+// It must be called with c.mu held.
+func (c *CaddyConfigurator) markChanged() {
+	changesTotal.Inc()
 
-	config := Builder{}.Build(c.servers)
-	data, err := json.Marshal(config)
-	if err != nil {
-		return 0, err
+	now := c.now()
+	if c.pending == 0 {
+		c.firstChangeAt = now
 	}
+	c.lastChangeAt = now
+	c.pending++
 
-	for _, ip := range ips {
-		if err := c.apply(ip, data); err != nil {
-			return n, err
-		}
-		n++
+	if c.options.CoalesceWindow <= 0 {
+		c.commit()
+		return
 	}
-	return n, nil
+	c.notify()
 }
 
-func (c *CaddyConfigurator) apply(ip string, data []byte) error {
-	resp, err := c.client.Post(makeURL(ip), "application/json", bytes.NewBuffer(data))
+// commit creates a new snapshot from the current servers, and wakes up the
+// push worker. It must be called with c.mu held.
+func (c *CaddyConfigurator) commit() {
+	if c.pending > 0 {
+		changesPerCommit.Observe(float64(c.pending))
+		coalescedChangesTotal.Add(float64(c.pending - 1))
+		c.pending = 0
+	}
+	c.generation++
+
+	for key := range c.changedKeys {
+		c.changedAt[key] = c.generation
+	}
+	c.changedKeys = make(map[Key]bool)
+
+	data, err := json.Marshal(Builder{}.Build(c.servers))
+	if err != nil {
+		c.logger.Error(err, "could not marshal Caddy config", "generation", c.generation)
+		return
+	}
+	data, index, err := c.applyQuarantines(data)
 	if err != nil {
-		return err
+		// Fall back to loading the whole configuration.
+		c.logger.Error(err, "could not index Caddy config", "generation", c.generation)
 	}
-	defer resp.Body.Close()
+	if data == nil {
+		return
+	}
+	c.snapshot = &Snapshot{Generation: c.generation, Data: data, index: index}
+	c.notify()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		var errMsg struct {
-			Error string `json:"error"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&errMsg); err != nil {
-			return err
-		}
-		return fmt.Errorf(errMsg.Error)
+// deleteFromServer deletes svc from the server associated with port, and
+// removes the server if it becomes empty.
+func (c *CaddyConfigurator) deleteFromServer(port Port, svc *Service) (changed bool) {
+	s, ok := c.servers[port]
+	if !ok {
+		return false
 	}
 
-	return nil
+	changed = s.Delete(svc)
+	if s.IsEmpty() {
+		delete(c.servers, port)
+	}
+	return changed
 }
 
 type CaddyServer struct {
@@ -131,6 +241,7 @@ type CaddyServer struct {
 	serviceGetter ServiceGetter
 
 	port          Port
+	httpRoutings  map[Key]*HTTPRouting
 	trafficSplits map[Key]*TrafficSplit
 	services      map[Key]*Service
 }
@@ -140,12 +251,17 @@ func NewCaddyServer(logger logr.Logger, getter ServiceGetter, port Port) *CaddyS
 		logger:        logger,
 		serviceGetter: getter,
 		port:          port,
+		httpRoutings:  make(map[Key]*HTTPRouting),
 		trafficSplits: make(map[Key]*TrafficSplit),
 		services:      make(map[Key]*Service),
 	}
 }
 
 func (s *CaddyServer) Upsert(svc *Service) (changed bool) {
+	if s.upsertHTTPRouting(svc) {
+		changed = true
+	}
+
 	ts := s.toTrafficSplit(svc)
 	if ts != nil {
 		// svc has Traffic-Split definitions, add it as a TrafficSplit.
@@ -164,14 +280,20 @@ func (s *CaddyServer) Upsert(svc *Service) (changed bool) {
 			// If svc happens to be OldService or NewService of any TrafficSplit,
 			// try to update the corresponding values.
 			for _, ts := range s.trafficSplits {
-				if svc.Key == ts.NewService.Key && !cmp.Equal(svc, ts.NewService) {
+				if ts.NewService != nil && svc.Key == ts.NewService.Key && !cmp.Equal(svc, ts.NewService) {
 					ts.NewService = svc
 					changed = true
 				}
-				if svc.Key == ts.OldService.Key && !cmp.Equal(svc, ts.OldService) {
+				if ts.OldService != nil && svc.Key == ts.OldService.Key && !cmp.Equal(svc, ts.OldService) {
 					ts.OldService = svc
 					changed = true
 				}
+				for _, b := range ts.Backends {
+					if svc.Key == b.Key && !cmp.Equal(svc, b.Service) {
+						b.Service = svc
+						changed = true
+					}
+				}
 			}
 		}
 	}
@@ -187,11 +309,16 @@ func (s *CaddyServer) Upsert(svc *Service) (changed bool) {
 }
 
 func (s *CaddyServer) Delete(svc *Service) (changed bool) {
+	if _, ok := s.httpRoutings[svc.Key]; ok {
+		delete(s.httpRoutings, svc.Key)
+		changed = true
+	}
+
 	// Just remove svc if it's a TrafficSplit.
 	//
-	// NOTE: No need to remove svc if it's OldService or NewService of
-	// any TrafficSplit, since typically the deletion occurs in the cleanup
-	// stages of canary releases.
+	// NOTE: svc is not removed if it's a backend of any TrafficSplit, since
+	// svc may be removed from a single port only. See CaddyConfigurator.Delete
+	// for the deletion of backends.
 	if _, ok := s.trafficSplits[svc.Key]; ok {
 		delete(s.trafficSplits, svc.Key)
 		changed = true
@@ -205,8 +332,128 @@ func (s *CaddyServer) Delete(svc *Service) (changed bool) {
 	return changed
 }
 
+// deleteBackend removes the backend Service of key from all the TrafficSplits
+// and HTTPRoutings, and returns the keys of the affected ones. The traffic to
+// the backend of a TrafficSplit is routed to the remaining backends, or to the
+// root Service if none remains, while the requests to the backend of an
+// HTTPRouting are rejected as if the backend has never been found.
+func (s *CaddyServer) deleteBackend(key Key) (parents []Key) {
+	for k, ts := range s.trafficSplits {
+		affected := false
+		if ts.NewService != nil && ts.NewService.Key == key {
+			ts.NewService, ts.NewPort = nil, 0
+			affected = true
+		}
+		if ts.OldService != nil && ts.OldService.Key == key {
+			ts.OldService, ts.OldPort = nil, 0
+			affected = true
+		}
+		var backends []*WeightedService
+		for _, b := range ts.Backends {
+			if b.Key == key {
+				affected = true
+				continue
+			}
+			backends = append(backends, b)
+		}
+		ts.Backends = backends
+		if !affected {
+			continue
+		}
+
+		if ts.isEmpty() {
+			delete(s.trafficSplits, k)
+		}
+		parents = append(parents, k)
+	}
+
+	for k, r := range s.httpRoutings {
+		affected := false
+		for _, rule := range r.Rules {
+			for _, b := range rule.Backends {
+				if b.Service != nil && b.Key == key {
+					b.Service = nil
+					affected = true
+				}
+			}
+		}
+		if affected {
+			parents = append(parents, k)
+		}
+	}
+
+	return parents
+}
+
 func (s *CaddyServer) IsEmpty() bool {
-	return len(s.trafficSplits) == 0 && len(s.services) == 0
+	return len(s.httpRoutings) == 0 && len(s.trafficSplits) == 0 && len(s.services) == 0
+}
+
+// upsertHTTPRouting adds svc as an HTTPRouting if it has any HTTPRoute rule
+// applying to the port, or removes it otherwise. If svc happens to be a backend
+// of any HTTPRouting, the backend is also updated.
+func (s *CaddyServer) upsertHTTPRouting(svc *Service) (changed bool) {
+	if r := s.toHTTPRouting(svc); r != nil {
+		existing, ok := s.httpRoutings[svc.Key]
+		if !ok || !cmp.Equal(r, existing) {
+			s.httpRoutings[svc.Key] = r
+			changed = true
+		}
+	} else if _, ok := s.httpRoutings[svc.Key]; ok {
+		delete(s.httpRoutings, svc.Key)
+		changed = true
+	}
+
+	for _, r := range s.httpRoutings {
+		for _, rule := range r.Rules {
+			for _, b := range rule.Backends {
+				if b.Service != nil && svc.Key == b.Key && !cmp.Equal(svc, b.Service) {
+					b.Service = svc
+					changed = true
+				}
+			}
+		}
+	}
+
+	return changed
+}
+
+// toHTTPRouting returns an HTTPRouting with the HTTPRoute rules of svc that
+// apply to the port, or nil if there's no such rule.
+func (s *CaddyServer) toHTTPRouting(svc *Service) *HTTPRouting {
+	d := svc.Definitions
+	if d == nil {
+		return nil
+	}
+
+	r := &HTTPRouting{Service: svc}
+	for i := range d.HTTPRouteRules {
+		rule := &d.HTTPRouteRules[i]
+		if rule.Port != 0 && rule.Port != s.port {
+			continue
+		}
+
+		resolved := &RoutingRule{HTTPRouteRule: rule}
+		for _, ref := range rule.BackendRefs {
+			// An invalid or missing backend is kept, to which the requests
+			// will be rejected, so that the weights of the others hold.
+			routed := &RoutedBackend{Port: ref.Port, Weight: ref.Weight}
+			if ref.Service != "" {
+				backend, err := s.serviceGetter(context.Background(), ref.Service, svc.Namespace)
+				if err != nil {
+					s.logger.Error(err, "could not get Kubernetes Service", "name", ref.Service, "namespace", svc.Namespace)
+				} else {
+					routed.Service = backend
+				}
+			}
+			resolved.Backends = append(resolved.Backends, routed)
+		}
+		r.Rules = append(r.Rules, resolved)
+	}
+	if len(r.Rules) == 0 {
+		return nil
+	}
+	return r
 }
 
 func (s *CaddyServer) toTrafficSplit(svc *Service) *TrafficSplit {
@@ -215,37 +462,122 @@ func (s *CaddyServer) toTrafficSplit(svc *Service) *TrafficSplit {
 		return nil
 	}
 
+	if len(d.TrafficSplitBackends) > 0 {
+		return s.toWeightedTrafficSplit(svc)
+	}
+
 	if d.TrafficSplitExpression == "" || d.TrafficSplitNewService == "" || d.TrafficSplitOldService == "" {
 		return nil
 	}
 
-	newService, err := s.serviceGetter(context.Background(), d.TrafficSplitNewService, svc.Namespace)
-	if err != nil {
-		s.logger.Error(err, "could not get Kubernetes Service", "name", d.TrafficSplitNewService, "namespace", svc.Namespace)
+	newService, newPort, ok := s.getBackend(svc, d.TrafficSplitNewService)
+	if !ok {
 		return nil
 	}
 
-	oldService, err := s.serviceGetter(context.Background(), d.TrafficSplitOldService, svc.Namespace)
-	if err != nil {
-		s.logger.Error(err, "could not get Kubernetes Service", "name", d.TrafficSplitOldService, "namespace", svc.Namespace)
+	oldService, oldPort, ok := s.getBackend(svc, d.TrafficSplitOldService)
+	if !ok {
 		return nil
 	}
 
+	if newService == nil && oldService == nil {
+		// Both backends are missing, route all requests to svc itself.
+		return nil
+	}
 	return &TrafficSplit{
 		Service:    svc,
 		Expression: d.TrafficSplitExpression,
 		NewService: newService,
 		OldService: oldService,
+		NewPort:    newPort,
+		OldPort:    oldPort,
 	}
 }
 
+// toWeightedTrafficSplit returns a TrafficSplit among the weighted backends of
+// svc, or nil if there's no existing backend with a positive weight.
+func (s *CaddyServer) toWeightedTrafficSplit(svc *Service) *TrafficSplit {
+	d := svc.Definitions
+	ts := &TrafficSplit{
+		Service:    svc,
+		Expression: d.TrafficSplitExpression,
+	}
+	type backendKey struct {
+		Key
+		Port Port
+	}
+	seen := make(map[backendKey]*WeightedService)
+	for _, b := range d.TrafficSplitBackends {
+		if b.Weight <= 0 {
+			continue
+		}
+		backend, port, ok := s.getBackend(svc, b.Service)
+		if !ok {
+			return nil
+		}
+		if backend == nil {
+			// The backend does not exist yet (e.g. it's about to be created
+			// by Flagger), route to the others.
+			continue
+		}
+		key := backendKey{Key: backend.Key, Port: port}
+		if ws, ok := seen[key]; ok {
+			// Merge the duplicate backends.
+			ws.Weight += b.Weight
+			continue
+		}
+		ws := &WeightedService{Service: backend, Port: port, Weight: b.Weight}
+		ts.Backends = append(ts.Backends, ws)
+		seen[key] = ws
+	}
+	if len(ts.Backends) == 0 {
+		return nil
+	}
+	return ts
+}
+
+// getBackend returns the backend Service of svc referenced by ref, along with
+// the port of the backend to which the requests are proxied. The port is zero
+// if it's the same as the port of the server. The backend is nil if it does
+// not exist, while ok is false if it could not be got.
+func (s *CaddyServer) getBackend(svc *Service, ref string) (backend *Service, port Port, ok bool) {
+	r, err := parseBackendRef(ref)
+	if err != nil {
+		// Invalid references have been rejected while decoding.
+		s.logger.Error(err, "bad backend of traffic split", "name", svc.Name, "namespace", svc.Namespace)
+		return nil, 0, false
+	}
+
+	key := r.Key(svc.Namespace)
+	backend, err = s.serviceGetter(context.Background(), key.Name, key.Namespace)
+	if err != nil {
+		s.logger.Error(err, "could not get Kubernetes Service", "name", key.Name, "namespace", key.Namespace)
+		return nil, 0, false
+	}
+	if backend == nil {
+		s.logger.Info("Traffic-split backend not found", "name", svc.Name, "namespace", svc.Namespace, "backend", key.Name, "backendNamespace", key.Namespace)
+		return nil, 0, true
+	}
+
+	port = r.Port
+	if port == 0 && len(backend.Ports) == 1 && !backend.PortSet()[s.port] {
+		// Fall back to the only port of the backend.
+		port = backend.Ports[0].Port
+	}
+	if port == s.port {
+		port = 0
+	}
+	return backend, port, true
+}
+
 // String implements fmt.Stringer. This is mainly used for testing purpose.
 func (s *CaddyServer) String() string {
 	if s == nil {
 		return "<nil>"
 	}
-	return fmt.Sprintf("{Port:%d TrafficSplits:%v Services:%v}",
+	return fmt.Sprintf("{Port:%d HTTPRoutings:%v TrafficSplits:%v Services:%v}",
 		s.port,
+		s.httpRoutings,
 		s.trafficSplits,
 		s.services,
 	)
@@ -270,11 +602,47 @@ func (k Key) SortString() string {
 type Service struct {
 	Key
 
-	// TODO: Add support for multiple ports per Service
-	Port        Port
-	PodPort     int
-	PodIPs      []string
+	Ports       []ServicePort
+	HealthCheck *HealthCheck
 	Definitions *Definitions
+	// Mirror, if not nil, is the Service to which the requests are mirrored.
+	Mirror *Mirror
+}
+
+// Upstreams returns the upstreams to which the given port of the Service is mapped.
+func (s *Service) Upstreams(port Port) ([]Upstream, bool) {
+	for _, p := range s.Ports {
+		if p.Port == port {
+			return p.Upstreams, true
+		}
+	}
+	return nil, false
+}
+
+// settings returns a copy of the Service without the upstreams, neither of its
+// own nor of its mirror, which tells the settings of the Service apart from its
+// endpoints.
+func (s *Service) settings() *Service {
+	out := *s
+	out.Ports = make([]ServicePort, len(s.Ports))
+	for i, p := range s.Ports {
+		out.Ports[i] = ServicePort{Port: p.Port}
+	}
+	if s.Mirror != nil && s.Mirror.Service != nil {
+		mirror := *s.Mirror
+		mirror.Service = s.Mirror.Service.settings()
+		out.Mirror = &mirror
+	}
+	return &out
+}
+
+// PortSet returns all the ports of the Service as a set.
+func (s *Service) PortSet() map[Port]bool {
+	set := make(map[Port]bool, len(s.Ports))
+	for _, p := range s.Ports {
+		set[p.Port] = true
+	}
+	return set
 }
 
 // String implements fmt.Stringer. This is mainly used for testing purpose.
@@ -285,6 +653,61 @@ func (s *Service) String() string {
 	return fmt.Sprintf("%+v", *s)
 }
 
+// ServicePort maps a port of a Service to the pods behind it. Since a named
+// target port may be resolved to different numbers on different pods, each
+// upstream carries its own port.
+type ServicePort struct {
+	Port      Port
+	Upstreams []Upstream
+}
+
+// Upstream is a pod serving a port of a Service.
+type Upstream struct {
+	IP   string
+	Port int
+}
+
+// Dial returns the network address of the upstream.
+func (u Upstream) Dial() string {
+	return net.JoinHostPort(u.IP, strconv.Itoa(u.Port))
+}
+
+// Mirror is a Service, along with its pods, to which a copy of the requests to
+// another Service is sent.
+type Mirror struct {
+	*Service
+
+	// Port is the port of the Service, to which the requests are mirrored,
+	// where zero means the port on which the requests are received.
+	Port       Port
+	Percentage int
+}
+
+// String implements fmt.Stringer. This is mainly used for testing purpose.
+func (m *Mirror) String() string {
+	if m == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *m)
+}
+
+// HealthCheck is an active health check against each pod of a Service.
+type HealthCheck struct {
+	Path     string
+	Port     int
+	Interval time.Duration
+	Timeout  time.Duration
+	Headers  map[string][]string
+}
+
+// String implements fmt.Stringer. This is mainly used for testing purpose.
+func (h *HealthCheck) String() string {
+	if h == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *h)
+}
+
 // TrafficSplit a Service with Traffic-Split definitions.
 //
 // Note that the current implementation is inspired by but a little different with
@@ -295,6 +718,47 @@ type TrafficSplit struct {
 	Expression string
 	NewService *Service
 	OldService *Service
+	// NewPort and OldPort are the ports of NewService and OldService, to which
+	// the requests are proxied, where zero means the port of the server.
+	NewPort Port
+	OldPort Port
+
+	// Backends, if not empty, take the place of NewService and OldService.
+	// The requests matched by Expression, or all requests if Expression is
+	// empty, are split among Backends by weight, while the unmatched ones
+	// are routed to the root Service.
+	//
+	// Missing backends are left out. If either NewService or OldService is
+	// missing, all requests are routed to the other one.
+	Backends []*WeightedService
+}
+
+// isEmpty reports whether there's no backend left.
+func (t *TrafficSplit) isEmpty() bool {
+	return len(t.Backends) == 0 && t.NewService == nil && t.OldService == nil
+}
+
+// WeightedService is a backend Service of a TrafficSplit along with its weight.
+type WeightedService struct {
+	*Service
+
+	// Port is the port of the Service, to which the requests are proxied,
+	// where zero means the port of the server.
+	Port   Port
+	Weight int
+}
+
+// Label returns the name of the backend, which is qualified by its namespace
+// and port if they differ from those of root.
+func (w *WeightedService) Label(root Key) string {
+	label := w.Name
+	if w.Namespace != root.Namespace {
+		label += "." + w.Namespace
+	}
+	if w.Port != 0 {
+		label += "." + strconv.Itoa(int(w.Port))
+	}
+	return label
 }
 
 // String implements fmt.Stringer. This is mainly used for testing purpose.
@@ -305,6 +769,39 @@ func (t *TrafficSplit) String() string {
 	return fmt.Sprintf("%+v", *t)
 }
 
+// HTTPRouting a Service with the rules of the HTTPRoutes attaching to it.
+type HTTPRouting struct {
+	*Service
+
+	// Rules are in order of precedence. The requests unmatched by any rule
+	// are routed as if there were no HTTPRoute.
+	Rules []*RoutingRule
+}
+
+// String implements fmt.Stringer. This is mainly used for testing purpose.
+func (r *HTTPRouting) String() string {
+	if r == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *r)
+}
+
+// RoutingRule is an HTTPRouteRule along with its resolved backends.
+type RoutingRule struct {
+	*HTTPRouteRule
+
+	Backends []*RoutedBackend
+}
+
+// RoutedBackend is a backend Service of a RoutingRule, where Service is nil
+// if the backend could not be found.
+type RoutedBackend struct {
+	*Service
+
+	Port   Port
+	Weight int
+}
+
 type Definitions struct {
 	TimeoutDialTimeout  time.Duration `json:"mesh.caddyserver.com/timeout-dial-timeout,omitempty"`
 	TimeoutReadTimeout  time.Duration `json:"mesh.caddyserver.com/timeout-read-timeout,omitempty"`
@@ -319,6 +816,26 @@ type Definitions struct {
 	// For the syntax of the value, see https://caddyserver.com/docs/caddyfile/matchers#expression.
 	RetryOn string `json:"mesh.caddyserver.com/retry-on,omitempty"`
 
+	CircuitBreakerMaxFails    int `json:"mesh.caddyserver.com/circuit-breaker-max-fails,omitempty"`
+	CircuitBreakerMaxRequests int `json:"mesh.caddyserver.com/circuit-breaker-max-requests,omitempty"`
+	// CircuitBreakerFailDuration specifies how long to remember a failed request
+	// to a backend. If any other circuit-breaker definition is specified,
+	// CircuitBreakerFailDuration will default to 30s, which enables the breaker.
+	CircuitBreakerFailDuration time.Duration `json:"mesh.caddyserver.com/circuit-breaker-fail-duration,omitempty"`
+	// CircuitBreakerUnhealthyStatus specifies the status codes that count a
+	// response as failed. The value is a comma-separated list, in which a class
+	// of status codes can be given as "5xx".
+	CircuitBreakerUnhealthyStatus  []int         `json:"mesh.caddyserver.com/circuit-breaker-unhealthy-status,omitempty"`
+	CircuitBreakerUnhealthyLatency time.Duration `json:"mesh.caddyserver.com/circuit-breaker-unhealthy-latency,omitempty"`
+
+	// HealthCheckPath, HealthCheckPort, HealthCheckInterval and HealthCheckTimeout
+	// override the corresponding settings of the active health check, which is
+	// derived from the HTTP readiness probe of the Service's pods by default.
+	HealthCheckPath     string        `json:"mesh.caddyserver.com/health-check-path,omitempty"`
+	HealthCheckPort     int           `json:"mesh.caddyserver.com/health-check-port,omitempty"`
+	HealthCheckInterval time.Duration `json:"mesh.caddyserver.com/health-check-interval,omitempty"`
+	HealthCheckTimeout  time.Duration `json:"mesh.caddyserver.com/health-check-timeout,omitempty"`
+
 	RateLimitKey      string `json:"mesh.caddyserver.com/rate-limit-key,omitempty"`
 	RateLimitRate     string `json:"mesh.caddyserver.com/rate-limit-rate,omitempty"`
 	RateLimitZoneSize int    `json:"mesh.caddyserver.com/rate-limit-zone-size,omitempty"`
@@ -331,12 +848,158 @@ type Definitions struct {
 	TrafficSplitExpression string `json:"mesh.caddyserver.com/traffic-split-expression,omitempty"`
 	TrafficSplitNewService string `json:"mesh.caddyserver.com/traffic-split-new-service,omitempty"`
 	TrafficSplitOldService string `json:"mesh.caddyserver.com/traffic-split-old-service,omitempty"`
+	// TrafficSplitBackends, if not empty, are the backend Services among which
+	// the requests are split by weight, instead of TrafficSplitNewService and
+	// TrafficSplitOldService. The value is a comma-separated list of weighted
+	// backends (e.g. "server-v1=95,server-v2=5"), where each weight is relative
+	// to the sum of all weights. If TrafficSplitExpression is also specified,
+	// only the matched requests are split.
+	//
+	// Each backend, as well as TrafficSplitNewService and TrafficSplitOldService,
+	// is referenced in the form of "[namespace/]name[:port]" (see BackendRef).
+	// A backend in another namespace must be granted by its Namespace (see
+	// ReferenceGrantAnnotation).
+	//
+	// Note that the backends of the SMI TrafficSplit, if any, whose root is the
+	// Service take precedence over this annotation.
+	TrafficSplitBackends []TrafficSplitBackend `json:"mesh.caddyserver.com/traffic-split-backends,omitempty"`
+	// TrafficSplitSticky specifies whether to keep a client on the backend it
+	// first hit, by means of a cookie, when splitting requests by weight.
+	TrafficSplitSticky bool `json:"mesh.caddyserver.com/traffic-split-sticky,omitempty"`
+
+	// MirrorService, if specified, is the Service to whose pods a copy of the
+	// requests is sent, in a fire-and-forget manner, while the responses are
+	// discarded. It's referenced in the form of "[namespace/]name[:port]" (see
+	// BackendRef), as the traffic-split backends are.
+	MirrorService string `json:"mesh.caddyserver.com/mirror-service,omitempty"`
+	// MirrorPercentage is the percentage of the requests to be mirrored, which
+	// defaults to 100 if MirrorService is specified.
+	MirrorPercentage int `json:"mesh.caddyserver.com/mirror-percentage,omitempty"`
+
+	// HTTPRouteRules are the rules, in order of precedence, of the Gateway API
+	// HTTPRoutes attaching to the Service. They are translated from HTTPRoutes
+	// rather than from annotations.
+	HTTPRouteRules []HTTPRouteRule `json:"-"`
+}
+
+// HTTPRouteRule is a routing rule translated from a match of an HTTPRoute rule,
+// whose filters and backends are shared by all the matches of the rule.
+type HTTPRouteRule struct {
+	// Port is the port of the Service to which the rule applies, where zero
+	// means all ports.
+	Port Port
+	// Expression specifies the condition required to match a request, where
+	// an empty one matches all requests.
+	Expression string
+
+	RequestHeaders  *HeaderOps
+	ResponseHeaders *HeaderOps
+	// Redirect, if specified, responds to the matched requests with a
+	// redirect instead of proxying them to BackendRefs.
+	Redirect *HTTPRedirect
+	Rewrite  *HTTPRewrite
+
+	// BackendRefs are the backend Services among which the matched requests
+	// are split by weight. If there's no backend with a positive weight, the
+	// requests will be rejected.
+	BackendRefs []HTTPRouteBackendRef
+}
+
+// HeaderOps are the modifications of the headers of a request or a response.
+type HeaderOps struct {
+	Set    map[string]string
+	Add    map[string][]string
+	Remove []string
+}
+
+// HTTPRedirect specifies the redirect, any empty field of which defaults to the
+// corresponding part of the request URL.
+type HTTPRedirect struct {
+	Scheme     string
+	Hostname   string
+	Port       int
+	Path       *PathModifier
+	StatusCode int
+}
+
+// HTTPRewrite specifies how to rewrite the URL of a request.
+type HTTPRewrite struct {
+	Hostname string
+	Path     *PathModifier
+}
+
+// PathModifier replaces the full path of a request with FullPath if it's not
+// empty, or otherwise the matched Prefix of the path with ReplacePrefix.
+type PathModifier struct {
+	FullPath      string
+	Prefix        string
+	ReplacePrefix string
+}
+
+// HTTPRouteBackendRef is a backend Service, by name, along with its port and weight.
+type HTTPRouteBackendRef struct {
+	Service string
+	Port    Port
+	Weight  int
+}
+
+// TrafficSplitBackend is a backend Service, by reference (see BackendRef),
+// along with its weight.
+type TrafficSplitBackend struct {
+	Service string
+	Weight  int
+}
+
+// BackendRef refers to a backend Service of a traffic split, in the form of
+// "[namespace/]name[:port]".
+type BackendRef struct {
+	Name string
+	// Namespace is the namespace of the backend, where empty means the
+	// namespace of the root Service.
+	Namespace string
+	// Port is the port of the backend, where zero means the port of the root
+	// Service or, if the backend has no such port, its only port.
+	Port Port
+}
+
+func parseBackendRef(s string) (BackendRef, error) {
+	var ref BackendRef
+	rest := s
+	if namespace, name, ok := strings.Cut(rest, "/"); ok {
+		ref.Namespace, rest = namespace, name
+		if namespace == "" {
+			return BackendRef{}, fmt.Errorf("invalid backend %q, want the form [namespace/]name[:port]", s)
+		}
+	}
+	if name, port, ok := strings.Cut(rest, ":"); ok {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return BackendRef{}, fmt.Errorf("invalid port %q of backend %q", port, s)
+		}
+		rest, ref.Port = name, Port(p)
+	}
+	if rest == "" || strings.ContainsAny(rest, "/:") {
+		return BackendRef{}, fmt.Errorf("invalid backend %q, want the form [namespace/]name[:port]", s)
+	}
+	ref.Name = rest
+	return ref, nil
+}
+
+// Key returns the key of the backend, whose root Service is in namespace.
+func (r BackendRef) Key(namespace string) Key {
+	if r.Namespace != "" {
+		namespace = r.Namespace
+	}
+	return Key{Name: r.Name, Namespace: namespace}
 }
 
 func NewDefinitions(annotations map[string]string) (*Definitions, error) {
 	codec := structool.New().TagName("json").DecodeHook(
 		structool.DecodeStringToDuration,
 		structool.DecodeStringToNumber,
+		decodeStringToStatusCodes,
+		decodeStringToTrafficSplitBackends,
+		decodeStringToBool,
 	)
 
 	d := new(Definitions)
@@ -348,9 +1011,158 @@ func NewDefinitions(annotations map[string]string) (*Definitions, error) {
 		d.RetryOn = "true"
 	}
 
+	if d.CircuitBreakerFailDuration == 0 && (d.CircuitBreakerMaxFails > 0 ||
+		d.CircuitBreakerMaxRequests > 0 ||
+		len(d.CircuitBreakerUnhealthyStatus) > 0 ||
+		d.CircuitBreakerUnhealthyLatency > 0) {
+		d.CircuitBreakerFailDuration = 30 * time.Second
+	}
+
+	if _, ok := annotations["mesh.caddyserver.com/mirror-percentage"]; !ok && d.MirrorService != "" {
+		d.MirrorPercentage = 100
+	}
+	if d.MirrorPercentage < 0 || d.MirrorPercentage > 100 {
+		return nil, fmt.Errorf("invalid percentage in 'mesh.caddyserver.com/mirror-percentage': %d, want 0 to 100", d.MirrorPercentage)
+	}
+
+	for _, r := range []struct {
+		name string
+		ref  string
+	}{
+		{name: "mesh.caddyserver.com/traffic-split-new-service", ref: d.TrafficSplitNewService},
+		{name: "mesh.caddyserver.com/traffic-split-old-service", ref: d.TrafficSplitOldService},
+		{name: "mesh.caddyserver.com/mirror-service", ref: d.MirrorService},
+	} {
+		if r.ref == "" {
+			continue
+		}
+		if _, err := parseBackendRef(r.ref); err != nil {
+			return nil, fmt.Errorf("invalid backend in '%s': %w", r.name, err)
+		}
+	}
+
+	// Reject invalid expressions here, since Caddy would otherwise reject
+	// the whole configuration with an opaque error.
+	for _, e := range []struct {
+		name string
+		expr string
+	}{
+		{name: "mesh.caddyserver.com/retry-on", expr: d.RetryOn},
+		{name: "mesh.caddyserver.com/traffic-split-expression", expr: d.TrafficSplitExpression},
+	} {
+		if e.expr == "" {
+			continue
+		}
+		if err := validateExpression(e.expr); err != nil {
+			return nil, fmt.Errorf("invalid expression in '%s': %w", e.name, err)
+		}
+	}
+
 	return d, nil
 }
 
+// decodeStringToStatusCodes decodes a comma-separated list of status codes
+// (e.g. "500,502,503") into []int. A class of status codes (e.g. "5xx") is
+// decoded into its first digit, which is how Caddy matches status classes.
+func decodeStringToStatusCodes(next structool.DecodeHookFunc) structool.DecodeHookFunc {
+	return func(from, to reflect.Value) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return next(from, to)
+		}
+		if _, ok := to.Interface().([]int); !ok {
+			return next(from, to)
+		}
+
+		var codes []int
+		for _, s := range strings.Split(from.Interface().(string), ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if len(s) == 3 && strings.HasSuffix(s, "xx") {
+				s = s[:1]
+			}
+			code, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status code %q", s)
+			}
+			codes = append(codes, code)
+		}
+		return codes, nil
+	}
+}
+
+// decodeStringToTrafficSplitBackends decodes a comma-separated list of weighted
+// backends (e.g. "server-v1=95,server-v2=5") into []TrafficSplitBackend.
+func decodeStringToTrafficSplitBackends(next structool.DecodeHookFunc) structool.DecodeHookFunc {
+	return func(from, to reflect.Value) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return next(from, to)
+		}
+		if _, ok := to.Interface().([]TrafficSplitBackend); !ok {
+			return next(from, to)
+		}
+		return parseTrafficSplitBackends(from.Interface().(string))
+	}
+}
+
+func parseTrafficSplitBackends(s string) ([]TrafficSplitBackend, error) {
+	var backends []TrafficSplitBackend
+	for _, b := range strings.Split(s, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(b, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid backend %q, want the form name=weight", b)
+		}
+		if _, err := parseBackendRef(name); err != nil {
+			return nil, err
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q of backend %q", weight, name)
+		}
+		backends = append(backends, TrafficSplitBackend{Service: name, Weight: w})
+	}
+	return backends, nil
+}
+
+// decodeStringToBool decodes a string into bool, as strconv.ParseBool does.
+func decodeStringToBool(next structool.DecodeHookFunc) structool.DecodeHookFunc {
+	return func(from, to reflect.Value) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return next(from, to)
+		}
+		if _, ok := to.Interface().(bool); !ok {
+			return next(from, to)
+		}
+		return strconv.ParseBool(from.Interface().(string))
+	}
+}
+
+// DeepCopy returns a copy of d, whose slices are not shared with d. Note that
+// the elements of the slices are copied shallowly, since they are replaced as
+// a whole rather than modified.
+func (d *Definitions) DeepCopy() *Definitions {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	if d.CircuitBreakerUnhealthyStatus != nil {
+		out.CircuitBreakerUnhealthyStatus = append(make([]int, 0, len(d.CircuitBreakerUnhealthyStatus)), d.CircuitBreakerUnhealthyStatus...)
+	}
+	if d.TrafficSplitBackends != nil {
+		out.TrafficSplitBackends = append(make([]TrafficSplitBackend, 0, len(d.TrafficSplitBackends)), d.TrafficSplitBackends...)
+	}
+	if d.HTTPRouteRules != nil {
+		out.HTTPRouteRules = append(make([]HTTPRouteRule, 0, len(d.HTTPRouteRules)), d.HTTPRouteRules...)
+	}
+	return &out
+}
+
 // String implements fmt.Stringer. This is mainly used for testing purpose.
 func (d *Definitions) String() string {
 	if d == nil {
@@ -18,14 +18,11 @@ var (
 	}
 )
 
-func testMakeServicePortsFromServers(servers map[Port]*CaddyServer) map[Key]Port {
-	m := make(map[Key]Port)
+func testMakeServicePortsFromServers(servers map[Port]*CaddyServer) map[Key][]Port {
+	m := make(map[Key][]Port)
 	for _, s := range servers {
-		for _, ts := range s.trafficSplits {
-			m[ts.Key] = s.port
-		}
 		for _, svc := range s.services {
-			m[svc.Key] = s.port
+			m[svc.Key] = append(m[svc.Key], s.port)
 		}
 	}
 	return m
@@ -43,10 +40,8 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 			name:    "add new service",
 			servers: nil,
 			service: &Service{
-				Key:     Key{Name: "service-1", Namespace: "test"},
-				Port:    Port(80),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 			},
 			wantChanged: true,
 			wantServers: map[Port]*CaddyServer{
@@ -54,10 +49,41 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					port: 80,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "add service with missing weighted backends",
+			servers: nil,
+			service: &Service{
+				Key:   Key{Name: "service", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+				Definitions: &Definitions{
+					TrafficSplitBackends: []TrafficSplitBackend{
+						{Service: "service-1", Weight: 95},
+						{Service: "service-2", Weight: 5},
+					},
+				},
+			},
+			wantChanged: true,
+			wantServers: map[Port]*CaddyServer{
+				Port(80): {
+					port:          80,
+					trafficSplits: map[Key]*TrafficSplit{},
+					services: map[Key]*Service{
+						Key{Name: "service", Namespace: "test"}: {
+							Key:   Key{Name: "service", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+							Definitions: &Definitions{
+								TrafficSplitBackends: []TrafficSplitBackend{
+									{Service: "service-1", Weight: 95},
+									{Service: "service-2", Weight: 5},
+								},
+							},
 						},
 					},
 				},
@@ -70,19 +96,15 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					port: 80,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 					},
 				},
 			},
 			service: &Service{
-				Key:     Key{Name: "service-1", Namespace: "test"},
-				Port:    Port(80),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 			},
 			wantChanged: false,
 			wantServers: map[Port]*CaddyServer{
@@ -90,10 +112,8 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					port: 80,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 					},
 				},
@@ -106,19 +126,15 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					port: 80,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 					},
 				},
 			},
 			service: &Service{
-				Key:     Key{Name: "service-1", Namespace: "test"},
-				Port:    Port(8080),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 			},
 			wantChanged: true,
 			wantServers: map[Port]*CaddyServer{
@@ -126,10 +142,114 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					port: 8080,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(8080),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "add service port",
+			servers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
+						},
+					},
+				},
+			},
+			service: &Service{
+				Key: Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{
+					{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+					{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+				},
+			},
+			wantChanged: true,
+			wantServers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+					},
+				},
+				Port(9090): {
+					port: 9090,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "remove service port",
+			servers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+						Key{Name: "service-2", Namespace: "test"}: {
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+						},
+					},
+				},
+				Port(9090): {
+					port: 9090,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+					},
+				},
+			},
+			service: &Service{
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}}},
+			},
+			wantChanged: true,
+			wantServers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-2", Namespace: "test"}: {
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+						},
+					},
+				},
+				Port(9090): {
+					port: 9090,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}}},
 						},
 					},
 				},
@@ -143,10 +263,8 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					trafficSplits: map[Key]*TrafficSplit{
 						Key{Name: "service", Namespace: "test"}: {
 							Service: &Service{
-								Key:     Key{Name: "service", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"},
+								Key:   Key{Name: "service", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 								Definitions: &Definitions{
 									TrafficSplitExpression: "false",
 									TrafficSplitNewService: "service-2",
@@ -155,46 +273,34 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 							},
 							Expression: "false",
 							NewService: &Service{
-								Key:     Key{Name: "service-2", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.4", "127.0.0.5"},
+								Key:   Key{Name: "service-2", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 							},
 							OldService: &Service{
-								Key:     Key{Name: "service-1", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+								Key:   Key{Name: "service-1", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 							},
 						},
 					},
 					services: map[Key]*Service{
 						Key{Name: "service", Namespace: "test"}: {
-							Key:     Key{Name: "service", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"},
+							Key:   Key{Name: "service", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 						},
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 						Key{Name: "service-2", Namespace: "test"}: {
-							Key:     Key{Name: "service-2", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.4", "127.0.0.5"},
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 						},
 					},
 				},
 			},
 			service: &Service{
-				Key:     Key{Name: "service-2", Namespace: "test"},
-				Port:    Port(80),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.6", "127.0.0.7"},
+				Key:   Key{Name: "service-2", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.6", Port: 80}, {IP: "127.0.0.7", Port: 80}}}},
 			},
 			wantChanged: true,
 			wantServers: map[Port]*CaddyServer{
@@ -203,10 +309,8 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 					trafficSplits: map[Key]*TrafficSplit{
 						Key{Name: "service", Namespace: "test"}: {
 							Service: &Service{
-								Key:     Key{Name: "service", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"},
+								Key:   Key{Name: "service", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 								Definitions: &Definitions{
 									TrafficSplitExpression: "false",
 									TrafficSplitNewService: "service-2",
@@ -215,37 +319,27 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 							},
 							Expression: "false",
 							NewService: &Service{
-								Key:     Key{Name: "service-2", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.6", "127.0.0.7"},
+								Key:   Key{Name: "service-2", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.6", Port: 80}, {IP: "127.0.0.7", Port: 80}}}},
 							},
 							OldService: &Service{
-								Key:     Key{Name: "service-1", Namespace: "test"},
-								Port:    Port(80),
-								PodPort: 80,
-								PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+								Key:   Key{Name: "service-1", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 							},
 						},
 					},
 					services: map[Key]*Service{
 						Key{Name: "service", Namespace: "test"}: {
-							Key:     Key{Name: "service", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"},
+							Key:   Key{Name: "service", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}, {IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
 						},
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 						Key{Name: "service-2", Namespace: "test"}: {
-							Key:     Key{Name: "service-2", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.6", "127.0.0.7"},
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.6", Port: 80}, {IP: "127.0.0.7", Port: 80}}}},
 						},
 					},
 				},
@@ -255,7 +349,7 @@ func TestCaddyConfigurator_Upsert(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := NewCaddyConfigurator(testLogger, testGetter)
+			c := NewCaddyConfigurator(testLogger, testGetter, nil)
 			if len(tt.servers) > 0 {
 				c.servers = tt.servers
 				c.servicePorts = testMakeServicePortsFromServers(tt.servers)
@@ -288,10 +382,8 @@ func TestCaddyConfigurator_Delete(t *testing.T) {
 			name:    "delete non-existent service",
 			servers: nil,
 			service: &Service{
-				Key:     Key{Name: "service-1", Namespace: "test"},
-				Port:    Port(80),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 			},
 			wantChanged: false,
 			wantServers: nil,
@@ -303,28 +395,157 @@ func TestCaddyConfigurator_Delete(t *testing.T) {
 					port: 80,
 					services: map[Key]*Service{
 						Key{Name: "service-1", Namespace: "test"}: {
-							Key:     Key{Name: "service-1", Namespace: "test"},
-							Port:    Port(80),
-							PodPort: 80,
-							PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+							Key:   Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 						},
 					},
 				},
 			},
 			service: &Service{
-				Key:     Key{Name: "service-1", Namespace: "test"},
-				Port:    Port(80),
-				PodPort: 80,
-				PodIPs:  []string{"127.0.0.2", "127.0.0.3"},
+				Key:   Key{Name: "service-1", Namespace: "test"},
+				Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}}},
 			},
 			wantChanged: true,
 			wantServers: nil,
 		},
+		{
+			name: "delete multi-port service",
+			servers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+						Key{Name: "service-2", Namespace: "test"}: {
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+						},
+					},
+				},
+				Port(9090): {
+					port: 9090,
+					services: map[Key]*Service{
+						Key{Name: "service-1", Namespace: "test"}: {
+							Key: Key{Name: "service-1", Namespace: "test"},
+							Ports: []ServicePort{
+								{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}, {IP: "127.0.0.3", Port: 80}}},
+								{Port: 9090, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 9090}, {IP: "127.0.0.3", Port: 9090}}},
+							},
+						},
+					},
+				},
+			},
+			service: &Service{
+				Key: Key{Name: "service-1", Namespace: "test"},
+			},
+			wantChanged: true,
+			wantServers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					services: map[Key]*Service{
+						Key{Name: "service-2", Namespace: "test"}: {
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 80}, {IP: "127.0.0.5", Port: 80}}}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "delete traffic-split backend",
+			servers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					trafficSplits: map[Key]*TrafficSplit{
+						Key{Name: "service", Namespace: "test"}: {
+							Service: &Service{
+								Key:   Key{Name: "service", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+							},
+							Expression: "false",
+							NewService: &Service{
+								Key:   Key{Name: "service-2", Namespace: "test"},
+								Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 8080}}}},
+							},
+							NewPort: 8080,
+							OldService: &Service{
+								Key:   Key{Name: "service-1", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+							},
+						},
+						Key{Name: "other", Namespace: "test"}: {
+							Service: &Service{
+								Key:   Key{Name: "other", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.5", Port: 80}}}},
+							},
+							Backends: []*WeightedService{
+								{
+									Service: &Service{
+										Key:   Key{Name: "service-2", Namespace: "test"},
+										Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 8080}}}},
+									},
+									Port:   8080,
+									Weight: 1,
+								},
+							},
+						},
+					},
+					services: map[Key]*Service{
+						Key{Name: "service", Namespace: "test"}: {
+							Key:   Key{Name: "service", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+						},
+					},
+				},
+				Port(8080): {
+					port: 8080,
+					services: map[Key]*Service{
+						Key{Name: "service-2", Namespace: "test"}: {
+							Key:   Key{Name: "service-2", Namespace: "test"},
+							Ports: []ServicePort{{Port: 8080, Upstreams: []Upstream{{IP: "127.0.0.4", Port: 8080}}}},
+						},
+					},
+				},
+			},
+			service: &Service{
+				Key: Key{Name: "service-2", Namespace: "test"},
+			},
+			wantChanged: true,
+			wantServers: map[Port]*CaddyServer{
+				Port(80): {
+					port: 80,
+					trafficSplits: map[Key]*TrafficSplit{
+						Key{Name: "service", Namespace: "test"}: {
+							Service: &Service{
+								Key:   Key{Name: "service", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+							},
+							Expression: "false",
+							OldService: &Service{
+								Key:   Key{Name: "service-1", Namespace: "test"},
+								Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+							},
+						},
+					},
+					services: map[Key]*Service{
+						Key{Name: "service", Namespace: "test"}: {
+							Key:   Key{Name: "service", Namespace: "test"},
+							Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := NewCaddyConfigurator(testLogger, testGetter)
+			c := NewCaddyConfigurator(testLogger, testGetter, nil)
 			if len(tt.servers) > 0 {
 				c.servers = tt.servers
 				c.servicePorts = testMakeServicePortsFromServers(tt.servers)
@@ -395,6 +616,47 @@ func TestNewDefinitions(t *testing.T) {
 				RetryOn:       "true",
 			},
 		},
+		{
+			name: "retry on",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-count": "2",
+				"mesh.caddyserver.com/retry-on":    "{http.reverse_proxy.status_code} in [502, 503] && method('GET', 'HEAD')",
+			},
+			want: &Definitions{
+				RetryCount: 2,
+				RetryOn:    "{http.reverse_proxy.status_code} in [502, 503] && method('GET', 'HEAD')",
+			},
+		},
+		{
+			name: "bad retry on",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-on": "{http.reverse_proxy.status_code} == 502 && methods('GET')",
+			},
+			want:    nil,
+			wantErr: "invalid expression in 'mesh.caddyserver.com/retry-on': 1:51: undeclared reference to 'methods' (in container '')",
+		},
+		{
+			name: "circuit breaker",
+			in: map[string]string{
+				"mesh.caddyserver.com/circuit-breaker-max-fails":         "3",
+				"mesh.caddyserver.com/circuit-breaker-unhealthy-status":  "5xx, 429",
+				"mesh.caddyserver.com/circuit-breaker-unhealthy-latency": "2s",
+			},
+			want: &Definitions{
+				CircuitBreakerMaxFails:         3,
+				CircuitBreakerFailDuration:     30 * time.Second,
+				CircuitBreakerUnhealthyStatus:  []int{5, 429},
+				CircuitBreakerUnhealthyLatency: 2 * time.Second,
+			},
+		},
+		{
+			name: "bad circuit breaker status",
+			in: map[string]string{
+				"mesh.caddyserver.com/circuit-breaker-unhealthy-status": "50x",
+			},
+			want:    nil,
+			wantErr: "1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/circuit-breaker-unhealthy-status': invalid status code \"50x\"",
+		},
 		{
 			name: "traffic split",
 			in: map[string]string{
@@ -408,6 +670,115 @@ func TestNewDefinitions(t *testing.T) {
 				TrafficSplitOldService: "service-1",
 			},
 		},
+		{
+			name: "weighted traffic split",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=95, service-2 = 5",
+				"mesh.caddyserver.com/traffic-split-sticky":   "true",
+			},
+			want: &Definitions{
+				TrafficSplitBackends: []TrafficSplitBackend{
+					{Service: "service-1", Weight: 95},
+					{Service: "service-2", Weight: 5},
+				},
+				TrafficSplitSticky: true,
+			},
+		},
+		{
+			name: "bad traffic split weight",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=95,service-2=-5",
+			},
+			want:    nil,
+			wantErr: "1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/traffic-split-backends': invalid weight \"-5\" of backend \"service-2\"",
+		},
+		{
+			name: "bad traffic split backend",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1",
+			},
+			want:    nil,
+			wantErr: "1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/traffic-split-backends': invalid backend \"service-1\", want the form name=weight",
+		},
+		{
+			name: "cross-namespace traffic split",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "false",
+				"mesh.caddyserver.com/traffic-split-new-service": "canary/service-2:8080",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+				"mesh.caddyserver.com/traffic-split-backends":    "service-1=95,canary/service-2:8080=5",
+			},
+			want: &Definitions{
+				TrafficSplitExpression: "false",
+				TrafficSplitNewService: "canary/service-2:8080",
+				TrafficSplitOldService: "service-1",
+				TrafficSplitBackends: []TrafficSplitBackend{
+					{Service: "service-1", Weight: 95},
+					{Service: "canary/service-2:8080", Weight: 5},
+				},
+			},
+		},
+		{
+			name: "bad traffic split service",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-new-service": "/service-2",
+			},
+			want:    nil,
+			wantErr: "invalid backend in 'mesh.caddyserver.com/traffic-split-new-service': invalid backend \"/service-2\", want the form [namespace/]name[:port]",
+		},
+		{
+			name: "bad traffic split backend port",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=95,canary/service-2:http=5",
+			},
+			want:    nil,
+			wantErr: "1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/traffic-split-backends': invalid port \"http\" of backend \"canary/service-2:http\"",
+		},
+		{
+			name: "mirror",
+			in: map[string]string{
+				"mesh.caddyserver.com/mirror-service": "canary/service-2:8080",
+			},
+			want: &Definitions{
+				MirrorService:    "canary/service-2:8080",
+				MirrorPercentage: 100,
+			},
+		},
+		{
+			name: "mirror with percentage",
+			in: map[string]string{
+				"mesh.caddyserver.com/mirror-service":    "service-2",
+				"mesh.caddyserver.com/mirror-percentage": "0",
+			},
+			want: &Definitions{
+				MirrorService: "service-2",
+			},
+		},
+		{
+			name: "bad mirror service",
+			in: map[string]string{
+				"mesh.caddyserver.com/mirror-service": "service-2:http",
+			},
+			want:    nil,
+			wantErr: "invalid backend in 'mesh.caddyserver.com/mirror-service': invalid port \"http\" of backend \"service-2:http\"",
+		},
+		{
+			name: "bad mirror percentage",
+			in: map[string]string{
+				"mesh.caddyserver.com/mirror-service":    "service-2",
+				"mesh.caddyserver.com/mirror-percentage": "150",
+			},
+			want:    nil,
+			wantErr: "invalid percentage in 'mesh.caddyserver.com/mirror-percentage': 150, want 0 to 100",
+		},
+		{
+			name: "bad traffic split expression",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression": "header({'User-Agent': '*Chrome*'}) &&",
+			},
+			want:    nil,
+			wantErr: "invalid expression in 'mesh.caddyserver.com/traffic-split-expression': 1:38: Syntax error: mismatched input '<EOF>' expecting {'[', '{', '(', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}",
+		},
 	}
 
 	for _, tt := range tests {
@@ -429,3 +800,83 @@ func TestNewDefinitions(t *testing.T) {
 		})
 	}
 }
+
+func TestCaddyServer_ToTrafficSplit_MissingBackends(t *testing.T) {
+	existing := &Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+	}
+	getter := func(ctx context.Context, name, namespace string) (*Service, error) {
+		if (Key{Name: name, Namespace: namespace}) == existing.Key {
+			return existing, nil
+		}
+		return nil, nil
+	}
+	newRoot := func(d *Definitions) *Service {
+		return &Service{
+			Key:         Key{Name: "service", Namespace: "test"},
+			Ports:       []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+			Definitions: d,
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   *Definitions
+		want func(root *Service) *TrafficSplit
+	}{
+		{
+			name: "missing new service",
+			in: &Definitions{
+				TrafficSplitExpression: "false",
+				TrafficSplitNewService: "service-2",
+				TrafficSplitOldService: "service-1",
+			},
+			want: func(root *Service) *TrafficSplit {
+				return &TrafficSplit{Service: root, Expression: "false", OldService: existing}
+			},
+		},
+		{
+			name: "missing new and old services",
+			in: &Definitions{
+				TrafficSplitExpression: "false",
+				TrafficSplitNewService: "service-2",
+				TrafficSplitOldService: "service-3",
+			},
+			want: func(root *Service) *TrafficSplit { return nil },
+		},
+		{
+			name: "missing weighted backend",
+			in: &Definitions{
+				TrafficSplitBackends: []TrafficSplitBackend{
+					{Service: "service-1", Weight: 95},
+					{Service: "service-2", Weight: 5},
+				},
+			},
+			want: func(root *Service) *TrafficSplit {
+				return &TrafficSplit{Service: root, Backends: []*WeightedService{{Service: existing, Weight: 95}}}
+			},
+		},
+		{
+			name: "missing all weighted backends",
+			in: &Definitions{
+				TrafficSplitBackends: []TrafficSplitBackend{
+					{Service: "service-2", Weight: 5},
+				},
+			},
+			want: func(root *Service) *TrafficSplit { return nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := newRoot(tt.in)
+			got := NewCaddyServer(testLogger, getter, 80).toTrafficSplit(root)
+			want := tt.want(root)
+			if !cmp.Equal(got, want) {
+				diff := cmp.Diff(got, want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
@@ -3,26 +3,86 @@ package controller
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/discovery/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
-	"github.com/RussellLuo/caddy-mesh/dnspatcher"
+	gw "github.com/RussellLuo/caddy-mesh/api/gateway/v1beta1"
+	smi "github.com/RussellLuo/caddy-mesh/api/smi/v1alpha4"
+	"github.com/RussellLuo/caddy-mesh/api/v1alpha1"
 )
 
+// resyncInterval is the interval between retries of the initial resync.
+const resyncInterval = 5 * time.Second
+
+// proxyLabels are the labels of the pods of caddy-mesh-proxy.
+var proxyLabels = map[string]string{
+	"app":       "caddy-mesh",
+	"component": "proxy",
+}
+
 type Config struct {
 	ProxyNamespace    string
 	IgnoredNamespaces []string
+	// HealthProbeAddress is the address on which the health probes (i.e.
+	// /healthz and /readyz) are served.
+	HealthProbeAddress string
+	// PushConcurrency is the maximum number of Caddy instances to which the
+	// configuration is pushed in parallel.
+	PushConcurrency int
+	// CoalesceWindow and CoalesceMaxDelay control how bursts of changes are
+	// coalesced into a single push, where a zero CoalesceWindow disables
+	// coalescing. See PushOptions for details.
+	CoalesceWindow   time.Duration
+	CoalesceMaxDelay time.Duration
+	// AnnotationMode determines how unknown annotations are handled.
+	AnnotationMode AnnotationMode
+	// WebhookPort is the port on which the admission webhook is served, where
+	// zero means the webhook is disabled.
+	WebhookPort int
+	// WebhookCertDir is the directory containing the serving certificate
+	// (tls.crt and tls.key) of the admission webhook.
+	WebhookCertDir string
+	// DefaultsConfigMap is the name of the mesh-wide ConfigMap, in the proxy
+	// namespace, holding the default annotations of all Services. An empty
+	// name means there are no mesh-wide defaults.
+	DefaultsConfigMap string
+	// EnableMeshPolicy enables the support for MeshPolicies, which requires
+	// the CRD of MeshPolicy (v1alpha1) to be installed.
+	EnableMeshPolicy bool
+	// EnableSMI enables the support for the SMI TrafficSplit, which requires
+	// the CRDs of TrafficSplit and HTTPRouteGroup (v1alpha4) to be installed.
+	EnableSMI bool
+	// EnableGatewayAPI enables the support for the Gateway API HTTPRoute, as
+	// per the GAMMA mesh profile, which requires the CRD of HTTPRoute (v1beta1)
+	// to be installed.
+	EnableGatewayAPI bool
 }
 
 type Controller struct {
@@ -30,41 +90,214 @@ type Controller struct {
 	manager      manager.Manager
 	configurator *CaddyConfigurator
 	client       client.Client
+	recorder     record.EventRecorder
 	config       *Config
+
+	// filters determine which Services are eligible to join the mesh.
+	filters []predicate.Predicate
+	// synced will be closed once the initial resync has finished.
+	synced chan struct{}
+
+	mu sync.Mutex
+	// definitions are the last good definitions of the Services, as decoded
+	// from the annotations, which are kept if the annotations of a Service
+	// become invalid.
+	definitions map[Key]*Definitions
+	// annotationErrors are the annotation errors of the Services, as well as
+	// those of the defaults, by reason, that have been raised as Events.
+	annotationErrors map[annotationEvent]string
+}
+
+type annotationEvent struct {
+	Kind string
+	Key
+	Reason string
 }
 
 func New(logger logr.Logger, cfg *Config) (*Controller, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := smi.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := gw.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
 	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{
+		Scheme: scheme,
+		// Only cache the mesh-wide ConfigMap, which is the only one read
+		// by the controller.
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.ConfigMap{}: {
+					Field: fields.SelectorFromSet(fields.Set{
+						"metadata.namespace": cfg.ProxyNamespace,
+						"metadata.name":      cfg.DefaultsConfigMap,
+					}),
+				},
+			},
+		}),
 		ClientDisableCacheFor: []client.Object{
-			&corev1.ConfigMap{},
 			&corev1.Secret{},
 		},
+		HealthProbeBindAddress: cfg.HealthProbeAddress,
+		Port:                   cfg.WebhookPort,
+		CertDir:                cfg.WebhookCertDir,
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	c := &Controller{
-		logger:  logger,
-		manager: mgr,
-		client:  mgr.GetClient(),
-		config:  cfg,
+		logger:   logger,
+		manager:  mgr,
+		client:   mgr.GetClient(),
+		recorder: mgr.GetEventRecorderFor("caddy-mesh-controller"),
+		config:   cfg,
+		filters: []predicate.Predicate{
+			IgnoreNamespaces(metav1.NamespaceSystem),
+			IgnoreNamespaces(cfg.IgnoredNamespaces...),
+			IgnoreService(metav1.NamespaceDefault, "kubernetes"),
+			IgnoreLabel("app", "caddy-mesh"),
+		},
+		synced:           make(chan struct{}),
+		definitions:      make(map[Key]*Definitions),
+		annotationErrors: make(map[annotationEvent]string),
+	}
+	c.configurator = NewCaddyConfigurator(logger, c.getService, &PushOptions{
+		Concurrency:      cfg.PushConcurrency,
+		CoalesceWindow:   cfg.CoalesceWindow,
+		CoalesceMaxDelay: cfg.CoalesceMaxDelay,
+		Recorder:         c,
+	})
+
+	if err := c.indexBackends(context.Background()); err != nil {
+		return nil, err
 	}
-	c.configurator = NewCaddyConfigurator(logger, c.getService)
 
+	b := builder.
+		ControllerManagedBy(mgr).
+		For(&corev1.Service{}, builder.WithPredicates(c.filters...)).
+		Owns(&v1beta1.EndpointSlice{}, builder.WithPredicates(c.filters...)). // Watch for EndpointSlice events
+		// Watch for the backends, and their endpoints, to re-reconcile the
+		// Services splitting or routing traffic to them.
+		Watches(&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapBackend),
+		).
+		Watches(&source.Kind{Type: &v1beta1.EndpointSlice{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapBackend),
+		).
+		// Watch for the defaults, to re-reconcile the affected Services.
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapNamespace),
+			builder.WithPredicates(predicate.AnnotationChangedPredicate{}),
+		)
+	if cfg.EnableMeshPolicy {
+		// Watch for the policies, to re-reconcile the targeted Services.
+		b = b.Watches(&source.Kind{Type: &v1alpha1.MeshPolicy{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapPolicy),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		)
+	}
+	if cfg.DefaultsConfigMap != "" {
+		b = b.Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapMeshDefaults),
+			builder.WithPredicates(
+				OnlyNamespace(cfg.ProxyNamespace),
+				OnlyName(cfg.DefaultsConfigMap),
+			),
+		)
+	}
+	if cfg.EnableSMI {
+		b = b.
+			Watches(&source.Kind{Type: &smi.TrafficSplit{}},
+				handler.EnqueueRequestsFromMapFunc(c.mapTrafficSplit),
+			).
+			Watches(&source.Kind{Type: &smi.HTTPRouteGroup{}},
+				handler.EnqueueRequestsFromMapFunc(c.mapHTTPRouteGroup),
+			)
+	}
+	if cfg.EnableGatewayAPI {
+		b = b.Watches(&source.Kind{Type: &gw.HTTPRoute{}},
+			handler.EnqueueRequestsFromMapFunc(c.mapHTTPRoute),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		)
+	}
+	if err := b.Complete(reconcile.Func(c.Reconcile)); err != nil {
+		return nil, err
+	}
+
+	if cfg.EnableMeshPolicy {
+		// Watch for the policies, and the Services they may target, to keep
+		// the status of the policies up to date.
+		err = builder.
+			ControllerManagedBy(mgr).
+			Named("meshpolicy").
+			For(&v1alpha1.MeshPolicy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+			Watches(&source.Kind{Type: &corev1.Service{}},
+				handler.EnqueueRequestsFromMapFunc(mapNamespaceRequest),
+				builder.WithPredicates(predicate.And(c.filters...), predicate.LabelChangedPredicate{}),
+			).
+			Complete(reconcile.Func(c.ReconcilePolicies))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.EnableGatewayAPI {
+		// Watch for the HTTPRoutes, and the Services they may attach to or
+		// route to, to keep the status of the routes up to date.
+		err = builder.
+			ControllerManagedBy(mgr).
+			Named("httproute").
+			For(&gw.HTTPRoute{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+			Watches(&source.Kind{Type: &corev1.Service{}},
+				handler.EnqueueRequestsFromMapFunc(mapNamespaceRequest),
+				builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{})),
+			).
+			Complete(reconcile.Func(c.ReconcileHTTPRoutes))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Watch for the pods of caddy-mesh-proxy, to push the configuration to
+	// any Caddy instance that has just started.
 	err = builder.
 		ControllerManagedBy(mgr).
-		WithEventFilter(IgnoreNamespaces(metav1.NamespaceSystem)).
-		WithEventFilter(IgnoreNamespaces(cfg.IgnoredNamespaces...)).
-		WithEventFilter(IgnoreService(metav1.NamespaceDefault, "kubernetes")).
-		WithEventFilter(IgnoreLabel("app", "caddy-mesh")).
-		For(&corev1.Service{}).
-		Owns(&v1beta1.EndpointSlice{}). // Watch for EndpointSlice events
-		Complete(reconcile.Func(c.Reconcile))
+		Named("proxy").
+		For(&corev1.Pod{}, builder.WithPredicates(
+			OnlyNamespace(cfg.ProxyNamespace),
+			OnlyLabels(proxyLabels),
+		)).
+		Complete(reconcile.Func(c.ReconcileProxies))
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.WebhookPort > 0 {
+		// Read Services from the API server directly, since the webhook
+		// might be called before the informer caches have been synced.
+		validator := NewServiceValidator(mgr.GetAPIReader(), cfg.AnnotationMode)
+		mgr.GetWebhookServer().Register(ValidateServicePath, &webhook.Admission{Handler: validator})
+	}
+
+	if err := mgr.Add(manager.RunnableFunc(c.resync)); err != nil {
+		return nil, err
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return nil, err
+	}
+	if err := mgr.AddReadyzCheck("resync", c.checkSynced); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
@@ -82,22 +315,15 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 		return reconcile.Result{}, err
 	}
 
-	proxyService := &corev1.Service{}
-	if err1 := c.client.Get(ctx, client.ObjectKey{Name: dnspatcher.CaddyMeshProxyName, Namespace: c.config.ProxyNamespace}, proxyService); err1 != nil {
-		return reconcile.Result{}, err1
-	}
-
-	proxyIPs, err1 := c.getPodIPs(ctx, proxyService)
-	if err != nil {
-		return reconcile.Result{}, err1
-	}
-
 	if errors.IsNotFound(err) {
 		svc := &Service{Key: Key{Name: req.Name, Namespace: req.Namespace}}
+		c.setDefinitions(svc.Key, nil)
+		c.changedAnnotationError("Service", svc.Key, ReasonInvalidAnnotation, nil)
+		c.changedAnnotationError("Service", svc.Key, ReasonUnknownAnnotation, nil)
+		c.changedAnnotationError("Service", svc.Key, ReasonReferenceNotPermitted, nil)
 		if c.configurator.Delete(svc) {
-			c.logger.Info("Deleting Caddy upstream backends", "host", fullHost(upstreamService.Name, upstreamService.Namespace))
-			_, err = c.configurator.Apply(proxyIPs)
-			return reconcile.Result{}, err
+			c.logger.Info("Deleting Caddy upstream backends", "host", fullHost(req.Name, req.Namespace))
+			return reconcile.Result{}, nil
 		}
 
 		c.logger.Info("No changes made, since all Caddy instances are in-sync")
@@ -108,59 +334,520 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if err != nil {
 		return reconcile.Result{}, err
 	}
+	c.warnAnnotations(upstreamService)
+	c.checkBackends(ctx, upstreamService, svc.Definitions)
+
 	if c.configurator.Upsert(svc) {
-		n, err := c.configurator.Apply(proxyIPs)
-		c.logger.Info(fmt.Sprintf("%d/%d Caddy instances haven been synchronized successfully", n, len(proxyIPs)))
-		return reconcile.Result{}, err
+		c.logger.Info("Updating Caddy upstream backends", "host", fullHost(req.Name, req.Namespace))
+		return reconcile.Result{}, nil
 	}
 
 	c.logger.Info("No changes made, since all Caddy instances are in-sync")
 	return reconcile.Result{}, nil
 }
 
+// ReconcileProxies keeps track of all the ready pods of caddy-mesh-proxy, to
+// which the configuration will be pushed.
+func (c *Controller) ReconcileProxies(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	c.logger.Info("Reconciling proxy", "name", req.Name, "namespace", req.Namespace)
+
+	pods := &corev1.PodList{}
+	if err := c.client.List(ctx, pods, client.InNamespace(c.config.ProxyNamespace), client.MatchingLabels(proxyLabels)); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	var proxies []Proxy
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !isPodReady(&pod) {
+			continue
+		}
+		proxies = append(proxies, Proxy{
+			IP:          pod.Status.PodIP,
+			Incarnation: podIncarnation(&pod),
+		})
+	}
+	c.configurator.SetProxies(proxies)
+
+	return reconcile.Result{}, nil
+}
+
+// resync rebuilds the complete state from all the eligible Services once the
+// informer caches have been synced, and then starts the push worker.
+func (c *Controller) resync(ctx context.Context) error {
+	if !c.manager.GetCache().WaitForCacheSync(ctx) {
+		return fmt.Errorf("could not sync the informer caches")
+	}
+
+	if c.config.CoalesceWindow <= 0 {
+		// Each Service would rebuild the whole configuration, which makes
+		// the resync quadratic in the number of Services.
+		c.logger.Info("Coalescing is disabled, the resync may be slow for many services", "recommendedCoalesceWindow", DefaultCoalesceWindow.String())
+	}
+	c.logger.Info("Resyncing all services")
+	err := wait.PollImmediateUntilWithContext(ctx, resyncInterval, func(ctx context.Context) (bool, error) {
+		if err := c.upsertAll(ctx); err != nil {
+			c.logger.Error(err, "could not resync services, will retry")
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	close(c.synced)
+	c.logger.Info("Initial resync has finished")
+
+	// Start pushing only now, since the configuration was incomplete before,
+	// and applying it would wipe out the routes of all the other Services.
+	return c.configurator.Run(ctx)
+}
+
+// upsertAll adds all the eligible Services into the configurator.
+func (c *Controller) upsertAll(ctx context.Context) error {
+	services := &corev1.ServiceList{}
+	if err := c.client.List(ctx, services); err != nil {
+		return err
+	}
+
+	for i := range services.Items {
+		upstreamService := &services.Items[i]
+		if !c.isEligible(upstreamService) {
+			continue
+		}
+
+		svc, err := c.toService(ctx, upstreamService)
+		if err != nil {
+			return err
+		}
+		c.configurator.Upsert(svc)
+	}
+
+	return nil
+}
+
+func (c *Controller) isEligible(obj client.Object) bool {
+	for _, f := range c.filters {
+		if !f.Generic(event.GenericEvent{Object: obj}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) isSynced() bool {
+	select {
+	case <-c.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkSynced reports whether the initial resync has finished.
+func (c *Controller) checkSynced(_ *http.Request) error {
+	if !c.isSynced() {
+		return fmt.Errorf("initial resync has not finished")
+	}
+	return nil
+}
+
+// checkAnnotations checks for unknown annotations of svc, which are only
+// rejected if AnnotationModeReject is used. Otherwise, they are warned about
+// by warnAnnotations.
+func (c *Controller) checkAnnotations(svc *corev1.Service) error {
+	if c.config.AnnotationMode != AnnotationModeReject {
+		return nil
+	}
+	return CheckAnnotations(svc.Annotations)
+}
+
+// warnAnnotations raises an Event on svc if it has unknown annotations, unless
+// AnnotationModeReject is used. It's only called while reconciling svc itself,
+// rather than while looking it up as a backend of another Service.
+func (c *Controller) warnAnnotations(svc *corev1.Service) {
+	if c.config.AnnotationMode == AnnotationModeReject {
+		return
+	}
+	err := CheckAnnotations(svc.Annotations)
+	if !c.changedAnnotationError("Service", Key{Name: svc.Name, Namespace: svc.Namespace}, ReasonUnknownAnnotation, err) {
+		return
+	}
+	c.logger.Info("Ignoring unknown service annotations", "name", svc.Name, "namespace", svc.Namespace, "error", err.Error())
+	c.recorder.Eventf(svc, corev1.EventTypeWarning, ReasonUnknownAnnotation, "%v", err)
+}
+
+// changedAnnotationError remembers err as the annotation error of the object,
+// of the given kind and identified by key, for the given reason, and reports
+// whether it's a new error which should be raised as an Event. A nil err means
+// the error is gone.
+func (c *Controller) changedAnnotationError(kind string, key Key, reason string, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := annotationEvent{Kind: kind, Key: key, Reason: reason}
+	if err == nil {
+		delete(c.annotationErrors, k)
+		return false
+	}
+	if c.annotationErrors[k] == err.Error() {
+		return false
+	}
+	c.annotationErrors[k] = err.Error()
+	return true
+}
+
 func (c *Controller) getService(ctx context.Context, name, namespace string) (*Service, error) {
 	svc := &corev1.Service{}
-	if err := c.client.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, svc); err != nil {
+	err := c.client.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, svc)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
 	return c.toService(ctx, svc)
 }
 
 func (c *Controller) toService(ctx context.Context, svc *corev1.Service) (*Service, error) {
-	ips, err := c.getPodIPs(ctx, svc)
+	slices, err := c.listEndpointSlices(ctx, svc)
 	if err != nil {
 		return nil, err
 	}
 
-	definitions, err := NewDefinitions(svc.Annotations)
+	pods, err := c.listPods(ctx, svc)
 	if err != nil {
-		c.logger.Error(err, "bad service annotations")
+		return nil, err
+	}
+
+	annotations, err := c.mergedAnnotations(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	key := Key{Name: svc.Name, Namespace: svc.Namespace}
+	definitions, err := NewDefinitions(annotations)
+	if err == nil {
+		err = c.checkAnnotations(svc)
+	}
+	if err != nil {
+		// Keep the last good definitions, if any, instead of dropping all
+		// the settings of the Service due to a single bad annotation.
+		definitions = c.getDefinitions(key)
+		if c.changedAnnotationError("Service", key, ReasonInvalidAnnotation, err) {
+			c.logger.Error(err, "bad service annotations", "name", svc.Name, "namespace", svc.Namespace)
+			if definitions != nil {
+				c.recorder.Eventf(svc, corev1.EventTypeWarning, ReasonInvalidAnnotation, "Annotations ignored, the last good ones are kept: %v", err)
+			} else {
+				c.recorder.Eventf(svc, corev1.EventTypeWarning, ReasonInvalidAnnotation, "%v", err)
+			}
+		}
+	} else {
+		c.setDefinitions(key, definitions)
+		c.changedAnnotationError("Service", key, ReasonInvalidAnnotation, nil)
+	}
+	if err := c.applyTrafficSplit(ctx, svc, definitions); err != nil {
+		return nil, err
+	}
+	definitions, err = c.checkReferenceGrants(ctx, svc, definitions)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.applyHTTPRoutes(ctx, svc, definitions); err != nil {
+		return nil, err
+	}
+	mirror, err := c.toMirror(ctx, svc, definitions)
+	if err != nil {
+		return nil, err
 	}
 
-	port := svc.Spec.Ports[0] // TODO: Add support for multiple ports per Service
 	return &Service{
-		Key: Key{
-			Name:      svc.Name,
-			Namespace: svc.Namespace,
-		},
-		Port:        Port(int(port.Port)),
-		PodPort:     int(port.TargetPort.IntVal),
-		PodIPs:      ips,
+		Key:         key,
+		Ports:       servicePorts(svc, slices),
+		HealthCheck: newHealthCheck(readinessProbe(pods), definitions),
 		Definitions: definitions,
+		Mirror:      mirror,
+	}, nil
+}
+
+// getDefinitions returns a copy of the last good definitions of the Service
+// identified by key, which can be modified freely.
+func (c *Controller) getDefinitions(key Key) *Definitions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.definitions[key].DeepCopy()
+}
+
+// setDefinitions remembers a copy of d as the last good definitions of the
+// Service identified by key, or forgets them if d is nil. It must be called
+// before d is modified (e.g. by applyTrafficSplit).
+func (c *Controller) setDefinitions(key Key, d *Definitions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d == nil {
+		delete(c.definitions, key)
+		return
+	}
+	c.definitions[key] = d.DeepCopy()
+}
+
+// toMirror returns the Service, to which the requests to svc are mirrored as
+// defined by d, or nil if there's none. Only the pods of the mirror Service are
+// resolved, since the requests are mirrored to them directly.
+func (c *Controller) toMirror(ctx context.Context, svc *corev1.Service, d *Definitions) (*Mirror, error) {
+	if d == nil || d.MirrorService == "" || d.MirrorPercentage <= 0 {
+		return nil, nil
+	}
+	ref, err := parseBackendRef(d.MirrorService)
+	if err != nil {
+		// Invalid references have been rejected while decoding.
+		return nil, nil
+	}
+
+	key := ref.Key(svc.Namespace)
+	mirror := &corev1.Service{}
+	err = c.client.Get(ctx, client.ObjectKey{Name: key.Name, Namespace: key.Namespace}, mirror)
+	if errors.IsNotFound(err) {
+		c.logger.Info("Mirror service not found", "name", svc.Name, "namespace", svc.Namespace, "mirror", key.Name, "mirrorNamespace", key.Namespace)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slices, err := c.listEndpointSlices(ctx, mirror)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		Service: &Service{
+			Key:   key,
+			Ports: servicePorts(mirror, slices),
+		},
+		Port:       ref.Port,
+		Percentage: d.MirrorPercentage,
 	}, nil
 }
 
-func (c *Controller) getPodIPs(ctx context.Context, svc *corev1.Service) ([]string, error) {
+// servicePorts returns the ports of svc that can be proxied, along with their
+// upstreams in slices.
+func servicePorts(svc *corev1.Service, slices []v1beta1.EndpointSlice) []ServicePort {
+	var ports []ServicePort
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+			continue // Only TCP ports can be proxied.
+		}
+		ports = append(ports, ServicePort{
+			Port:      Port(int(port.Port)),
+			Upstreams: upstreams(slices, port),
+		})
+	}
+	return ports
+}
+
+func (c *Controller) listEndpointSlices(ctx context.Context, svc *corev1.Service) ([]v1beta1.EndpointSlice, error) {
+	slices := &v1beta1.EndpointSliceList{}
+	if err := c.client.List(ctx, slices, client.InNamespace(svc.Namespace), client.MatchingLabels{v1beta1.LabelServiceName: svc.Name}); err != nil {
+		return nil, err
+	}
+	return slices.Items, nil
+}
+
+func (c *Controller) listPods(ctx context.Context, svc *corev1.Service) ([]corev1.Pod, error) {
+	if len(svc.Spec.Selector) == 0 {
+		// An empty selector would select all the pods in the namespace.
+		return nil, nil
+	}
+
 	pods := &corev1.PodList{}
 	if err := c.client.List(ctx, pods, client.InNamespace(svc.Namespace), client.MatchingLabels(svc.Spec.Selector)); err != nil {
 		return nil, err
 	}
 
-	var ips []string
-	for _, pod := range pods.Items {
-		ips = append(ips, pod.Status.PodIP)
+	// Keep the pods in a fixed order.
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+
+	return pods.Items, nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podIncarnation returns an identifier that changes whenever the pod is
+// recreated or any of its containers restarts.
+func podIncarnation(pod *corev1.Pod) string {
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+	return fmt.Sprintf("%s/%d", pod.UID, restarts)
+}
+
+// upstreams returns the endpoints, from the given EndpointSlices, that serve
+// the given Service port. Only ready endpoints are returned normally; endpoints
+// that are terminating but still serving are used as a fallback to drain the
+// in-flight traffic, if there's no ready endpoint.
+//
+// Note that the EndpointSlice controller has resolved any named target port
+// for each endpoint, which may be different between endpoints.
+func upstreams(slices []v1beta1.EndpointSlice, port corev1.ServicePort) []Upstream {
+	var ready, draining []Upstream
+	seen := make(map[Upstream]bool)
+
+	for _, slice := range slices {
+		if slice.AddressType == v1beta1.AddressTypeFQDN {
+			continue
+		}
+
+		podPort := endpointPort(slice.Ports, port)
+		if podPort == 0 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			cond := ep.Conditions
+			// A nil Ready or Serving condition should be interpreted as "true",
+			// while a nil Terminating condition should be interpreted as "false".
+			isReady := cond.Ready == nil || *cond.Ready
+			isServing := cond.Serving == nil || *cond.Serving
+			isTerminating := cond.Terminating != nil && *cond.Terminating
+
+			for _, addr := range ep.Addresses {
+				u := Upstream{IP: addr, Port: podPort}
+				if seen[u] {
+					continue // An endpoint may be duplicated across slices transiently.
+				}
+				seen[u] = true
+
+				switch {
+				case isReady:
+					ready = append(ready, u)
+				case isServing && isTerminating:
+					draining = append(draining, u)
+				}
+			}
+		}
+	}
+
+	result := ready
+	if len(result) == 0 {
+		result = draining
+	}
+
+	// Keep the upstreams in a fixed order.
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].IP != result[j].IP {
+			return result[i].IP < result[j].IP
+		}
+		return result[i].Port < result[j].Port
+	})
+
+	return result
+}
+
+// endpointPort returns the number of the EndpointSlice port that corresponds to
+// the given Service port, or 0 if there's no such port.
+func endpointPort(ports []v1beta1.EndpointPort, port corev1.ServicePort) int {
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if name == port.Name {
+			return int(*p.Port)
+		}
+	}
+	return 0
+}
+
+// httpProbe is an HTTP readiness probe, whose port has been resolved against
+// the ports of the container it belongs to.
+type httpProbe struct {
+	*corev1.Probe
+	Port int
+}
+
+// readinessProbe returns the first HTTP readiness probe declared by the given pods.
+// Pods selected by the same Service are typically created from the same template,
+// so their probes are considered identical.
+func readinessProbe(pods []corev1.Pod) *httpProbe {
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			probe := container.ReadinessProbe
+			if probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Scheme == corev1.URISchemeHTTPS {
+				continue
+			}
+			if port := containerPort(container, probe.HTTPGet.Port); port > 0 {
+				return &httpProbe{Probe: probe, Port: port}
+			}
+		}
+	}
+	return nil
+}
+
+// containerPort resolves the given port, which may be a port name, against the
+// ports of the given container.
+func containerPort(container corev1.Container, port intstr.IntOrString) int {
+	if port.Type == intstr.Int {
+		return int(port.IntVal)
+	}
+	for _, p := range container.Ports {
+		if p.Name == port.StrVal {
+			return int(p.ContainerPort)
+		}
+	}
+	return 0
+}
+
+// newHealthCheck creates an active health check from the given readiness probe,
+// whose settings can be overridden by the given definitions.
+func newHealthCheck(probe *httpProbe, d *Definitions) *HealthCheck {
+	hc := new(HealthCheck)
+	if probe != nil {
+		hc.Path = probe.HTTPGet.Path
+		hc.Port = probe.Port
+		hc.Interval = time.Duration(probe.PeriodSeconds) * time.Second
+		hc.Timeout = time.Duration(probe.TimeoutSeconds) * time.Second
+		for _, h := range probe.HTTPGet.HTTPHeaders {
+			if hc.Headers == nil {
+				hc.Headers = make(map[string][]string)
+			}
+			hc.Headers[h.Name] = append(hc.Headers[h.Name], h.Value)
+		}
+	}
+
+	if d != nil {
+		if d.HealthCheckPath != "" {
+			hc.Path = d.HealthCheckPath
+		}
+		if d.HealthCheckPort > 0 {
+			hc.Port = d.HealthCheckPort
+		}
+		if d.HealthCheckInterval > 0 {
+			hc.Interval = d.HealthCheckInterval
+		}
+		if d.HealthCheckTimeout > 0 {
+			hc.Timeout = d.HealthCheckTimeout
+		}
+	}
+
+	if probe == nil && hc.Path == "" {
+		// Neither a readiness probe nor a health-check path is available.
+		return nil
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
 	}
-	sort.Strings(ips) // Keep the ips in a fixed order.
 
-	return ips, nil
+	return hc
 }
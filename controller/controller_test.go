@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewHealthCheck(t *testing.T) {
+	pods := []corev1.Pod{
+		{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "sidecar",
+					},
+					{
+						Name: "app",
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 8080},
+							{Name: "health", ContainerPort: 8081},
+						},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{
+									Path: "/ready",
+									Port: intstr.FromString("health"),
+									HTTPHeaders: []corev1.HTTPHeader{
+										{Name: "X-Probe", Value: "1"},
+									},
+								},
+							},
+							PeriodSeconds:  5,
+							TimeoutSeconds: 1,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		pods []corev1.Pod
+		in   *Definitions
+		want *HealthCheck
+	}{
+		{
+			name: "no probe",
+			pods: nil,
+			in:   &Definitions{},
+			want: nil,
+		},
+		{
+			name: "no probe but annotations",
+			pods: nil,
+			in: &Definitions{
+				HealthCheckPath:     "/healthz",
+				HealthCheckInterval: 10 * time.Second,
+			},
+			want: &HealthCheck{
+				Path:     "/healthz",
+				Interval: 10 * time.Second,
+			},
+		},
+		{
+			name: "probe",
+			pods: pods,
+			in:   nil,
+			want: &HealthCheck{
+				Path:     "/ready",
+				Port:     8081,
+				Interval: 5 * time.Second,
+				Timeout:  time.Second,
+				Headers:  map[string][]string{"X-Probe": {"1"}},
+			},
+		},
+		{
+			name: "probe overridden by annotations",
+			pods: pods,
+			in: &Definitions{
+				HealthCheckPort:    8080,
+				HealthCheckTimeout: 2 * time.Second,
+			},
+			want: &HealthCheck{
+				Path:     "/ready",
+				Port:     8080,
+				Interval: 5 * time.Second,
+				Timeout:  2 * time.Second,
+				Headers:  map[string][]string{"X-Probe": {"1"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newHealthCheck(readinessProbe(tt.pods), tt.in)
+			if !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	ptr := func(b bool) *bool { return &b }
+	newSlice := func(ports []v1beta1.EndpointPort, endpoints ...v1beta1.Endpoint) v1beta1.EndpointSlice {
+		return v1beta1.EndpointSlice{
+			AddressType: v1beta1.AddressTypeIPv4,
+			Ports:       ports,
+			Endpoints:   endpoints,
+		}
+	}
+	newPorts := func(name string, port int32) []v1beta1.EndpointPort {
+		return []v1beta1.EndpointPort{{Name: &name, Port: &port}}
+	}
+	newEndpoint := func(ip string, ready, serving, terminating *bool) v1beta1.Endpoint {
+		return v1beta1.Endpoint{
+			Addresses: []string{ip},
+			Conditions: v1beta1.EndpointConditions{
+				Ready:       ready,
+				Serving:     serving,
+				Terminating: terminating,
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		slices []v1beta1.EndpointSlice
+		in     corev1.ServicePort
+		want   []Upstream
+	}{
+		{
+			name: "ready endpoints only",
+			slices: []v1beta1.EndpointSlice{
+				newSlice(newPorts("http", 8080),
+					newEndpoint("127.0.0.3", nil, nil, nil),
+					newEndpoint("127.0.0.2", ptr(true), ptr(true), ptr(false)),
+					newEndpoint("127.0.0.4", ptr(false), ptr(false), ptr(false)),
+					newEndpoint("127.0.0.5", ptr(false), ptr(true), ptr(true)),
+				),
+			},
+			in: corev1.ServicePort{Name: "http", Port: 80},
+			want: []Upstream{
+				{IP: "127.0.0.2", Port: 8080},
+				{IP: "127.0.0.3", Port: 8080},
+			},
+		},
+		{
+			name: "terminating but serving endpoints as fallback",
+			slices: []v1beta1.EndpointSlice{
+				newSlice(newPorts("http", 8080),
+					newEndpoint("127.0.0.2", ptr(false), ptr(true), ptr(true)),
+					newEndpoint("127.0.0.3", ptr(false), ptr(false), ptr(true)),
+				),
+			},
+			in: corev1.ServicePort{Name: "http", Port: 80},
+			want: []Upstream{
+				{IP: "127.0.0.2", Port: 8080},
+			},
+		},
+		{
+			name: "named target port resolved differently",
+			slices: []v1beta1.EndpointSlice{
+				newSlice(newPorts("http", 8080), newEndpoint("127.0.0.2", nil, nil, nil)),
+				newSlice(newPorts("http", 8081), newEndpoint("127.0.0.3", nil, nil, nil)),
+				newSlice(newPorts("metrics", 9090), newEndpoint("127.0.0.4", nil, nil, nil)),
+			},
+			in: corev1.ServicePort{Name: "http", Port: 80},
+			want: []Upstream{
+				{IP: "127.0.0.2", Port: 8080},
+				{IP: "127.0.0.3", Port: 8081},
+			},
+		},
+		{
+			name: "unnamed port",
+			slices: []v1beta1.EndpointSlice{
+				newSlice([]v1beta1.EndpointPort{{Port: func(p int32) *int32 { return &p }(8080)}},
+					newEndpoint("127.0.0.2", nil, nil, nil),
+				),
+			},
+			in: corev1.ServicePort{Port: 80},
+			want: []Upstream{
+				{IP: "127.0.0.2", Port: 8080},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := upstreams(tt.slices, tt.in)
+			if !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestController_ToService_LastGoodDefinitions(t *testing.T) {
+	ctx := context.Background()
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "test", Annotations: map[string]string{
+		"mesh.caddyserver.com/traffic-split-backends": "server-v1=95,canary/server-v2=5",
+	}}}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "canary"}}
+	c := &Controller{
+		logger:           testLogger,
+		client:           fake.NewClientBuilder().WithObjects(svc, ns).Build(),
+		recorder:         record.NewFakeRecorder(10),
+		config:           &Config{AnnotationMode: AnnotationModeWarn},
+		definitions:      make(map[Key]*Definitions),
+		annotationErrors: make(map[annotationEvent]string),
+	}
+
+	// The traffic split is disabled, since the backend is not granted.
+	s1, err := c.toService(ctx, svc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(s1.Definitions.TrafficSplitBackends) != 0 {
+		t.Fatalf("Backends: Got (%v) != Want (none)", s1.Definitions.TrafficSplitBackends)
+	}
+
+	// Once granted, the traffic split is enabled by the last good definitions,
+	// even though the annotations have become invalid.
+	ns.Annotations = map[string]string{ReferenceGrantAnnotation: "test"}
+	if err := c.client.Update(ctx, ns); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	svc.Annotations["mesh.caddyserver.com/retry-count"] = "two"
+	s2, err := c.toService(ctx, svc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []TrafficSplitBackend{{Service: "server-v1", Weight: 95}, {Service: "canary/server-v2", Weight: 5}}
+	if diff := cmp.Diff(want, s2.Definitions.TrafficSplitBackends); diff != "" {
+		t.Errorf("Want - Got: %s", diff)
+	}
+	if s1.Definitions == s2.Definitions {
+		t.Errorf("Definitions: Got (shared) != Want (copied)")
+	}
+}
@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// DefaultsConfigMap is the default name of the mesh-wide ConfigMap, in the
+// proxy namespace, whose data are the default annotations of all Services.
+// Since the keys of a ConfigMap can not contain slashes, each key is the name
+// of an annotation without AnnotationPrefix (e.g. "retry-count").
+const DefaultsConfigMap = "caddy-mesh-defaults"
+
+// isDefaultable reports whether the annotation name can be defaulted by a
+// Namespace or the mesh-wide ConfigMap. Traffic splitting and mirroring are
+// specific to each Service, and so is the status.
+func isDefaultable(name string) bool {
+	return knownAnnotations[name] &&
+		name != StatusAnnotation &&
+		!strings.HasPrefix(name, AnnotationPrefix+"traffic-split-") &&
+		!strings.HasPrefix(name, AnnotationPrefix+"mirror-")
+}
+
+// MergeAnnotations merges the annotations of a Service with its defaults, which
+// are given in ascending order of precedence (i.e. the mesh-wide defaults, the
+// namespace defaults and then the policies). The annotations of the Service
+// take precedence over all the defaults, from which only the defaultable
+// annotations are taken.
+func MergeAnnotations(service map[string]string, defaults ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, d := range defaults {
+		for name, value := range d {
+			if isDefaultable(name) {
+				merged[name] = value
+			}
+		}
+	}
+	for name, value := range service {
+		merged[name] = value
+	}
+	return merged
+}
+
+// checkDefaults checks the defaults declared by a Namespace or the mesh-wide
+// ConfigMap. The known annotations that can not be defaulted are reported as
+// ignored, while an error means all the defaults are invalid.
+func checkDefaults(defaults map[string]string) (ignored []string, err error) {
+	valid := make(map[string]string)
+	for name, value := range defaults {
+		if !knownAnnotations[name] {
+			continue
+		}
+		if !isDefaultable(name) {
+			ignored = append(ignored, name)
+			continue
+		}
+		valid[name] = value
+	}
+	sort.Strings(ignored)
+
+	_, err = NewDefinitions(valid)
+	return ignored, err
+}
+
+// mergedAnnotations returns the annotations of svc merged with its defaults
+// and the settings of the policies targeting it.
+func (c *Controller) mergedAnnotations(ctx context.Context, svc *corev1.Service) (map[string]string, error) {
+	mesh, err := c.meshDefaults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := c.namespaceDefaults(ctx, svc.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := c.policyAnnotations(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	return MergeAnnotations(svc.Annotations, mesh, namespace, policies), nil
+}
+
+// meshDefaults returns the default annotations from the mesh-wide ConfigMap.
+func (c *Controller) meshDefaults(ctx context.Context) (map[string]string, error) {
+	if c.config.DefaultsConfigMap == "" {
+		return nil, nil
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := c.client.Get(ctx, client.ObjectKey{Name: c.config.DefaultsConfigMap, Namespace: c.config.ProxyNamespace}, cm)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := make(map[string]string, len(cm.Data))
+	for key, value := range cm.Data {
+		defaults[AnnotationPrefix+key] = value
+	}
+	return c.validDefaults("ConfigMap", cm, defaults), nil
+}
+
+// namespaceDefaults returns the default annotations from the given Namespace.
+func (c *Controller) namespaceDefaults(ctx context.Context, name string) (map[string]string, error) {
+	ns := &corev1.Namespace{}
+	err := c.client.Get(ctx, client.ObjectKey{Name: name}, ns)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The reference grant is the only annotation of a Namespace that is not
+	// a default.
+	defaults := make(map[string]string, len(ns.Annotations))
+	for name, value := range ns.Annotations {
+		if name != ReferenceGrantAnnotation {
+			defaults[name] = value
+		}
+	}
+	return c.validDefaults("Namespace", ns, defaults), nil
+}
+
+// validDefaults returns defaults, declared by obj of the given kind, if they
+// are valid. Otherwise, an Event is raised on obj and no defaults are returned,
+// to keep the Services in the mesh with their own annotations. Since defaults
+// are checked for every Service using them, each Event is only raised once
+// until the defaults are changed.
+func (c *Controller) validDefaults(kind string, obj client.Object, defaults map[string]string) map[string]string {
+	key := Key{Name: obj.GetName(), Namespace: obj.GetNamespace()}
+
+	unknownErr := CheckAnnotations(defaults)
+	if c.changedAnnotationError(kind, key, ReasonUnknownAnnotation, unknownErr) {
+		c.logger.Info("Ignoring unknown default annotations", "name", obj.GetName(), "namespace", obj.GetNamespace(), "error", unknownErr.Error())
+		c.recorder.Eventf(obj, corev1.EventTypeWarning, ReasonUnknownAnnotation, "%v", unknownErr)
+	}
+
+	ignored, err := checkDefaults(defaults)
+	var msgs []string
+	if len(ignored) > 0 {
+		msgs = append(msgs, fmt.Sprintf("Ignoring annotations that can not be defaulted: %s", strings.Join(ignored, ", ")))
+	}
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Defaults ignored: %v", err))
+	}
+	var invalidErr error
+	if len(msgs) > 0 {
+		invalidErr = fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	if c.changedAnnotationError(kind, key, ReasonInvalidAnnotation, invalidErr) {
+		for _, msg := range msgs {
+			c.logger.Info(msg, "name", obj.GetName(), "namespace", obj.GetNamespace())
+			c.recorder.Event(obj, corev1.EventTypeWarning, ReasonInvalidAnnotation, msg)
+		}
+	}
+
+	if err != nil {
+		return nil
+	}
+	return defaults
+}
+
+// mapNamespace maps a Namespace to the eligible Services within it, whose
+// defaults might have been changed, and to those with backends within it,
+// whose reference grants might have been changed.
+func (c *Controller) mapNamespace(obj client.Object) []reconcile.Request {
+	requests := c.eligibleServices(client.InNamespace(obj.GetName()))
+	return append(requests, c.eligibleServices(client.MatchingFields{backendNamespacesField: obj.GetName()})...)
+}
+
+// mapMeshDefaults maps the mesh-wide ConfigMap to all the eligible Services.
+func (c *Controller) mapMeshDefaults(_ client.Object) []reconcile.Request {
+	return c.eligibleServices()
+}
+
+func (c *Controller) eligibleServices(opts ...client.ListOption) []reconcile.Request {
+	services := &corev1.ServiceList{}
+	if err := c.client.List(context.Background(), services, opts...); err != nil {
+		c.logger.Error(err, "could not list services")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range services.Items {
+		svc := &services.Items[i]
+		if c.isEligible(svc) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)})
+		}
+	}
+	return requests
+}
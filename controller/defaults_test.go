@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMergeAnnotations(t *testing.T) {
+	tests := []struct {
+		name      string
+		mesh      map[string]string
+		namespace map[string]string
+		service   map[string]string
+		want      map[string]string
+	}{
+		{
+			name: "no defaults",
+			service: map[string]string{
+				"mesh.caddyserver.com/retry-count": "2",
+			},
+			want: map[string]string{
+				"mesh.caddyserver.com/retry-count": "2",
+			},
+		},
+		{
+			name: "precedence",
+			mesh: map[string]string{
+				"mesh.caddyserver.com/retry-count":          "1",
+				"mesh.caddyserver.com/retry-duration":       "5s",
+				"mesh.caddyserver.com/timeout-dial-timeout": "1s",
+			},
+			namespace: map[string]string{
+				"mesh.caddyserver.com/retry-count":          "2",
+				"mesh.caddyserver.com/timeout-dial-timeout": "2s",
+			},
+			service: map[string]string{
+				"mesh.caddyserver.com/timeout-dial-timeout": "3s",
+			},
+			want: map[string]string{
+				"mesh.caddyserver.com/retry-count":          "2",
+				"mesh.caddyserver.com/retry-duration":       "5s",
+				"mesh.caddyserver.com/timeout-dial-timeout": "3s",
+			},
+		},
+		{
+			name: "non-defaultable",
+			mesh: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression": "true",
+				"mesh.caddyserver.com/status":                   `{"appliedGeneration":1,"proxies":1}`,
+			},
+			namespace: map[string]string{
+				"mesh.caddyserver.com/traffic-split-new-service": "server-v2",
+				"mesh.caddyserver.com/mirror-service":            "server-v3",
+				"mesh.caddyserver.com/retry-cout":                "2",
+				"example.com/owner":                              "team",
+			},
+			service: map[string]string{
+				"example.com/owner": "someone",
+			},
+			want: map[string]string{
+				"example.com/owner": "someone",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergeAnnotations(tt.service, tt.mesh, tt.namespace)
+			if !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckDefaults(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          map[string]string
+		wantIgnored []string
+		wantErr     string
+	}{
+		{
+			name: "valid",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-count": "2",
+				"mesh.caddyserver.com/retry-cout":  "x",
+				"example.com/owner":                "team",
+			},
+		},
+		{
+			name: "non-defaultable",
+			in: map[string]string{
+				"mesh.caddyserver.com/traffic-split-new-service": "server-v2",
+				"mesh.caddyserver.com/traffic-split-expression":  "true",
+				"mesh.caddyserver.com/retry-count":               "2",
+			},
+			wantIgnored: []string{
+				"mesh.caddyserver.com/traffic-split-expression",
+				"mesh.caddyserver.com/traffic-split-new-service",
+			},
+		},
+		{
+			name: "invalid",
+			in: map[string]string{
+				"mesh.caddyserver.com/retry-count": "x",
+			},
+			wantErr: "1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/retry-count': strconv.Atoi: parsing \"x\": invalid syntax",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ignored, err := checkDefaults(tt.in)
+			if !cmp.Equal(ignored, tt.wantIgnored) {
+				diff := cmp.Diff(ignored, tt.wantIgnored)
+				t.Errorf("Want - Got: %s", diff)
+			}
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Err: Got (%q) != Want (%q)", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestController_ValidDefaults(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		logger:           testLogger,
+		recorder:         recorder,
+		annotationErrors: make(map[annotationEvent]string),
+	}
+	events := func() (got []string) {
+		for {
+			select {
+			case e := <-recorder.Events:
+				got = append(got, e)
+			default:
+				return got
+			}
+		}
+	}
+
+	// The Events are raised only once, as long as the defaults are unchanged.
+	defaults := map[string]string{
+		"mesh.caddyserver.com/retry-count":               "x",
+		"mesh.caddyserver.com/traffic-split-new-service": "server-v2",
+	}
+	for i := 0; i < 2; i++ {
+		if got := c.validDefaults("Namespace", ns, defaults); got != nil {
+			t.Fatalf("Defaults: Got (%v) != Want (none)", got)
+		}
+	}
+	want := []string{
+		"Warning InvalidAnnotation Ignoring annotations that can not be defaulted: mesh.caddyserver.com/traffic-split-new-service",
+		"Warning InvalidAnnotation Defaults ignored: 1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/retry-count': strconv.Atoi: parsing \"x\": invalid syntax",
+	}
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+
+	// And raised again once the defaults are changed.
+	defaults = map[string]string{"mesh.caddyserver.com/retry-count": "y"}
+	c.validDefaults("Namespace", ns, defaults)
+	want = []string{
+		"Warning InvalidAnnotation Defaults ignored: 1 error(s) decoding:\n\n* error decoding 'mesh.caddyserver.com/retry-count': strconv.Atoi: parsing \"y\": invalid syntax",
+	}
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+}
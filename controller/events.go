@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// StatusAnnotation is the annotation, written by the controller, that shows
+// the mesh state of a Service.
+const StatusAnnotation = "mesh.caddyserver.com/status"
+
+// Reasons of the Events raised on Services.
+const (
+	ReasonApplied               = "Applied"
+	ReasonInvalidAnnotation     = "InvalidAnnotation"
+	ReasonMissingBackend        = "MissingBackend"
+	ReasonPushFailed            = "PushFailed"
+	ReasonQuarantined           = "Quarantined"
+	ReasonReferenceNotPermitted = "ReferenceNotPermitted"
+	ReasonUnknownAnnotation     = "UnknownAnnotation"
+)
+
+// ServiceStatus is the mesh state of a Service.
+type ServiceStatus struct {
+	// AppliedGeneration is the generation of the configuration, containing
+	// the newest settings of the Service, that has been applied. The changes
+	// of the endpoints alone are not recorded, since they change frequently.
+	AppliedGeneration uint64 `json:"appliedGeneration"`
+	// Proxies is the number of Caddy instances holding the configuration.
+	Proxies int `json:"proxies"`
+	// Degraded, if not empty, tells why the traffic to the Service is not
+	// routed as configured (e.g. some traffic-split backends are missing).
+	Degraded string `json:"degraded,omitempty"`
+}
+
+// Applied implements Recorder by raising an Event on the Service and updating
+// its status annotation, if the status is changed.
+func (c *Controller) Applied(key Key, generation uint64, proxies int) {
+	ctx := context.Background()
+	svc, ok := c.getForEvent(ctx, key)
+	if !ok {
+		return
+	}
+	if status := serviceStatus(svc); status.AppliedGeneration == generation && status.Proxies == proxies {
+		return
+	}
+	c.recorder.Eventf(svc, corev1.EventTypeNormal, ReasonApplied, "Config of generation %d applied to %d proxies", generation, proxies)
+
+	c.patchStatus(ctx, svc, func(status *ServiceStatus) {
+		status.AppliedGeneration = generation
+		status.Proxies = proxies
+	})
+}
+
+// patchStatus updates the status annotation of svc by update, if the status
+// is changed.
+func (c *Controller) patchStatus(ctx context.Context, svc *corev1.Service, update func(status *ServiceStatus)) {
+	status := serviceStatus(svc)
+	old := status
+	update(&status)
+	if status == old {
+		return
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		c.logger.Error(err, "could not marshal service status", "name", svc.Name, "namespace", svc.Namespace)
+		return
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	metav1.SetMetaDataAnnotation(&svc.ObjectMeta, StatusAnnotation, string(data))
+	if err := c.client.Patch(ctx, svc, patch); err != nil {
+		c.logger.Error(err, "could not update service status", "name", svc.Name, "namespace", svc.Namespace)
+	}
+}
+
+// serviceStatus returns the status of svc recorded in its status annotation.
+func serviceStatus(svc *corev1.Service) ServiceStatus {
+	var status ServiceStatus
+	if data := svc.Annotations[StatusAnnotation]; data != "" {
+		// An invalid status will be overwritten.
+		_ = json.Unmarshal([]byte(data), &status)
+	}
+	return status
+}
+
+// PushFailed implements Recorder by raising an Event on the Service.
+func (c *Controller) PushFailed(key Key, generation uint64, failed, total int) {
+	if svc, ok := c.getForEvent(context.Background(), key); ok {
+		c.recorder.Eventf(svc, corev1.EventTypeWarning, ReasonPushFailed, "Config of generation %d failed to apply on %d of %d proxies", generation, failed, total)
+	}
+}
+
+// Quarantined implements Recorder by raising an Event on the Service.
+func (c *Controller) Quarantined(key Key, err error) {
+	if svc, ok := c.getForEvent(context.Background(), key); ok {
+		c.recorder.Eventf(svc, corev1.EventTypeWarning, ReasonQuarantined, "Config rejected by Caddy, the last good config is kept: %v", err)
+	}
+}
+
+func (c *Controller) getForEvent(ctx context.Context, key Key) (*corev1.Service, bool) {
+	svc := &corev1.Service{}
+	if err := c.client.Get(ctx, client.ObjectKey{Name: key.Name, Namespace: key.Namespace}, svc); err != nil {
+		if !errors.IsNotFound(err) {
+			c.logger.Error(err, "could not get service for event", "name", key.Name, "namespace", key.Namespace)
+		}
+		return nil, false
+	}
+	return svc, true
+}
+
+// checkBackends raises an Event on svc if any of its traffic-split backends
+// does not exist, in which case the traffic is routed to the remaining ones, or
+// to svc itself if none remains. So does a missing mirror Service, to which no
+// request is mirrored. The degraded state is also recorded in the status of
+// svc, until all the backends are back. The Event is raised only once for each
+// reason, as long as it's recorded in the status.
+func (c *Controller) checkBackends(ctx context.Context, svc *corev1.Service, d *Definitions) {
+	var refs []BackendRef
+	var mirror BackendRef
+	hasMirror := false
+	if d != nil {
+		refs = trafficSplitRefs(d)
+		mirror, hasMirror = mirrorRef(d)
+	}
+
+	exists := func(ref BackendRef) bool {
+		key := ref.Key(svc.Namespace)
+		err := c.client.Get(ctx, client.ObjectKey{Name: key.Name, Namespace: key.Namespace}, &corev1.Service{})
+		return !errors.IsNotFound(err)
+	}
+
+	var missing []string
+	for _, ref := range refs {
+		if !exists(ref) {
+			missing = append(missing, strconv.Quote(backendKey(ref.Key(svc.Namespace))))
+		}
+	}
+
+	var reasons []string
+	if len(missing) > 0 {
+		fallback := "the remaining backends"
+		if len(missing) == len(refs) {
+			fallback = "the service itself"
+		}
+		reasons = append(reasons, fmt.Sprintf("Traffic-split backends %s not found, traffic is routed to %s", strings.Join(missing, ", "), fallback))
+	}
+	if hasMirror && !exists(mirror) {
+		reasons = append(reasons, fmt.Sprintf("Mirror service %q not found, requests are not mirrored", backendKey(mirror.Key(svc.Namespace))))
+	}
+
+	degraded := strings.Join(reasons, "; ")
+	old := serviceStatus(svc).Degraded
+	if degraded == old {
+		return
+	}
+	for _, reason := range newReasons(old, reasons) {
+		c.recorder.Event(svc, corev1.EventTypeWarning, ReasonMissingBackend, reason)
+	}
+
+	c.patchStatus(ctx, svc, func(status *ServiceStatus) {
+		status.Degraded = degraded
+	})
+}
+
+// newReasons returns the reasons that are not in degraded, which are the
+// previously recorded reasons joined by "; ".
+func newReasons(degraded string, reasons []string) []string {
+	old := make(map[string]bool)
+	for _, reason := range strings.Split(degraded, "; ") {
+		old[reason] = true
+	}
+	var result []string
+	for _, reason := range reasons {
+		if !old[reason] {
+			result = append(result, reason)
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestController_CheckBackends(t *testing.T) {
+	ctx := context.Background()
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "test", Annotations: map[string]string{
+		"mesh.caddyserver.com/traffic-split-backends": "server-v1=95,server-v2=5",
+	}}}
+	backend := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server-v1", Namespace: "test"}}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		logger:   testLogger,
+		client:   fake.NewClientBuilder().WithObjects(svc, backend).Build(),
+		recorder: recorder,
+	}
+
+	check := func() string {
+		got := &corev1.Service{}
+		if err := c.client.Get(ctx, client.ObjectKeyFromObject(svc), got); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		d, err := NewDefinitions(got.Annotations)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		c.checkBackends(ctx, got, d)
+
+		if err := c.client.Get(ctx, client.ObjectKeyFromObject(svc), got); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return serviceStatus(got).Degraded
+	}
+	events := func() (got []string) {
+		for {
+			select {
+			case e := <-recorder.Events:
+				got = append(got, e)
+			default:
+				return got
+			}
+		}
+	}
+
+	degraded := `Traffic-split backends "test/server-v2" not found, traffic is routed to the remaining backends`
+	for i := 0; i < 2; i++ {
+		if got := check(); got != degraded {
+			t.Fatalf("Degraded: Got (%s) != Want (%s)", got, degraded)
+		}
+	}
+	// The Event is raised only once, as long as the reason is unchanged.
+	want := []string{"Warning MissingBackend " + degraded}
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+
+	if err := c.client.Delete(ctx, backend); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	degraded = `Traffic-split backends "test/server-v1", "test/server-v2" not found, traffic is routed to the service itself`
+	if got := check(); got != degraded {
+		t.Fatalf("Degraded: Got (%s) != Want (%s)", got, degraded)
+	}
+	want = []string{"Warning MissingBackend " + degraded}
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+}
+
+func TestController_WarnAnnotations(t *testing.T) {
+	ctx := context.Background()
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "test", Annotations: map[string]string{
+		"mesh.caddyserver.com/retry-cuont": "3",
+	}}}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		logger:           testLogger,
+		client:           fake.NewClientBuilder().WithObjects(svc).Build(),
+		recorder:         recorder,
+		config:           &Config{AnnotationMode: AnnotationModeWarn},
+		definitions:      make(map[Key]*Definitions),
+		annotationErrors: make(map[annotationEvent]string),
+	}
+	events := func() (got []string) {
+		for {
+			select {
+			case e := <-recorder.Events:
+				got = append(got, e)
+			default:
+				return got
+			}
+		}
+	}
+
+	// No warning while looking up the Service as a backend.
+	if _, err := c.getService(ctx, svc.Name, svc.Namespace); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := events(); len(got) != 0 {
+		t.Fatalf("Events: Got (%v) != Want (none)", got)
+	}
+
+	// The warning is raised only once for the same unknown annotations.
+	want := []string{"Warning UnknownAnnotation unknown annotation 'mesh.caddyserver.com/retry-cuont' (did you mean 'mesh.caddyserver.com/retry-count'?)"}
+	c.warnAnnotations(svc)
+	c.warnAnnotations(svc)
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+
+	// And raised again once the annotations are fixed and then broken again.
+	svc.Annotations = map[string]string{"mesh.caddyserver.com/retry-count": "3"}
+	c.warnAnnotations(svc)
+	svc.Annotations = map[string]string{"mesh.caddyserver.com/retry-cuont": "3"}
+	c.warnAnnotations(svc)
+	if diff := cmp.Diff(want, events()); diff != "" {
+		t.Errorf("Events: Want - Got: %s", diff)
+	}
+}
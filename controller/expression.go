@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+)
+
+// maxMatcherArgs is the maximum number of arguments accepted by the matcher
+// functions that take a variable number of strings (e.g. path()).
+const maxMatcherArgs = 16
+
+// placeholderRegexp matches the placeholders in an expression, which will be
+// expanded into function calls just as Caddy does.
+// See https://github.com/caddyserver/caddy/blob/master/modules/caddyhttp/celmatcher.go
+var placeholderRegexp = regexp.MustCompile(`{([a-zA-Z][\w.-]+)}`)
+
+// celEnv is the CEL environment of the expressions supported by the expression
+// matcher of Caddy.
+var celEnv = mustNewCELEnv()
+
+func mustNewCELEnv() *cel.Env {
+	requestType := cel.OpaqueType("http.Request")
+	jsonType := cel.MapType(cel.StringType, cel.DynType)
+
+	opts := []cel.EnvOption{
+		cel.Variable("request", requestType),
+		cel.Function("caddyPlaceholder",
+			cel.Overload("caddyPlaceholder_request_string", []*cel.Type{requestType, cel.StringType}, cel.DynType),
+		),
+		newMatcherFunction("header", []*cel.Type{jsonType}),
+		newMatcherFunction("query", []*cel.Type{jsonType}),
+		newMatcherFunction("vars", []*cel.Type{jsonType}),
+		newMatcherFunction("protocol", []*cel.Type{cel.StringType}),
+		newMatcherFunction("path_regexp",
+			[]*cel.Type{cel.StringType},
+			[]*cel.Type{cel.StringType, cel.StringType},
+		),
+		newMatcherFunction("header_regexp",
+			[]*cel.Type{cel.StringType, cel.StringType},
+			[]*cel.Type{cel.StringType, cel.StringType, cel.StringType},
+		),
+		newMatcherFunction("vars_regexp",
+			[]*cel.Type{cel.StringType, cel.StringType},
+			[]*cel.Type{cel.StringType, cel.StringType, cel.StringType},
+		),
+		newMatcherFunction("file", append([][]*cel.Type{{}, {jsonType}}, stringArgs(maxMatcherArgs)...)...),
+	}
+	for _, name := range []string{"host", "method", "path", "remote_ip", "client_ip"} {
+		opts = append(opts, newMatcherFunction(name, stringArgs(maxMatcherArgs)...))
+	}
+
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// newMatcherFunction declares a matcher function with the given signatures,
+// each of which returns bool.
+func newMatcherFunction(name string, signatures ...[]*cel.Type) cel.EnvOption {
+	var overloads []cel.FunctionOpt
+	for _, args := range signatures {
+		id := name
+		for _, arg := range args {
+			id += "_" + strings.ReplaceAll(arg.String(), " ", "")
+		}
+		overloads = append(overloads, cel.Overload(id, args, cel.BoolType))
+	}
+	return cel.Function(name, overloads...)
+}
+
+// stringArgs returns the signatures taking one to n strings.
+func stringArgs(n int) (signatures [][]*cel.Type) {
+	var args []*cel.Type
+	for i := 0; i < n; i++ {
+		args = append(args, cel.StringType)
+		signatures = append(signatures, append([]*cel.Type(nil), args...))
+	}
+	return signatures
+}
+
+// validateExpression checks whether expr is a valid expression for the expression
+// matcher of Caddy. The position of the first error, if any, is reported as
+// line:column in expr.
+func validateExpression(expr string) error {
+	expanded, mapping := expandPlaceholders(expr)
+
+	ast, iss := celEnv.Compile(expanded)
+	if iss != nil && iss.Err() != nil {
+		errs := iss.Errors()
+		if len(errs) == 0 {
+			return iss.Err()
+		}
+		e := errs[0]
+		line, column := mapping.locate(e.Location)
+		return fmt.Errorf("%d:%d: %s", line, column, e.Message)
+	}
+
+	if t := ast.OutputType(); t.String() != cel.BoolType.String() {
+		return fmt.Errorf("1:1: expected return type of bool, not %s", t)
+	}
+
+	return nil
+}
+
+// placeholderMapping maps the positions in an expression, whose placeholders
+// have been expanded, back to the positions in the original expression.
+type placeholderMapping struct {
+	original []rune
+	expanded []rune
+	// expansions are the offsets of the placeholders in ascending order.
+	expansions []expansion
+}
+
+type expansion struct {
+	originalStart, originalEnd int
+	expandedStart, expandedEnd int
+}
+
+func expandPlaceholders(expr string) (string, *placeholderMapping) {
+	m := &placeholderMapping{original: []rune(expr)}
+
+	var b strings.Builder
+	var last int // byte offset in expr
+	for _, loc := range placeholderRegexp.FindAllStringSubmatchIndex(expr, -1) {
+		b.WriteString(expr[last:loc[0]])
+
+		e := expansion{
+			originalStart: runeCount(expr[:loc[0]]),
+			originalEnd:   runeCount(expr[:loc[1]]),
+			expandedStart: runeCount(b.String()),
+		}
+		b.WriteString(fmt.Sprintf("caddyPlaceholder(request, %q)", expr[loc[2]:loc[3]]))
+		e.expandedEnd = runeCount(b.String())
+		m.expansions = append(m.expansions, e)
+
+		last = loc[1]
+	}
+	b.WriteString(expr[last:])
+
+	m.expanded = []rune(b.String())
+	return b.String(), m
+}
+
+// locate returns the 1-based line and column, in the original expression, of
+// the given location in the expanded expression. A location within an expanded
+// placeholder is mapped to the start of the placeholder.
+func (m *placeholderMapping) locate(loc common.Location) (line, column int) {
+	offset := runeOffset(m.expanded, loc.Line(), loc.Column())
+
+	shift := 0
+	for _, e := range m.expansions {
+		if offset < e.expandedStart {
+			break
+		}
+		if offset < e.expandedEnd {
+			return lineColumn(m.original, e.originalStart)
+		}
+		shift = e.expandedEnd - e.originalEnd
+	}
+	return lineColumn(m.original, offset-shift)
+}
+
+// runeOffset returns the offset of the given 1-based line and 0-based column.
+func runeOffset(text []rune, line, column int) int {
+	offset := 0
+	for l := 1; l < line && offset < len(text); offset++ {
+		if text[offset] == '\n' {
+			l++
+		}
+	}
+	return offset + column
+}
+
+// lineColumn returns the 1-based line and column of the given offset.
+func lineColumn(text []rune, offset int) (line, column int) {
+	line, column = 1, 1
+	for i := 0; i < offset && i < len(text); i++ {
+		if text[i] == '\n' {
+			line++
+			column = 1
+			continue
+		}
+		column++
+	}
+	return line, column
+}
+
+func runeCount(s string) int {
+	return len([]rune(s))
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestValidateExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{
+			name: "literal",
+			in:   "true",
+		},
+		{
+			name: "placeholder",
+			in:   "{http.request.method} == 'GET'",
+		},
+		{
+			name: "matchers",
+			in:   "path('/api/*', '/v2/*') && header({'User-Agent': '*Chrome*'}) && query({'debug': 'true'})",
+		},
+		{
+			name: "regexp matchers",
+			in:   "path_regexp('^/api/v[0-9]+') || header_regexp('ua', 'User-Agent', 'Chrome.*')",
+		},
+		{
+			name: "uuid bucket",
+			in:   `{http.request.uuid} < "e666"`,
+		},
+		{
+			name:    "syntax error",
+			in:      "{http.request.method} == 'GET' &&",
+			wantErr: "1:34: Syntax error: mismatched input '<EOF>' expecting {'[', '{', '(', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}",
+		},
+		{
+			name:    "unknown function after placeholders",
+			in:      "{http.request.method} == 'GET' && {query.debug} == 'true' && foo()",
+			wantErr: "1:65: undeclared reference to 'foo' (in container '')",
+		},
+		{
+			name:    "bad argument",
+			in:      "path(1)",
+			wantErr: "1:5: found no matching overload for 'path' applied to '(int)'",
+		},
+		{
+			name:    "multiple lines",
+			in:      "method('GET')\n  && bar",
+			wantErr: "2:6: undeclared reference to 'bar' (in container '')",
+		},
+		{
+			name:    "not bool",
+			in:      "{http.request.method}",
+			wantErr: "1:1: expected return type of bool, not dyn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExpression(tt.in)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Err: Got (%q) != Want (%q)", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
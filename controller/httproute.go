@@ -0,0 +1,581 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gw "github.com/RussellLuo/caddy-mesh/api/gateway/v1beta1"
+)
+
+// HTTPRouteControllerName is the name of the controller, by which the statuses
+// of HTTPRoutes with respect to Services are written.
+const HTTPRouteControllerName = "mesh.caddyserver.com/controller"
+
+// queryParamNameRegexp matches the names of the query parameters that can be
+// referenced by placeholders.
+var queryParamNameRegexp = regexp.MustCompile(`^[\w.-]+$`)
+
+// isServiceParent reports whether ref refers to a Service, instead of a Gateway
+// as the group and kind of a parent default to.
+func isServiceParent(ref *gw.ParentReference) bool {
+	return ref.Group != nil && *ref.Group == "" && ref.Kind != nil && *ref.Kind == "Service"
+}
+
+// parentNamespace returns the namespace of the parent ref of route.
+func parentNamespace(route *gw.HTTPRoute, ref *gw.ParentReference) string {
+	if ref.Namespace != nil {
+		return *ref.Namespace
+	}
+	return route.Namespace
+}
+
+// attachesTo returns the ports of svc to which route attaches, where zero means
+// all ports. It returns nil if route does not attach to svc.
+func attachesTo(route *gw.HTTPRoute, svc *corev1.Service) []Port {
+	var ports []Port
+	for i := range route.Spec.ParentRefs {
+		ref := &route.Spec.ParentRefs[i]
+		if !isServiceParent(ref) || ref.Name != svc.Name || parentNamespace(route, ref) != svc.Namespace {
+			continue
+		}
+		var port Port
+		if ref.Port != nil {
+			port = Port(*ref.Port)
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// routeRule is a rule translated from a match of an HTTPRoute, along with what
+// determines its precedence.
+type routeRule struct {
+	HTTPRouteRule
+
+	route *gw.HTTPRoute
+	// index is the position of the match among all the matches of route.
+	index int
+	match gw.HTTPRouteMatch
+}
+
+// translateHTTPRoute translates each match of route into a rule. A rule without
+// any match is translated as if it had a match of all requests.
+func translateHTTPRoute(route *gw.HTTPRoute) ([]routeRule, error) {
+	var rules []routeRule
+	for i, r := range route.Spec.Rules {
+		matches := r.Matches
+		if len(matches) == 0 {
+			matches = []gw.HTTPRouteMatch{{}}
+		}
+		for j, m := range matches {
+			rule, err := translateRule(route.Namespace, r, m)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d].matches[%d]: %w", i, j, err)
+			}
+			rules = append(rules, routeRule{
+				HTTPRouteRule: *rule,
+				route:         route,
+				index:         len(rules),
+				match:         m,
+			})
+		}
+	}
+	return rules, nil
+}
+
+// translateRule translates the match m of rule r, which belongs to an HTTPRoute
+// in namespace.
+func translateRule(namespace string, r gw.HTTPRouteRule, m gw.HTTPRouteMatch) (*HTTPRouteRule, error) {
+	expr, err := httpRouteMatchExpression(m)
+	if err != nil {
+		return nil, err
+	}
+	rule := &HTTPRouteRule{Expression: expr}
+
+	// The prefix matched by m, which can be replaced by the path modifiers.
+	prefix, hasPrefix := pathPrefix(m.Path)
+	pathModifier := func(pm *gw.HTTPPathModifier) (*PathModifier, error) {
+		if pm == nil {
+			return nil, nil
+		}
+		switch pm.Type {
+		case gw.FullPathHTTPPathModifier:
+			if pm.ReplaceFullPath == nil {
+				return nil, fmt.Errorf("replaceFullPath must be specified")
+			}
+			path := *pm.ReplaceFullPath
+			if path == "" {
+				path = "/"
+			}
+			return &PathModifier{FullPath: path}, nil
+		case gw.PrefixMatchHTTPPathModifier:
+			if pm.ReplacePrefixMatch == nil {
+				return nil, fmt.Errorf("replacePrefixMatch must be specified")
+			}
+			if !hasPrefix {
+				return nil, fmt.Errorf("replacePrefixMatch requires a PathPrefix match")
+			}
+			return &PathModifier{Prefix: prefix, ReplacePrefix: *pm.ReplacePrefixMatch}, nil
+		default:
+			return nil, fmt.Errorf("unsupported path modifier type %q", pm.Type)
+		}
+	}
+
+	seen := make(map[gw.HTTPRouteFilterType]bool)
+	for _, f := range r.Filters {
+		if seen[f.Type] {
+			return nil, fmt.Errorf("filter %q is specified more than once", f.Type)
+		}
+		seen[f.Type] = true
+
+		switch f.Type {
+		case gw.FilterRequestHeaderModifier:
+			rule.RequestHeaders = headerOps(f.RequestHeaderModifier)
+		case gw.FilterResponseHeaderModifier:
+			rule.ResponseHeaders = headerOps(f.ResponseHeaderModifier)
+		case gw.FilterRequestRedirect:
+			rr := f.RequestRedirect
+			if rr == nil {
+				return nil, fmt.Errorf("requestRedirect must be specified")
+			}
+			redirect := &HTTPRedirect{
+				Scheme:     stringValue(rr.Scheme),
+				Hostname:   stringValue(rr.Hostname),
+				StatusCode: intValue(rr.StatusCode),
+			}
+			if rr.Port != nil {
+				redirect.Port = int(*rr.Port)
+			}
+			if redirect.Path, err = pathModifier(rr.Path); err != nil {
+				return nil, err
+			}
+			rule.Redirect = redirect
+		case gw.FilterURLRewrite:
+			rw := f.URLRewrite
+			if rw == nil {
+				return nil, fmt.Errorf("urlRewrite must be specified")
+			}
+			rewrite := &HTTPRewrite{Hostname: stringValue(rw.Hostname)}
+			if rewrite.Path, err = pathModifier(rw.Path); err != nil {
+				return nil, err
+			}
+			rule.Rewrite = rewrite
+		default:
+			return nil, fmt.Errorf("unsupported filter type %q", f.Type)
+		}
+	}
+	if rule.Redirect != nil && rule.Rewrite != nil {
+		return nil, fmt.Errorf("filters RequestRedirect and URLRewrite are mutually exclusive")
+	}
+
+	for _, ref := range r.BackendRefs {
+		backend := HTTPRouteBackendRef{Weight: 1}
+		if ref.Weight != nil {
+			backend.Weight = int(*ref.Weight)
+		}
+		// An invalid backend is kept without a name, so that the requests
+		// to it will be rejected.
+		if backendRefProblem(namespace, &ref.BackendObjectReference) == "" {
+			if ref.Port == nil {
+				return nil, fmt.Errorf("port of backend %q must be specified", ref.Name)
+			}
+			backend.Service = ref.Name
+			backend.Port = Port(*ref.Port)
+		}
+		rule.BackendRefs = append(rule.BackendRefs, backend)
+	}
+
+	return rule, nil
+}
+
+// httpRouteMatchExpression converts m into an expression, which matches all
+// requests if it's empty.
+func httpRouteMatchExpression(m gw.HTTPRouteMatch) (string, error) {
+	var conditions []string
+
+	if p := m.Path; p != nil {
+		value := stringValue(p.Value)
+		switch pathMatchType(p) {
+		case gw.PathMatchExact:
+			conditions = append(conditions, fmt.Sprintf("{http.request.uri.path} == %s", strconv.Quote(value)))
+		case gw.PathMatchPathPrefix:
+			if prefix := strings.TrimSuffix(value, "/"); prefix != "" {
+				// A prefix only matches whole path segments.
+				re := "^" + regexp.QuoteMeta(prefix) + "(/.*)?$"
+				conditions = append(conditions, fmt.Sprintf("path_regexp(%s)", strconv.Quote(re)))
+			}
+		case gw.PathMatchRegularExpression:
+			if _, err := regexp.Compile(value); err != nil {
+				return "", fmt.Errorf("invalid path regexp: %w", err)
+			}
+			conditions = append(conditions, fmt.Sprintf("path_regexp(%s)", strconv.Quote(anchorRegexp(value))))
+		default:
+			return "", fmt.Errorf("unsupported path match type %q", *p.Type)
+		}
+	}
+
+	for _, h := range m.Headers {
+		var re string
+		switch {
+		case h.Type == nil || *h.Type == gw.HeaderMatchExact:
+			re = "^" + regexp.QuoteMeta(h.Value) + "$"
+		case *h.Type == gw.HeaderMatchRegularExpression:
+			if _, err := regexp.Compile(h.Value); err != nil {
+				return "", fmt.Errorf("invalid regexp of header %q: %w", h.Name, err)
+			}
+			re = anchorRegexp(h.Value)
+		default:
+			return "", fmt.Errorf("unsupported header match type %q", *h.Type)
+		}
+		conditions = append(conditions, fmt.Sprintf("header_regexp(%s, %s)", strconv.Quote(h.Name), strconv.Quote(re)))
+	}
+
+	for _, q := range m.QueryParams {
+		if !queryParamNameRegexp.MatchString(q.Name) {
+			return "", fmt.Errorf("unsupported query parameter name %q", q.Name)
+		}
+		placeholder := "{http.request.uri.query." + q.Name + "}"
+		switch {
+		case q.Type == nil || *q.Type == gw.QueryParamMatchExact:
+			conditions = append(conditions, fmt.Sprintf("%s == %s", placeholder, strconv.Quote(q.Value)))
+		case *q.Type == gw.QueryParamMatchRegularExpression:
+			if _, err := regexp.Compile(q.Value); err != nil {
+				return "", fmt.Errorf("invalid regexp of query parameter %q: %w", q.Name, err)
+			}
+			conditions = append(conditions, fmt.Sprintf("%s.matches(%s)", placeholder, strconv.Quote(anchorRegexp(q.Value))))
+		default:
+			return "", fmt.Errorf("unsupported query parameter match type %q", *q.Type)
+		}
+	}
+
+	if m.Method != nil {
+		conditions = append(conditions, fmt.Sprintf("method(%s)", strconv.Quote(*m.Method)))
+	}
+
+	expr := strings.Join(conditions, " && ")
+	if expr != "" {
+		if err := validateExpression(expr); err != nil {
+			return "", err
+		}
+	}
+	return expr, nil
+}
+
+func pathMatchType(p *gw.HTTPPathMatch) gw.PathMatchType {
+	if p == nil || p.Type == nil {
+		return gw.PathMatchPathPrefix
+	}
+	return *p.Type
+}
+
+// pathPrefix returns the prefix matched by p, if it's a prefix match.
+func pathPrefix(p *gw.HTTPPathMatch) (string, bool) {
+	if pathMatchType(p) != gw.PathMatchPathPrefix {
+		return "", false
+	}
+	if p == nil || p.Value == nil {
+		return "/", true
+	}
+	return *p.Value, true
+}
+
+func headerOps(f *gw.HTTPHeaderFilter) *HeaderOps {
+	if f == nil {
+		return nil
+	}
+	ops := &HeaderOps{Remove: f.Remove}
+	for _, h := range f.Set {
+		if ops.Set == nil {
+			ops.Set = make(map[string]string)
+		}
+		ops.Set[h.Name] = h.Value
+	}
+	for _, h := range f.Add {
+		if ops.Add == nil {
+			ops.Add = make(map[string][]string)
+		}
+		ops.Add[h.Name] = append(ops.Add[h.Name], h.Value)
+	}
+	return ops
+}
+
+// backendRefProblem returns the reason why ref, of an HTTPRoute in namespace,
+// cannot be resolved regardless of whether the backend exists, or an empty
+// string if there's no problem.
+func backendRefProblem(namespace string, ref *gw.BackendObjectReference) string {
+	if stringValue(ref.Group) != "" || (ref.Kind != nil && *ref.Kind != "Service") {
+		return gw.RouteReasonInvalidKind
+	}
+	if ref.Namespace != nil && *ref.Namespace != namespace {
+		return gw.RouteReasonRefNotPermitted
+	}
+	return ""
+}
+
+// rulePrecedes reports whether rule a takes precedence over rule b, by the
+// order specified by the Gateway API: an exact path match, the longest prefix
+// match, a method match, the largest number of header matches and then query
+// parameter matches. Otherwise, the rule of the older route wins, and then the
+// one of the route first in alphabetical order, and then the first rule.
+func rulePrecedes(a, b *routeRule) bool {
+	if ea, eb := pathMatchType(a.match.Path) == gw.PathMatchExact, pathMatchType(b.match.Path) == gw.PathMatchExact; ea != eb {
+		return ea
+	}
+	pa, oka := pathPrefix(a.match.Path)
+	pb, okb := pathPrefix(b.match.Path)
+	if oka != okb {
+		return oka
+	}
+	if len(pa) != len(pb) {
+		return len(pa) > len(pb)
+	}
+	if ma, mb := a.match.Method != nil, b.match.Method != nil; ma != mb {
+		return ma
+	}
+	if len(a.match.Headers) != len(b.match.Headers) {
+		return len(a.match.Headers) > len(b.match.Headers)
+	}
+	if len(a.match.QueryParams) != len(b.match.QueryParams) {
+		return len(a.match.QueryParams) > len(b.match.QueryParams)
+	}
+
+	ra, rb := a.route, b.route
+	if !ra.CreationTimestamp.Equal(&rb.CreationTimestamp) {
+		return ra.CreationTimestamp.Before(&rb.CreationTimestamp)
+	}
+	if ra.Namespace != rb.Namespace {
+		return ra.Namespace < rb.Namespace
+	}
+	if ra.Name != rb.Name {
+		return ra.Name < rb.Name
+	}
+	return a.index < b.index
+}
+
+// httpRouteRules returns the rules, in order of precedence, of the valid routes
+// attaching to svc.
+func httpRouteRules(svc *corev1.Service, routes []gw.HTTPRoute) []HTTPRouteRule {
+	var rules []routeRule
+	for i := range routes {
+		route := &routes[i]
+		ports := attachesTo(route, svc)
+		if len(ports) == 0 || route.Namespace != svc.Namespace {
+			continue
+		}
+		translated, err := translateHTTPRoute(route)
+		if err != nil {
+			continue // The error is reported in the status of route.
+		}
+		for _, port := range ports {
+			for _, r := range translated {
+				r.Port = port
+				rules = append(rules, r)
+			}
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rulePrecedes(&rules[i], &rules[j])
+	})
+
+	var result []HTTPRouteRule
+	for _, r := range rules {
+		result = append(result, r.HTTPRouteRule)
+	}
+	return result
+}
+
+// httpRouteStatus computes the status of route with respect to each of its
+// Service parents, given the Services in the namespace of route along with
+// whether they are eligible. The statuses with respect to the other parents
+// are left untouched, and the existing conditions are updated in place, to
+// keep their transition times.
+func httpRouteStatus(route *gw.HTTPRoute, services map[string]bool) *gw.HTTPRouteStatus {
+	status := &gw.HTTPRouteStatus{}
+	existing := make(map[string]*gw.RouteParentStatus)
+	for i := range route.Status.Parents {
+		p := route.Status.Parents[i].DeepCopy()
+		if p.ControllerName != HTTPRouteControllerName {
+			status.Parents = append(status.Parents, *p)
+			continue
+		}
+		existing[parentKey(&p.ParentRef)] = p
+	}
+
+	_, translateErr := translateHTTPRoute(route)
+	resolved := metav1.Condition{
+		Type:    gw.RouteConditionResolvedRefs,
+		Status:  metav1.ConditionTrue,
+		Reason:  gw.RouteReasonResolvedRefs,
+		Message: "All references are resolved",
+	}
+	for _, r := range route.Spec.Rules {
+		for _, ref := range r.BackendRefs {
+			reason := backendRefProblem(route.Namespace, &ref.BackendObjectReference)
+			if _, ok := services[ref.Name]; reason == "" && !ok {
+				reason = gw.RouteReasonBackendNotFound
+			}
+			if reason != "" && resolved.Status == metav1.ConditionTrue {
+				resolved.Status = metav1.ConditionFalse
+				resolved.Reason = reason
+				resolved.Message = fmt.Sprintf("Backend %q cannot be resolved", ref.Name)
+			}
+		}
+	}
+
+	for i := range route.Spec.ParentRefs {
+		ref := &route.Spec.ParentRefs[i]
+		if !isServiceParent(ref) {
+			continue
+		}
+		p, ok := existing[parentKey(ref)]
+		if !ok {
+			p = &gw.RouteParentStatus{ControllerName: HTTPRouteControllerName}
+		}
+		p.ParentRef = *ref.DeepCopy()
+		delete(existing, parentKey(ref))
+
+		accepted := metav1.Condition{
+			Type:   gw.RouteConditionAccepted,
+			Status: metav1.ConditionFalse,
+		}
+		eligible, found := services[ref.Name]
+		switch {
+		case parentNamespace(route, ref) != route.Namespace:
+			accepted.Reason = gw.RouteReasonNotAllowedByParents
+			accepted.Message = "Routes in other namespaces than the parent Service are not supported"
+		case !found:
+			accepted.Reason = gw.RouteReasonNoMatchingParent
+			accepted.Message = fmt.Sprintf("Service %q not found", ref.Name)
+		case !eligible:
+			accepted.Reason = gw.RouteReasonNoMatchingParent
+			accepted.Message = fmt.Sprintf("Service %q is not in the mesh", ref.Name)
+		case translateErr != nil:
+			accepted.Reason = gw.RouteReasonUnsupportedValue
+			accepted.Message = translateErr.Error()
+		default:
+			accepted.Status = metav1.ConditionTrue
+			accepted.Reason = gw.RouteReasonAccepted
+			accepted.Message = "Route is accepted"
+		}
+
+		for _, cond := range []metav1.Condition{accepted, resolved} {
+			cond.ObservedGeneration = route.Generation
+			meta.SetStatusCondition(&p.Conditions, cond)
+		}
+		status.Parents = append(status.Parents, *p)
+	}
+
+	return status
+}
+
+// parentKey identifies the parent referenced by ref.
+func parentKey(ref *gw.ParentReference) string {
+	var port string
+	if ref.Port != nil {
+		port = strconv.Itoa(int(*ref.Port))
+	}
+	return strings.Join([]string{
+		stringValue(ref.Group),
+		stringValue(ref.Kind),
+		stringValue(ref.Namespace),
+		ref.Name,
+		stringValue(ref.SectionName),
+		port,
+	}, "/")
+}
+
+// applyHTTPRoutes resolves the HTTPRoutes attaching to svc into d.
+func (c *Controller) applyHTTPRoutes(ctx context.Context, svc *corev1.Service, d *Definitions) error {
+	if !c.config.EnableGatewayAPI || d == nil {
+		return nil
+	}
+
+	routes := &gw.HTTPRouteList{}
+	if err := c.client.List(ctx, routes, client.InNamespace(svc.Namespace)); err != nil {
+		return err
+	}
+	d.HTTPRouteRules = httpRouteRules(svc, routes.Items)
+	return nil
+}
+
+// ReconcileHTTPRoutes updates the status of all the HTTPRoutes in the namespace
+// of req, regardless of its name, since a change of any Service may affect the
+// status of any route.
+func (c *Controller) ReconcileHTTPRoutes(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	c.logger.Info("Reconciling HTTP routes", "namespace", req.Namespace)
+
+	routes := &gw.HTTPRouteList{}
+	if err := c.client.List(ctx, routes, client.InNamespace(req.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	if len(routes.Items) == 0 {
+		return reconcile.Result{}, nil
+	}
+
+	services := &corev1.ServiceList{}
+	if err := c.client.List(ctx, services, client.InNamespace(req.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	eligible := make(map[string]bool)
+	for i := range services.Items {
+		svc := &services.Items[i]
+		eligible[svc.Name] = c.isEligible(svc)
+	}
+
+	for i := range routes.Items {
+		route := &routes.Items[i]
+		status := httpRouteStatus(route, eligible)
+		if equality.Semantic.DeepEqual(&route.Status, status) {
+			continue
+		}
+		route.Status = *status
+		if err := c.client.Status().Update(ctx, route); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// mapHTTPRoute maps an HTTPRoute to the eligible Services it attaches to.
+func (c *Controller) mapHTTPRoute(obj client.Object) []reconcile.Request {
+	route, ok := obj.(*gw.HTTPRoute)
+	if !ok {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range route.Spec.ParentRefs {
+		ref := &route.Spec.ParentRefs[i]
+		if isServiceParent(ref) && parentNamespace(route, ref) == route.Namespace {
+			requests = append(requests, c.eligibleService(route.Namespace, ref.Name)...)
+		}
+	}
+	return requests
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
@@ -0,0 +1,339 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gw "github.com/RussellLuo/caddy-mesh/api/gateway/v1beta1"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func serviceParent(name string) gw.ParentReference {
+	return gw.ParentReference{Group: ptr(""), Kind: ptr("Service"), Name: name}
+}
+
+func backendRef(name string, port int32, weight int32) gw.HTTPBackendRef {
+	return gw.HTTPBackendRef{
+		BackendObjectReference: gw.BackendObjectReference{Name: name, Port: ptr(port)},
+		Weight:                 ptr(weight),
+	}
+}
+
+func newHTTPRoute(name string, age time.Duration, spec gw.HTTPRouteSpec) gw.HTTPRoute {
+	return gw.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "test",
+			Generation:        1,
+			CreationTimestamp: metav1.NewTime(time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC).Add(-age)),
+		},
+		Spec: spec,
+	}
+}
+
+func TestHTTPRouteMatchExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      gw.HTTPRouteMatch
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no match",
+			want: "",
+		},
+		{
+			name: "root prefix",
+			in:   gw.HTTPRouteMatch{Path: &gw.HTTPPathMatch{Value: ptr("/")}},
+			want: "",
+		},
+		{
+			name: "prefix",
+			in: gw.HTTPRouteMatch{
+				Path:   &gw.HTTPPathMatch{Type: ptr(gw.PathMatchPathPrefix), Value: ptr("/api.v1/")},
+				Method: ptr("POST"),
+			},
+			want: `path_regexp("^/api\\.v1(/.*)?$") && method("POST")`,
+		},
+		{
+			name: "exact path and headers",
+			in: gw.HTTPRouteMatch{
+				Path: &gw.HTTPPathMatch{Type: ptr(gw.PathMatchExact), Value: ptr("/login")},
+				Headers: []gw.HTTPHeaderMatch{
+					{Name: "X-Version", Value: "v2+"},
+					{Type: ptr(gw.HeaderMatchRegularExpression), Name: "User-Agent", Value: ".*Firefox.*"},
+				},
+			},
+			want: `{http.request.uri.path} == "/login" && header_regexp("X-Version", "^v2\\+$") && header_regexp("User-Agent", "^(?:.*Firefox.*)$")`,
+		},
+		{
+			name: "regexp path and query parameters",
+			in: gw.HTTPRouteMatch{
+				Path: &gw.HTTPPathMatch{Type: ptr(gw.PathMatchRegularExpression), Value: ptr("/users/[0-9]+")},
+				QueryParams: []gw.HTTPQueryParamMatch{
+					{Name: "debug", Value: "1"},
+					{Type: ptr(gw.QueryParamMatchRegularExpression), Name: "page", Value: "[0-9]+"},
+				},
+			},
+			want: `path_regexp("^(?:/users/[0-9]+)$") && {http.request.uri.query.debug} == "1" && {http.request.uri.query.page}.matches("^(?:[0-9]+)$")`,
+		},
+		{
+			name: "bad regexp",
+			in: gw.HTTPRouteMatch{
+				Path: &gw.HTTPPathMatch{Type: ptr(gw.PathMatchRegularExpression), Value: ptr("/users/(")},
+			},
+			wantErr: "invalid path regexp: error parsing regexp: missing closing ): `/users/(`",
+		},
+		{
+			name: "bad query parameter name",
+			in: gw.HTTPRouteMatch{
+				QueryParams: []gw.HTTPQueryParamMatch{{Name: "a b", Value: "1"}},
+			},
+			wantErr: `unsupported query parameter name "a b"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := httpRouteMatchExpression(tt.in)
+			if got != tt.want {
+				t.Errorf("Got (%s) != Want (%s)", got, tt.want)
+			}
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Err: Got (%q) != Want (%q)", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPRouteRules(t *testing.T) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "test"}}
+	routes := []gw.HTTPRoute{
+		newHTTPRoute("newer", 0, gw.HTTPRouteSpec{
+			ParentRefs: []gw.ParentReference{serviceParent("server")},
+			Rules: []gw.HTTPRouteRule{
+				{
+					Matches: []gw.HTTPRouteMatch{
+						{Path: &gw.HTTPPathMatch{Value: ptr("/api")}},
+						{Path: &gw.HTTPPathMatch{Type: ptr(gw.PathMatchExact), Value: ptr("/login")}},
+					},
+					Filters: []gw.HTTPRouteFilter{
+						{
+							Type: gw.FilterRequestHeaderModifier,
+							RequestHeaderModifier: &gw.HTTPHeaderFilter{
+								Set:    []gw.HTTPHeader{{Name: "X-Mesh", Value: "caddy"}},
+								Remove: []string{"X-Debug"},
+							},
+						},
+						{
+							Type: gw.FilterURLRewrite,
+							URLRewrite: &gw.HTTPURLRewriteFilter{
+								Path: &gw.HTTPPathModifier{Type: gw.FullPathHTTPPathModifier, ReplaceFullPath: ptr("/v2")},
+							},
+						},
+					},
+					BackendRefs: []gw.HTTPBackendRef{
+						backendRef("server-v1", 80, 90),
+						backendRef("server-v2", 8080, 10),
+					},
+				},
+			},
+		}),
+		newHTTPRoute("older", time.Hour, gw.HTTPRouteSpec{
+			ParentRefs: []gw.ParentReference{
+				{Group: ptr(""), Kind: ptr("Service"), Name: "server", Port: ptr(int32(80))},
+			},
+			Rules: []gw.HTTPRouteRule{
+				{
+					Matches: []gw.HTTPRouteMatch{
+						{Path: &gw.HTTPPathMatch{Value: ptr("/api")}},
+					},
+					Filters: []gw.HTTPRouteFilter{
+						{
+							Type: gw.FilterRequestRedirect,
+							RequestRedirect: &gw.HTTPRequestRedirectFilter{
+								Path:       &gw.HTTPPathModifier{Type: gw.PrefixMatchHTTPPathModifier, ReplacePrefixMatch: ptr("/v1")},
+								StatusCode: ptr(301),
+							},
+						},
+					},
+				},
+				{
+					BackendRefs: []gw.HTTPBackendRef{
+						{
+							BackendObjectReference: gw.BackendObjectReference{Name: "other", Namespace: ptr("other"), Port: ptr(int32(80))},
+						},
+					},
+				},
+			},
+		}),
+		newHTTPRoute("invalid", 0, gw.HTTPRouteSpec{
+			ParentRefs: []gw.ParentReference{serviceParent("server")},
+			Rules: []gw.HTTPRouteRule{
+				{Filters: []gw.HTTPRouteFilter{{Type: gw.FilterRequestMirror}}},
+			},
+		}),
+		newHTTPRoute("gateway", 0, gw.HTTPRouteSpec{
+			ParentRefs: []gw.ParentReference{{Name: "server"}},
+			Rules:      []gw.HTTPRouteRule{{}},
+		}),
+	}
+
+	got := httpRouteRules(svc, routes)
+
+	apiRule := HTTPRouteRule{
+		Expression: `path_regexp("^/api(/.*)?$")`,
+		RequestHeaders: &HeaderOps{
+			Set:    map[string]string{"X-Mesh": "caddy"},
+			Remove: []string{"X-Debug"},
+		},
+		Rewrite: &HTTPRewrite{Path: &PathModifier{FullPath: "/v2"}},
+		BackendRefs: []HTTPRouteBackendRef{
+			{Service: "server-v1", Port: 80, Weight: 90},
+			{Service: "server-v2", Port: 8080, Weight: 10},
+		},
+	}
+	loginRule := apiRule
+	loginRule.Expression = `{http.request.uri.path} == "/login"`
+	want := []HTTPRouteRule{
+		loginRule,
+		{
+			Port:       80,
+			Expression: `path_regexp("^/api(/.*)?$")`,
+			Redirect: &HTTPRedirect{
+				Path:       &PathModifier{Prefix: "/api", ReplacePrefix: "/v1"},
+				StatusCode: 301,
+			},
+		},
+		apiRule,
+		{
+			Port:        80,
+			BackendRefs: []HTTPRouteBackendRef{{Weight: 1}},
+		},
+	}
+	if !cmp.Equal(got, want) {
+		diff := cmp.Diff(got, want)
+		t.Errorf("Want - Got: %s", diff)
+	}
+}
+
+func TestHTTPRouteStatus(t *testing.T) {
+	services := map[string]bool{
+		"server":    true,
+		"server-v1": true,
+		"ignored":   false,
+	}
+
+	type condition struct {
+		Type   string
+		Status metav1.ConditionStatus
+		Reason string
+	}
+	tests := []struct {
+		name  string
+		route gw.HTTPRoute
+		want  map[string][]condition
+	}{
+		{
+			name: "accepted",
+			route: newHTTPRoute("route", 0, gw.HTTPRouteSpec{
+				ParentRefs: []gw.ParentReference{serviceParent("server"), {Name: "gateway"}},
+				Rules: []gw.HTTPRouteRule{
+					{BackendRefs: []gw.HTTPBackendRef{backendRef("server-v1", 80, 1)}},
+				},
+			}),
+			want: map[string][]condition{
+				"server": {
+					{Type: gw.RouteConditionAccepted, Status: metav1.ConditionTrue, Reason: gw.RouteReasonAccepted},
+					{Type: gw.RouteConditionResolvedRefs, Status: metav1.ConditionTrue, Reason: gw.RouteReasonResolvedRefs},
+				},
+			},
+		},
+		{
+			name: "unresolved refs",
+			route: newHTTPRoute("route", 0, gw.HTTPRouteSpec{
+				ParentRefs: []gw.ParentReference{serviceParent("server"), serviceParent("ignored"), serviceParent("missing")},
+				Rules: []gw.HTTPRouteRule{
+					{BackendRefs: []gw.HTTPBackendRef{backendRef("server-v2", 80, 1)}},
+				},
+			}),
+			want: map[string][]condition{
+				"server": {
+					{Type: gw.RouteConditionAccepted, Status: metav1.ConditionTrue, Reason: gw.RouteReasonAccepted},
+					{Type: gw.RouteConditionResolvedRefs, Status: metav1.ConditionFalse, Reason: gw.RouteReasonBackendNotFound},
+				},
+				"ignored": {
+					{Type: gw.RouteConditionAccepted, Status: metav1.ConditionFalse, Reason: gw.RouteReasonNoMatchingParent},
+					{Type: gw.RouteConditionResolvedRefs, Status: metav1.ConditionFalse, Reason: gw.RouteReasonBackendNotFound},
+				},
+				"missing": {
+					{Type: gw.RouteConditionAccepted, Status: metav1.ConditionFalse, Reason: gw.RouteReasonNoMatchingParent},
+					{Type: gw.RouteConditionResolvedRefs, Status: metav1.ConditionFalse, Reason: gw.RouteReasonBackendNotFound},
+				},
+			},
+		},
+		{
+			name: "unsupported",
+			route: newHTTPRoute("route", 0, gw.HTTPRouteSpec{
+				ParentRefs: []gw.ParentReference{serviceParent("server")},
+				Rules: []gw.HTTPRouteRule{
+					{
+						Filters: []gw.HTTPRouteFilter{{Type: gw.FilterExtensionRef}},
+						BackendRefs: []gw.HTTPBackendRef{
+							{BackendObjectReference: gw.BackendObjectReference{Group: ptr("example.com"), Kind: ptr("Bucket"), Name: "bucket"}},
+						},
+					},
+				},
+			}),
+			want: map[string][]condition{
+				"server": {
+					{Type: gw.RouteConditionAccepted, Status: metav1.ConditionFalse, Reason: gw.RouteReasonUnsupportedValue},
+					{Type: gw.RouteConditionResolvedRefs, Status: metav1.ConditionFalse, Reason: gw.RouteReasonInvalidKind},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The status written by another controller must be kept.
+			other := gw.RouteParentStatus{ParentRef: gw.ParentReference{Name: "gateway"}, ControllerName: "example.com/gateway"}
+			tt.route.Status.Parents = []gw.RouteParentStatus{other}
+
+			status := httpRouteStatus(&tt.route, services)
+
+			got := make(map[string][]condition)
+			for _, p := range status.Parents {
+				if p.ControllerName != HTTPRouteControllerName {
+					if !cmp.Equal(p, other) {
+						t.Errorf("Status of other controllers changed: %+v", p)
+					}
+					continue
+				}
+				for _, c := range p.Conditions {
+					got[p.ParentRef.Name] = append(got[p.ParentRef.Name], condition{Type: c.Type, Status: c.Status, Reason: c.Reason})
+				}
+				if c := meta.FindStatusCondition(p.Conditions, gw.RouteConditionAccepted); c.ObservedGeneration != 1 {
+					t.Errorf("ObservedGeneration: Got (%d) != Want (1)", c.ObservedGeneration)
+				}
+			}
+			if !cmp.Equal(got, tt.want) {
+				diff := cmp.Diff(got, tt.want)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	changesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "caddy_mesh_config_changes_total",
+		Help: "Total number of changes made to the Caddy configuration.",
+	})
+	coalescedChangesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "caddy_mesh_config_coalesced_changes_total",
+		Help: "Total number of changes that have been coalesced into another change's rebuild and push.",
+	})
+	changesPerCommit = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "caddy_mesh_config_changes_per_commit",
+		Help:    "Number of changes collapsed into each rebuild of the Caddy configuration.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+	pushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "caddy_mesh_config_pushes_total",
+		Help: "Total number of successful pushes to Caddy instances, by mode (full or incremental).",
+	}, []string{"mode"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		changesTotal,
+		coalescedChangesTotal,
+		changesPerCommit,
+		pushesTotal,
+	)
+}
@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// snapshotIndex indexes the routes, in a snapshot, that can be updated
+// individually through the /id/ endpoints of the Caddy admin API.
+type snapshotIndex struct {
+	// skeleton is the configuration with all the indexed routes removed.
+	// Two snapshots with different skeletons are structurally different.
+	skeleton []byte
+	// routes are the indexed routes by their @id.
+	routes map[string]*indexedRoute
+}
+
+type indexedRoute struct {
+	// container is the @id of the subroute handler containing the route.
+	container string
+	data      []byte
+	// rest is the route with the upstreams of all its proxies removed.
+	rest []byte
+	// upstreams are the upstreams of the proxies in the route, by the @id
+	// of the proxies.
+	upstreams map[string][]byte
+}
+
+// newSnapshotIndex indexes every route, with an @id, that is contained by a
+// subroute handler with an @id.
+func newSnapshotIndex(data []byte) (*snapshotIndex, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	index := &snapshotIndex{routes: make(map[string]*indexedRoute)}
+	if err := index.walk(doc); err != nil {
+		return nil, err
+	}
+
+	skeleton, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	index.skeleton = skeleton
+
+	return index, nil
+}
+
+func (x *snapshotIndex) walk(v interface{}) error {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if err := x.walk(e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		container, _ := v["@id"].(string)
+		routes, _ := v["routes"].([]interface{})
+		if v["handler"] != "subroute" || container == "" {
+			for _, e := range v {
+				if err := x.walk(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var rest []interface{}
+		for _, r := range routes {
+			route, _ := r.(map[string]interface{})
+			id, _ := route["@id"].(string)
+			if id == "" {
+				rest = append(rest, r)
+				continue
+			}
+			if _, ok := x.routes[id]; ok {
+				return fmt.Errorf("duplicate @id %q", id)
+			}
+			indexed, err := newIndexedRoute(container, route)
+			if err != nil {
+				return err
+			}
+			x.routes[id] = indexed
+		}
+		v["routes"] = rest
+	}
+	return nil
+}
+
+func newIndexedRoute(container string, route map[string]interface{}) (*indexedRoute, error) {
+	data, err := json.Marshal(route)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &indexedRoute{
+		container: container,
+		data:      data,
+		upstreams: make(map[string][]byte),
+	}
+	if err := r.takeUpstreams(route); err != nil {
+		return nil, err
+	}
+
+	// The upstreams have been taken from route now.
+	if r.rest, err = json.Marshal(route); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// takeUpstreams moves the upstreams of all the proxies, with an @id, in v into r.
+func (r *indexedRoute) takeUpstreams(v interface{}) error {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if err := r.takeUpstreams(e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if id, _ := v["@id"].(string); id != "" && v["handler"] == "reverse_proxy" {
+			data, err := json.Marshal(v["upstreams"])
+			if err != nil {
+				return err
+			}
+			r.upstreams[id] = data
+			delete(v, "upstreams")
+			return nil
+		}
+		for _, e := range v {
+			if err := r.takeUpstreams(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// patchOp is a request to the Caddy admin API.
+type patchOp struct {
+	Method string
+	Path   string
+	Data   []byte
+}
+
+// diff returns the requests that turn the configuration of the snapshot
+// indexed by from into the one indexed by to. It will return ok=false if
+// the two snapshots are structurally different.
+func diff(from, to *snapshotIndex) (ops []patchOp, ok bool) {
+	if !bytes.Equal(from.skeleton, to.skeleton) {
+		return nil, false
+	}
+
+	for _, id := range sortedKeys(from.routes) {
+		if _, ok := to.routes[id]; !ok {
+			ops = append(ops, patchOp{
+				Method: http.MethodDelete,
+				Path:   "/id/" + id,
+			})
+		}
+	}
+
+	for _, id := range sortedKeys(to.routes) {
+		newRoute := to.routes[id]
+		oldRoute, ok := from.routes[id]
+		switch {
+		case !ok:
+			// Routes are matched by disjoint hosts, so appending is fine.
+			ops = append(ops, patchOp{
+				Method: http.MethodPost,
+				Path:   "/id/" + newRoute.container + "/routes",
+				Data:   newRoute.data,
+			})
+		case oldRoute.container != newRoute.container:
+			return nil, false
+		case bytes.Equal(oldRoute.data, newRoute.data):
+		case bytes.Equal(oldRoute.rest, newRoute.rest) && sameKeys(oldRoute.upstreams, newRoute.upstreams):
+			// Only the upstreams have been changed.
+			for _, proxyID := range sortedKeys(newRoute.upstreams) {
+				if data := newRoute.upstreams[proxyID]; !bytes.Equal(oldRoute.upstreams[proxyID], data) {
+					ops = append(ops, patchOp{
+						Method: http.MethodPatch,
+						Path:   "/id/" + proxyID + "/upstreams",
+						Data:   data,
+					})
+				}
+			}
+		default:
+			ops = append(ops, patchOp{
+				Method: http.MethodPatch,
+				Path:   "/id/" + id,
+				Data:   newRoute.data,
+			})
+		}
+	}
+
+	return ops, true
+}
+
+func sameKeys[V any](a, b map[string]V) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// patchSize returns the total size of the data to be sent by ops.
+func patchSize(ops []patchOp) (n int) {
+	for _, op := range ops {
+		n += len(op.Data)
+	}
+	return n
+}
+
+// replaceRoutes replaces the indexed routes in data with the given ones by
+// their @id, where a nil route means the route should be removed.
+func replaceRoutes(data []byte, routes map[string][]byte) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := replaceIn(doc, routes); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func replaceIn(v interface{}, routes map[string][]byte) error {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if err := replaceIn(e, routes); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		container, _ := v["@id"].(string)
+		if v["handler"] != "subroute" || container == "" {
+			for _, e := range v {
+				if err := replaceIn(e, routes); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		oldRoutes, _ := v["routes"].([]interface{})
+		var newRoutes []interface{}
+		for _, r := range oldRoutes {
+			route, _ := r.(map[string]interface{})
+			id, _ := route["@id"].(string)
+			data, ok := routes[id]
+			switch {
+			case !ok:
+				newRoutes = append(newRoutes, r)
+			case data != nil:
+				var newRoute interface{}
+				if err := json.Unmarshal(data, &newRoute); err != nil {
+					return err
+				}
+				newRoutes = append(newRoutes, newRoute)
+			}
+		}
+		v["routes"] = newRoutes
+	}
+	return nil
+}
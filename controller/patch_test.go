@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	newService := func(name string, port Port, ip string, d *Definitions) *Service {
+		return &Service{
+			Key:         Key{Name: name, Namespace: "test"},
+			Ports:       []ServicePort{{Port: port, Upstreams: []Upstream{{IP: ip, Port: 80}}}},
+			Definitions: d,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		inOld   []*Service
+		inNew   []*Service
+		wantOps []patchOp
+		wantOK  bool
+	}{
+		{
+			name:   "no change",
+			inOld:  []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			inNew:  []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			wantOK: true,
+		},
+		{
+			name:  "upstreams changed",
+			inOld: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			inNew: []*Service{newService("service-1", 80, "127.0.0.2", nil)},
+			wantOps: []patchOp{
+				{
+					Method: http.MethodPatch,
+					Path:   "/id/service.test.service-1.80.proxy/upstreams",
+					Data:   []byte(`[{"dial":"127.0.0.2:80"}]`),
+				},
+			},
+			wantOK: true,
+		},
+		{
+			name:  "definitions changed",
+			inOld: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			inNew: []*Service{newService("service-1", 80, "127.0.0.1", &Definitions{RetryCount: 2})},
+			wantOps: []patchOp{
+				{
+					Method: http.MethodPatch,
+					Path:   "/id/service.test.service-1.80",
+					Data:   []byte(`{"@id":"service.test.service-1.80","handle":[{"@id":"service.test.service-1.80.proxy","handler":"reverse_proxy","load_balancing":{"retries":2,"selection_policy":{"policy":"round_robin"}},"upstreams":[{"dial":"127.0.0.1:80"}]}],"match":[{"host":["service-1.test.caddy.mesh"]}]}`),
+				},
+			},
+			wantOK: true,
+		},
+		{
+			name:  "service added",
+			inOld: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			inNew: []*Service{
+				newService("service-1", 80, "127.0.0.1", nil),
+				newService("service-2", 80, "127.0.0.2", nil),
+			},
+			wantOps: []patchOp{
+				{
+					Method: http.MethodPost,
+					Path:   "/id/services.80/routes",
+					Data:   []byte(`{"@id":"service.test.service-2.80","handle":[{"@id":"service.test.service-2.80.proxy","handler":"reverse_proxy","load_balancing":{"selection_policy":{"policy":"round_robin"}},"upstreams":[{"dial":"127.0.0.2:80"}]}],"match":[{"host":["service-2.test.caddy.mesh"]}]}`),
+				},
+			},
+			wantOK: true,
+		},
+		{
+			name: "service deleted",
+			inOld: []*Service{
+				newService("service-1", 80, "127.0.0.1", nil),
+				newService("service-2", 80, "127.0.0.2", nil),
+			},
+			inNew: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			wantOps: []patchOp{
+				{
+					Method: http.MethodDelete,
+					Path:   "/id/service.test.service-2.80",
+				},
+			},
+			wantOK: true,
+		},
+		{
+			name:  "server added",
+			inOld: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+			inNew: []*Service{
+				newService("service-1", 80, "127.0.0.1", nil),
+				newService("service-2", 8080, "127.0.0.2", nil),
+			},
+		},
+		{
+			name:  "server removed",
+			inOld: []*Service{newService("service-1", 80, "127.0.0.1", nil)},
+		},
+	}
+
+	index := func(t *testing.T, services []*Service) *snapshotIndex {
+		c := NewCaddyConfigurator(testLogger, testGetter, nil)
+		for _, svc := range services {
+			c.Upsert(svc)
+		}
+		c.commit()
+		return c.snapshot.index
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, ok := diff(index(t, tt.inOld), index(t, tt.inNew))
+			if ok != tt.wantOK {
+				t.Fatalf("OK: Got (%v) != Want (%v)", ok, tt.wantOK)
+			}
+			if !cmp.Equal(ops, tt.wantOps) {
+				diff := cmp.Diff(ops, tt.wantOps)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/RussellLuo/caddy-mesh/api/v1alpha1"
+)
+
+// policySettings converts the settings of a MeshPolicy into the equivalent
+// annotations.
+func policySettings(spec *v1alpha1.MeshPolicySpec) map[string]string {
+	settings := make(map[string]string)
+	setString := func(name, value string) {
+		if value != "" {
+			settings[AnnotationPrefix+name] = value
+		}
+	}
+	setInt := func(name string, value int32) {
+		if value != 0 {
+			setString(name, strconv.Itoa(int(value)))
+		}
+	}
+	setDuration := func(name string, value *metav1.Duration) {
+		if value != nil {
+			setString(name, value.Duration.String())
+		}
+	}
+
+	if t := spec.Timeout; t != nil {
+		setDuration("timeout-dial-timeout", t.DialTimeout)
+		setDuration("timeout-read-timeout", t.ReadTimeout)
+		setDuration("timeout-write-timeout", t.WriteTimeout)
+	}
+	if r := spec.Retry; r != nil {
+		setInt("retry-count", r.Count)
+		setDuration("retry-duration", r.Duration)
+		setString("retry-on", r.On)
+	}
+	if r := spec.RateLimit; r != nil {
+		setString("rate-limit-key", r.Key)
+		setString("rate-limit-rate", r.Rate)
+		setInt("rate-limit-zone-size", r.ZoneSize)
+	}
+	if cb := spec.CircuitBreaker; cb != nil {
+		setInt("circuit-breaker-max-fails", cb.MaxFails)
+		setInt("circuit-breaker-max-requests", cb.MaxRequests)
+		setDuration("circuit-breaker-fail-duration", cb.FailDuration)
+		var codes []string
+		for _, code := range cb.UnhealthyStatus {
+			codes = append(codes, strconv.Itoa(int(code)))
+		}
+		setString("circuit-breaker-unhealthy-status", strings.Join(codes, ","))
+		setDuration("circuit-breaker-unhealthy-latency", cb.UnhealthyLatency)
+	}
+
+	return settings
+}
+
+// validatePolicy checks whether the policy is valid. Invalid policies are not
+// taken into account.
+func validatePolicy(p *v1alpha1.MeshPolicy) error {
+	spec := &p.Spec
+	switch {
+	case spec.TargetRef == nil && spec.Selector == nil:
+		return fmt.Errorf("either targetRef or selector must be specified")
+	case spec.TargetRef != nil && spec.Selector != nil:
+		return fmt.Errorf("targetRef and selector are mutually exclusive")
+	case spec.TargetRef != nil:
+		ref := spec.TargetRef
+		if ref.Group != "" || ref.Kind != "Service" {
+			return fmt.Errorf("unsupported targetRef kind %q in group %q, only Services are supported", ref.Kind, ref.Group)
+		}
+		if ref.Name == "" {
+			return fmt.Errorf("targetRef.name must be specified")
+		}
+	default:
+		if _, err := metav1.LabelSelectorAsSelector(spec.Selector); err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+	}
+
+	if _, err := NewDefinitions(policySettings(spec)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// targets reports whether the valid policy p targets svc.
+func targets(p *v1alpha1.MeshPolicy, svc *corev1.Service) bool {
+	if p.Namespace != svc.Namespace {
+		return false
+	}
+	if ref := p.Spec.TargetRef; ref != nil {
+		return ref.Name == svc.Name
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.Selector)
+	return err == nil && selector.Matches(labels.Set(svc.Labels))
+}
+
+// policyPrecedes reports whether policy a takes precedence over policy b. A
+// policy targeting a Service by name is more specific than one by selector.
+// Otherwise, just as in the Gateway API, the older policy wins, and then the
+// one first in alphabetical order.
+func policyPrecedes(a, b *v1alpha1.MeshPolicy) bool {
+	if byName := a.Spec.TargetRef != nil; byName != (b.Spec.TargetRef != nil) {
+		return byName
+	}
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// policyConflict is a setting of the loser policy overridden by the one of the
+// winner policy, both targeting the same Service.
+type policyConflict struct {
+	Service    string
+	Annotation string
+	Winner     string
+	Loser      string
+}
+
+// resolvePolicies merges the settings of the given policies, which are valid
+// and target the Service, into annotations. A setting is taken from the policy
+// with the highest precedence, and the conflicting ones are reported.
+func resolvePolicies(service string, policies []*v1alpha1.MeshPolicy) (map[string]string, []policyConflict) {
+	sorted := append([]*v1alpha1.MeshPolicy(nil), policies...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return policyPrecedes(sorted[i], sorted[j])
+	})
+
+	resolved := make(map[string]string)
+	owners := make(map[string]string)
+	var conflicts []policyConflict
+	for _, p := range sorted {
+		settings := policySettings(&p.Spec)
+		for _, name := range sortedKeys(settings) {
+			value := settings[name]
+			owner, ok := owners[name]
+			if !ok {
+				resolved[name] = value
+				owners[name] = p.Name
+				continue
+			}
+			if resolved[name] != value {
+				conflicts = append(conflicts, policyConflict{
+					Service:    service,
+					Annotation: name,
+					Winner:     owner,
+					Loser:      p.Name,
+				})
+			}
+		}
+	}
+
+	return resolved, conflicts
+}
+
+// targetingPolicies returns the valid policies, among the given ones, that
+// target svc.
+func targetingPolicies(svc *corev1.Service, policies []v1alpha1.MeshPolicy) []*v1alpha1.MeshPolicy {
+	var result []*v1alpha1.MeshPolicy
+	for i := range policies {
+		p := &policies[i]
+		if validatePolicy(p) == nil && targets(p, svc) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// policyStatuses computes the status of each of the given policies, keyed by
+// name, from the Services in the same namespace. The existing conditions are
+// updated in place, to keep their transition times.
+func policyStatuses(services []corev1.Service, policies []v1alpha1.MeshPolicy) map[string]*v1alpha1.MeshPolicyStatus {
+	statuses := make(map[string]*v1alpha1.MeshPolicyStatus)
+	for i := range policies {
+		p := &policies[i]
+		status := p.Status.DeepCopy()
+		status.Services = nil
+		statuses[p.Name] = status
+
+		if err := validatePolicy(p); err != nil {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               v1alpha1.PolicyConditionAccepted,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: p.Generation,
+				Reason:             "Invalid",
+				Message:            err.Error(),
+			})
+			meta.RemoveStatusCondition(&status.Conditions, v1alpha1.PolicyConditionConflicted)
+			continue
+		}
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               v1alpha1.PolicyConditionAccepted,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: p.Generation,
+			Reason:             "Accepted",
+			Message:            "Policy is valid",
+		})
+	}
+
+	conflicts := make(map[string][]string)
+	for i := range services {
+		svc := &services[i]
+		targeting := targetingPolicies(svc, policies)
+		for _, p := range targeting {
+			statuses[p.Name].Services = append(statuses[p.Name].Services, svc.Name)
+		}
+		_, cs := resolvePolicies(svc.Name, targeting)
+		for _, c := range cs {
+			conflicts[c.Loser] = append(conflicts[c.Loser], fmt.Sprintf(
+				"'%s' of Service '%s' is overridden by policy '%s'",
+				c.Annotation, c.Service, c.Winner,
+			))
+		}
+	}
+
+	for i := range policies {
+		p := &policies[i]
+		status := statuses[p.Name]
+		if !meta.IsStatusConditionTrue(status.Conditions, v1alpha1.PolicyConditionAccepted) {
+			continue
+		}
+		sort.Strings(status.Services)
+
+		cond := metav1.Condition{
+			Type:               v1alpha1.PolicyConditionConflicted,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: p.Generation,
+			Reason:             "NoConflicts",
+			Message:            "No settings are overridden by other policies",
+		}
+		if msgs := conflicts[p.Name]; len(msgs) > 0 {
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = "Conflicted"
+			cond.Message = strings.Join(msgs, "; ")
+		}
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}
+
+	return statuses
+}
+
+// policyAnnotations returns the settings of all the policies targeting svc as
+// annotations.
+func (c *Controller) policyAnnotations(ctx context.Context, svc *corev1.Service) (map[string]string, error) {
+	if !c.config.EnableMeshPolicy {
+		return nil, nil
+	}
+	policies := &v1alpha1.MeshPolicyList{}
+	if err := c.client.List(ctx, policies, client.InNamespace(svc.Namespace)); err != nil {
+		return nil, err
+	}
+	annotations, _ := resolvePolicies(svc.Name, targetingPolicies(svc, policies.Items))
+	return annotations, nil
+}
+
+// ReconcilePolicies updates the status of all the MeshPolicies in the namespace
+// of req, regardless of its name, since a change of any policy or Service may
+// affect the conflicts between the policies.
+func (c *Controller) ReconcilePolicies(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	c.logger.Info("Reconciling policies", "namespace", req.Namespace)
+
+	policies := &v1alpha1.MeshPolicyList{}
+	if err := c.client.List(ctx, policies, client.InNamespace(req.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	if len(policies.Items) == 0 {
+		return reconcile.Result{}, nil
+	}
+
+	services := &corev1.ServiceList{}
+	if err := c.client.List(ctx, services, client.InNamespace(req.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	var eligible []corev1.Service
+	for _, svc := range services.Items {
+		if c.isEligible(&svc) {
+			eligible = append(eligible, svc)
+		}
+	}
+
+	statuses := policyStatuses(eligible, policies.Items)
+	for i := range policies.Items {
+		p := &policies.Items[i]
+		status := statuses[p.Name]
+		if equality.Semantic.DeepEqual(&p.Status, status) {
+			continue
+		}
+		p.Status = *status
+		if err := c.client.Status().Update(ctx, p); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// mapPolicy maps a MeshPolicy to the eligible Services in its namespace, which
+// might have been targeted by the policy, before or after the change.
+func (c *Controller) mapPolicy(obj client.Object) []reconcile.Request {
+	return c.eligibleServices(client.InNamespace(obj.GetNamespace()))
+}
+
+// mapNamespaceRequest maps an object to a request for its namespace, which is
+// reconciled as a whole (e.g. all the MeshPolicies in the namespace).
+func mapNamespaceRequest(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace()}}}
+}
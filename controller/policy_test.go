@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/RussellLuo/caddy-mesh/api/v1alpha1"
+)
+
+func newPolicy(name string, age time.Duration, spec v1alpha1.MeshPolicySpec) v1alpha1.MeshPolicy {
+	return v1alpha1.MeshPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "test",
+			CreationTimestamp: metav1.NewTime(time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC).Add(-age)),
+		},
+		Spec: spec,
+	}
+}
+
+func newService(name string, labels map[string]string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "test",
+			Labels:    labels,
+		},
+	}
+}
+
+func TestPolicySettings(t *testing.T) {
+	spec := &v1alpha1.MeshPolicySpec{
+		Timeout: &v1alpha1.TimeoutPolicy{
+			DialTimeout: &metav1.Duration{Duration: 5 * time.Second},
+		},
+		Retry: &v1alpha1.RetryPolicy{
+			Count: 2,
+			On:    "{http.request.method} == 'GET'",
+		},
+		RateLimit: &v1alpha1.RateLimitPolicy{
+			Key:  "{remote_host}",
+			Rate: "10r/s",
+		},
+		CircuitBreaker: &v1alpha1.CircuitBreakerPolicy{
+			MaxFails:         3,
+			UnhealthyStatus:  []int32{5, 429},
+			UnhealthyLatency: &metav1.Duration{Duration: time.Second},
+		},
+	}
+
+	got := policySettings(spec)
+	want := map[string]string{
+		"mesh.caddyserver.com/timeout-dial-timeout":              "5s",
+		"mesh.caddyserver.com/retry-count":                       "2",
+		"mesh.caddyserver.com/retry-on":                          "{http.request.method} == 'GET'",
+		"mesh.caddyserver.com/rate-limit-key":                    "{remote_host}",
+		"mesh.caddyserver.com/rate-limit-rate":                   "10r/s",
+		"mesh.caddyserver.com/circuit-breaker-max-fails":         "3",
+		"mesh.caddyserver.com/circuit-breaker-unhealthy-status":  "5,429",
+		"mesh.caddyserver.com/circuit-breaker-unhealthy-latency": "1s",
+	}
+	if !cmp.Equal(got, want) {
+		diff := cmp.Diff(got, want)
+		t.Errorf("Want - Got: %s", diff)
+	}
+
+	if _, err := NewDefinitions(got); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    v1alpha1.MeshPolicySpec
+		wantErr string
+	}{
+		{
+			name: "target ref",
+			spec: v1alpha1.MeshPolicySpec{
+				TargetRef: &v1alpha1.PolicyTargetReference{Kind: "Service", Name: "server"},
+			},
+		},
+		{
+			name: "selector",
+			spec: v1alpha1.MeshPolicySpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+			},
+		},
+		{
+			name:    "no target",
+			spec:    v1alpha1.MeshPolicySpec{},
+			wantErr: "either targetRef or selector must be specified",
+		},
+		{
+			name: "both targets",
+			spec: v1alpha1.MeshPolicySpec{
+				TargetRef: &v1alpha1.PolicyTargetReference{Kind: "Service", Name: "server"},
+				Selector:  &metav1.LabelSelector{},
+			},
+			wantErr: "targetRef and selector are mutually exclusive",
+		},
+		{
+			name: "unsupported kind",
+			spec: v1alpha1.MeshPolicySpec{
+				TargetRef: &v1alpha1.PolicyTargetReference{Group: "apps", Kind: "Deployment", Name: "server"},
+			},
+			wantErr: `unsupported targetRef kind "Deployment" in group "apps", only Services are supported`,
+		},
+		{
+			name: "invalid expression",
+			spec: v1alpha1.MeshPolicySpec{
+				TargetRef: &v1alpha1.PolicyTargetReference{Kind: "Service", Name: "server"},
+				Retry:     &v1alpha1.RetryPolicy{On: "1 + 1"},
+			},
+			wantErr: "invalid expression in 'mesh.caddyserver.com/retry-on': 1:1: expected return type of bool, not int",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPolicy("policy", 0, tt.spec)
+			err := validatePolicy(&p)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Err: Got (%q) != Want (%q)", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolvePolicies(t *testing.T) {
+	byName := newPolicy("by-name", 0, v1alpha1.MeshPolicySpec{
+		TargetRef: &v1alpha1.PolicyTargetReference{Kind: "Service", Name: "server"},
+		Retry:     &v1alpha1.RetryPolicy{Count: 3},
+	})
+	older := newPolicy("older", time.Hour, v1alpha1.MeshPolicySpec{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+		Retry:    &v1alpha1.RetryPolicy{Count: 2},
+		Timeout:  &v1alpha1.TimeoutPolicy{DialTimeout: &metav1.Duration{Duration: time.Second}},
+	})
+	newer := newPolicy("newer", 0, v1alpha1.MeshPolicySpec{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+		Timeout: &v1alpha1.TimeoutPolicy{
+			DialTimeout: &metav1.Duration{Duration: 2 * time.Second},
+			ReadTimeout: &metav1.Duration{Duration: 10 * time.Second},
+		},
+	})
+
+	got, gotConflicts := resolvePolicies("server", []*v1alpha1.MeshPolicy{&newer, &older, &byName})
+
+	want := map[string]string{
+		"mesh.caddyserver.com/retry-count":          "3",
+		"mesh.caddyserver.com/timeout-dial-timeout": "1s",
+		"mesh.caddyserver.com/timeout-read-timeout": "10s",
+	}
+	if !cmp.Equal(got, want) {
+		diff := cmp.Diff(got, want)
+		t.Errorf("Want - Got: %s", diff)
+	}
+
+	wantConflicts := []policyConflict{
+		{Service: "server", Annotation: "mesh.caddyserver.com/retry-count", Winner: "by-name", Loser: "older"},
+		{Service: "server", Annotation: "mesh.caddyserver.com/timeout-dial-timeout", Winner: "older", Loser: "newer"},
+	}
+	if !cmp.Equal(gotConflicts, wantConflicts) {
+		diff := cmp.Diff(gotConflicts, wantConflicts)
+		t.Errorf("Want - Got: %s", diff)
+	}
+}
+
+func TestPolicyStatuses(t *testing.T) {
+	services := []corev1.Service{
+		newService("server", map[string]string{"tier": "backend"}),
+		newService("worker", map[string]string{"tier": "backend"}),
+		newService("web", map[string]string{"tier": "frontend"}),
+	}
+	policies := []v1alpha1.MeshPolicy{
+		newPolicy("backend", time.Hour, v1alpha1.MeshPolicySpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+			Retry:    &v1alpha1.RetryPolicy{Count: 2},
+		}),
+		newPolicy("server", 0, v1alpha1.MeshPolicySpec{
+			TargetRef: &v1alpha1.PolicyTargetReference{Kind: "Service", Name: "server"},
+			Retry:     &v1alpha1.RetryPolicy{Count: 3},
+		}),
+		newPolicy("invalid", 0, v1alpha1.MeshPolicySpec{}),
+	}
+
+	statuses := policyStatuses(services, policies)
+
+	type condition struct {
+		Status  metav1.ConditionStatus
+		Message string
+	}
+	tests := []struct {
+		policy         string
+		wantServices   []string
+		wantAccepted   condition
+		wantConflicted *condition
+	}{
+		{
+			policy:       "backend",
+			wantServices: []string{"server", "worker"},
+			wantAccepted: condition{Status: metav1.ConditionTrue, Message: "Policy is valid"},
+			wantConflicted: &condition{
+				Status:  metav1.ConditionTrue,
+				Message: "'mesh.caddyserver.com/retry-count' of Service 'server' is overridden by policy 'server'",
+			},
+		},
+		{
+			policy:         "server",
+			wantServices:   []string{"server"},
+			wantAccepted:   condition{Status: metav1.ConditionTrue, Message: "Policy is valid"},
+			wantConflicted: &condition{Status: metav1.ConditionFalse, Message: "No settings are overridden by other policies"},
+		},
+		{
+			policy:       "invalid",
+			wantAccepted: condition{Status: metav1.ConditionFalse, Message: "either targetRef or selector must be specified"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			status := statuses[tt.policy]
+			if !cmp.Equal(status.Services, tt.wantServices) {
+				diff := cmp.Diff(status.Services, tt.wantServices)
+				t.Errorf("Services: Want - Got: %s", diff)
+			}
+
+			accepted := meta.FindStatusCondition(status.Conditions, v1alpha1.PolicyConditionAccepted)
+			if got := (condition{Status: accepted.Status, Message: accepted.Message}); got != tt.wantAccepted {
+				t.Errorf("Accepted: Got (%+v) != Want (%+v)", got, tt.wantAccepted)
+			}
+
+			conflicted := meta.FindStatusCondition(status.Conditions, v1alpha1.PolicyConditionConflicted)
+			var got *condition
+			if conflicted != nil {
+				got = &condition{Status: conflicted.Status, Message: conflicted.Message}
+			}
+			if !cmp.Equal(got, tt.wantConflicted) {
+				diff := cmp.Diff(got, tt.wantConflicted)
+				t.Errorf("Conflicted: Want - Got: %s", diff)
+			}
+		})
+	}
+}
@@ -32,6 +32,30 @@ func IgnoreLabel(key, value string) predicate.Funcs {
 	})
 }
 
+func OnlyNamespace(namespace string) predicate.Funcs {
+	return predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == namespace
+	})
+}
+
+func OnlyName(name string) predicate.Funcs {
+	return predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetName() == name
+	})
+}
+
+func OnlyLabels(labels map[string]string) predicate.Funcs {
+	return predicate.NewPredicateFuncs(func(object client.Object) bool {
+		objLabels := object.GetLabels()
+		for k, v := range labels {
+			if objLabels[k] != v {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 type Set struct {
 	m map[string]struct{}
 }
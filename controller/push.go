@@ -0,0 +1,485 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCoalesceWindow is the default coalescing window of the controller.
+const DefaultCoalesceWindow = time.Second
+
+const (
+	defaultPushConcurrency = 8
+
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// errSuperseded indicates that a push has been dropped, since a newer snapshot
+// has been created in the meantime.
+var errSuperseded = errors.New("superseded by a newer snapshot")
+
+// PushOptions controls how the configuration is pushed to the Caddy instances.
+type PushOptions struct {
+	// Concurrency is the maximum number of Caddy instances to which the
+	// configuration is pushed in parallel. Default: 8.
+	Concurrency int
+
+	// CoalesceWindow is how long to wait for further changes after a change,
+	// so that a burst of changes collapses into one rebuild and push (see
+	// DefaultCoalesceWindow). Zero disables coalescing, in which case every
+	// change rebuilds the whole configuration immediately, which is mainly
+	// meant for testing.
+	CoalesceWindow time.Duration
+	// CoalesceMaxDelay is the maximum time that a change can be delayed by
+	// the coalescing window. Default: CoalesceWindow.
+	CoalesceMaxDelay time.Duration
+
+	// Recorder, if not nil, is notified of the outcomes of the changes made
+	// to the services.
+	Recorder Recorder
+}
+
+func (o *PushOptions) withDefaults() *PushOptions {
+	opts := new(PushOptions)
+	if o != nil {
+		*opts = *o
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultPushConcurrency
+	}
+	if opts.CoalesceMaxDelay < opts.CoalesceWindow {
+		opts.CoalesceMaxDelay = opts.CoalesceWindow
+	}
+	return opts
+}
+
+// Snapshot is an immutable and versioned Caddy configuration.
+type Snapshot struct {
+	Generation uint64
+	Data       []byte
+
+	// index is used for updating the Caddy instances incrementally, which
+	// is nil if the configuration can only be loaded as a whole.
+	index *snapshotIndex
+}
+
+// Proxy is a Caddy instance.
+type Proxy struct {
+	IP string
+	// Incarnation identifies a specific run of the Caddy instance, which
+	// changes whenever the instance restarts.
+	Incarnation string
+}
+
+// ProxyStatus is the sync status of a Caddy instance.
+type ProxyStatus struct {
+	IP string
+	// Generation is the generation of the configuration held by the Caddy instance.
+	Generation uint64
+	InSync     bool
+	// LastError is the error of the last failed push, if any.
+	LastError error
+}
+
+type proxyState struct {
+	incarnation string
+	// generation is the generation of the configuration held by the proxy,
+	// where zero means the proxy holds no configuration yet.
+	generation uint64
+	// applied is the snapshot held by the proxy, which is nil if unknown.
+	applied *Snapshot
+
+	lastErr  error
+	failures int
+	retryAt  time.Time
+}
+
+func (s *proxyState) fail(err error, now time.Time) {
+	// The configuration might have been partially updated.
+	s.applied = nil
+	s.lastErr = err
+	s.failures++
+
+	backoff := maxRetryBackoff
+	if s.failures < 16 {
+		backoff = minRetryBackoff << (s.failures - 1)
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	s.retryAt = now.Add(backoff)
+}
+
+func (s *proxyState) succeed(snapshot *Snapshot) {
+	s.generation = snapshot.Generation
+	s.applied = snapshot
+	s.lastErr = nil
+	s.failures = 0
+	s.retryAt = time.Time{}
+}
+
+// PushResult is the result of pushing a snapshot to the Caddy instances.
+type PushResult struct {
+	// Generation is the generation of the pushed snapshot.
+	Generation uint64
+	// Synced is the number of the Caddy instances that hold the snapshot.
+	Synced int
+	// Total is the number of all the Caddy instances.
+	Total int
+	// Errors are the errors occurred in this round.
+	Errors []error
+	// RetryAfter is the duration after which the Caddy instances that have
+	// failed should be retried. Zero means no retry is needed.
+	RetryAfter time.Duration
+}
+
+func (r *PushResult) retryAt(after time.Duration) {
+	if r.RetryAfter == 0 || after < r.RetryAfter {
+		r.RetryAfter = after
+	}
+}
+
+// SetProxies sets the Caddy instances to which the configuration will be pushed.
+// A proxy that is new, or has been restarted since the last call, is considered
+// to hold no configuration.
+func (c *CaddyConfigurator) SetProxies(proxies []Proxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states := make(map[string]*proxyState, len(proxies))
+	for _, p := range proxies {
+		state, ok := c.proxies[p.IP]
+		if !ok || state.incarnation != p.Incarnation {
+			state = &proxyState{incarnation: p.Incarnation}
+		}
+		states[p.IP] = state
+	}
+	c.proxies = states
+	c.notify()
+}
+
+// Statuses returns the sync statuses of all the Caddy instances.
+func (c *CaddyConfigurator) Statuses() []ProxyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var statuses []ProxyStatus
+	for _, ip := range sortedKeys(c.proxies) {
+		state := c.proxies[ip]
+		statuses = append(statuses, ProxyStatus{
+			IP:         ip,
+			Generation: state.generation,
+			InSync:     state.generation == c.generation,
+			LastError:  state.lastErr,
+		})
+	}
+	return statuses
+}
+
+// Run runs the push worker, which rebuilds the snapshot once the pending changes
+// have settled, pushes the newest snapshot to the Caddy instances whenever the
+// snapshot or the instances have changed, and retries the failed instances after
+// their backoff, until ctx is done.
+func (c *CaddyConfigurator) Run(ctx context.Context) error {
+	wakeup := time.NewTimer(0)
+	defer wakeup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.notifyC:
+		case <-wakeup.C:
+		}
+
+		// Pending changes not due yet will be committed on a later wakeup.
+		wakeAfter := c.commitIfDue()
+
+		result := c.Push(ctx)
+		if result.Total > 0 {
+			c.logger.Info(fmt.Sprintf("%d/%d Caddy instances haven been synchronized successfully", result.Synced, result.Total), "generation", result.Generation)
+		}
+		for _, err := range result.Errors {
+			c.logger.Error(err, "could not synchronize Caddy instance", "generation", result.Generation)
+		}
+		c.report(result)
+
+		if result.RetryAfter > 0 && (wakeAfter == 0 || result.RetryAfter < wakeAfter) {
+			wakeAfter = result.RetryAfter
+		}
+
+		if !wakeup.Stop() {
+			select {
+			case <-wakeup.C:
+			default:
+			}
+		}
+		if wakeAfter > 0 {
+			wakeup.Reset(wakeAfter)
+		}
+	}
+}
+
+// report notifies the recorder of the outcomes of the services changed in, or
+// before, the generation that has been pushed.
+func (c *CaddyConfigurator) report(result PushResult) {
+	if c.options.Recorder == nil || result.Generation == 0 || result.Total == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	quarantined := make(map[Key]bool)
+	for id := range c.quarantined {
+		_, key, _, _ := parseRouteID(id)
+		quarantined[key] = true
+	}
+	var applied, failed []Key
+	for key, generation := range c.changedAt {
+		switch {
+		case generation > result.Generation:
+		case quarantined[key]:
+			// The changes have not been applied, which has been reported.
+			delete(c.changedAt, key)
+		case result.Synced == result.Total:
+			applied = append(applied, key)
+			delete(c.changedAt, key)
+			delete(c.failedAt, key)
+		case len(result.Errors) > 0 && c.failedAt[key] != result.Generation:
+			failed = append(failed, key)
+			c.failedAt[key] = result.Generation
+		}
+	}
+	c.mu.Unlock()
+
+	sortSlice(applied)
+	for _, key := range applied {
+		c.options.Recorder.Applied(key, result.Generation, result.Total)
+	}
+	sortSlice(failed)
+	for _, key := range failed {
+		c.options.Recorder.PushFailed(key, result.Generation, result.Total-result.Synced, result.Total)
+	}
+}
+
+// commitIfDue commits the pending changes if the coalescing window has passed
+// since the last change, or the maximum delay has passed since the first change.
+// Otherwise, it returns how long to wait until the changes will be due.
+func (c *CaddyConfigurator) commitIfDue() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == 0 {
+		return 0
+	}
+
+	due := c.lastChangeAt.Add(c.options.CoalesceWindow)
+	if deadline := c.firstChangeAt.Add(c.options.CoalesceMaxDelay); deadline.Before(due) {
+		due = deadline
+	}
+	if now := c.now(); now.Before(due) {
+		return due.Sub(now)
+	}
+
+	c.commit()
+	return 0
+}
+
+// Push pushes the newest snapshot, in parallel, to all the Caddy instances that
+// do not hold it yet. A failure on one Caddy instance does not prevent the others
+// from being tried, and a failed Caddy instance will not be retried until its
+// backoff has expired.
+func (c *CaddyConfigurator) Push(ctx context.Context) (result PushResult) {
+	type target struct {
+		ip    string
+		state *proxyState
+		from  *Snapshot
+		err   error
+	}
+
+	c.mu.Lock()
+	snapshot := c.snapshot
+	now := c.now()
+	result.Total = len(c.proxies)
+	var targets []*target
+	for _, ip := range sortedKeys(c.proxies) {
+		state := c.proxies[ip]
+		switch {
+		case snapshot == nil || state.generation == snapshot.Generation:
+			result.Synced++
+		case now.Before(state.retryAt):
+			// Still in backoff.
+			result.retryAt(state.retryAt.Sub(now))
+		default:
+			targets = append(targets, &target{ip: ip, state: state, from: state.applied})
+		}
+	}
+	c.mu.Unlock()
+
+	if snapshot == nil {
+		return result
+	}
+	result.Generation = snapshot.Generation
+
+	sem := make(chan struct{}, c.options.Concurrency)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if c.superseded(snapshot) {
+				// Drop the intermediate snapshot, the newest one will
+				// be pushed in the next round.
+				t.err = errSuperseded
+				return
+			}
+			t.err = c.apply(ctx, t.ip, t.from, snapshot)
+		}(t)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now = c.now()
+	var rejectedBy string
+	for _, t := range targets {
+		if c.proxies[t.ip] != t.state {
+			continue // The proxy has been removed or restarted in the meantime.
+		}
+		switch {
+		case t.err == errSuperseded:
+		case t.err != nil:
+			t.state.fail(t.err, now)
+			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", t.ip, t.err))
+			result.retryAt(t.state.retryAt.Sub(now))
+			if isRejected(t.err) && rejectedBy == "" {
+				rejectedBy = t.ip
+			}
+		default:
+			t.state.succeed(snapshot)
+			result.Synced++
+			if c.good == nil || c.good.Generation < snapshot.Generation {
+				c.good = snapshot
+			}
+		}
+	}
+
+	if rejectedBy == "" || c.snapshot != snapshot || c.isolated == snapshot {
+		return result
+	}
+	c.isolated = snapshot
+
+	// Quarantine the rejected routes, so that they won't prevent the others
+	// from converging.
+	c.mu.Unlock()
+	err := c.isolate(ctx, rejectedBy, snapshot)
+	c.mu.Lock()
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Errorf("could not isolate rejected routes: %w", err))
+	}
+
+	return result
+}
+
+func (c *CaddyConfigurator) superseded(snapshot *Snapshot) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot != snapshot
+}
+
+// notify wakes up the push worker, if it's not awake yet.
+func (c *CaddyConfigurator) notify() {
+	select {
+	case c.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+// apply applies the snapshot to to the Caddy instance at ip, which holds the
+// snapshot from. Only the changed routes are updated if possible, otherwise,
+// or if the update has failed, the whole configuration will be loaded.
+func (c *CaddyConfigurator) apply(ctx context.Context, ip string, from, to *Snapshot) error {
+	if ops, ok := patches(from, to); ok {
+		err := c.patch(ctx, ip, ops)
+		if err == nil {
+			pushesTotal.WithLabelValues("incremental").Inc()
+			return nil
+		}
+		c.logger.Error(err, "could not update Caddy instance incrementally, falling back to loading", "ip", ip, "generation", to.Generation)
+	}
+
+	if err := c.request(ctx, ip, http.MethodPost, "/load", to.Data); err != nil {
+		return err
+	}
+	pushesTotal.WithLabelValues("full").Inc()
+	return nil
+}
+
+// patches returns the requests that update the Caddy instance holding the
+// snapshot from to the snapshot to. It will return ok=false if it's better
+// to load the whole configuration.
+func patches(from, to *Snapshot) (ops []patchOp, ok bool) {
+	if from == nil || from.index == nil || to.index == nil {
+		return nil, false
+	}
+	ops, ok = diff(from.index, to.index)
+	if !ok || patchSize(ops) >= len(to.Data) {
+		return nil, false
+	}
+	return ops, true
+}
+
+func (c *CaddyConfigurator) patch(ctx context.Context, ip string, ops []patchOp) error {
+	for _, op := range ops {
+		if err := c.request(ctx, ip, op.Method, op.Path, op.Data); err != nil {
+			return fmt.Errorf("%s %s: %w", op.Method, op.Path, err)
+		}
+	}
+	return nil
+}
+
+func (c *CaddyConfigurator) request(ctx context.Context, ip, method, path string, data []byte) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.makeURL(ip, path), body)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errMsg struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errMsg); err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusBadRequest {
+			return &rejectedError{msg: errMsg.Error}
+		}
+		return errors.New(errMsg.Error)
+	}
+
+	return nil
+}
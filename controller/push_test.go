@@ -0,0 +1,477 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testProxies starts a fake Caddy instance for each of the given IPs, and
+// returns a function for building the URLs of them.
+func testProxies(t *testing.T, handler func(ip string, w http.ResponseWriter, r *http.Request), ips ...string) func(ip, path string) string {
+	addrs := make(map[string]string)
+	for _, ip := range ips {
+		ip := ip
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(ip, w, r)
+		}))
+		t.Cleanup(srv.Close)
+		addrs[ip] = srv.URL
+	}
+	return func(ip, path string) string {
+		return addrs[ip] + path
+	}
+}
+
+func TestCaddyConfigurator_Push(t *testing.T) {
+	var mu sync.Mutex
+	pushes := make(map[string]int)
+	c := NewCaddyConfigurator(testLogger, testGetter, nil)
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		pushes[ip]++
+	}, "proxy-1", "proxy-2")
+
+	apply := func(wantN int, wantPushes map[string]int) {
+		t.Helper()
+		result := c.Push(context.Background())
+		if result.Synced != wantN {
+			t.Errorf("Synced: Got (%d) != Want (%d)", result.Synced, wantN)
+		}
+		if !cmp.Equal(pushes, wantPushes) {
+			diff := cmp.Diff(pushes, wantPushes)
+			t.Errorf("Want - Got: %s", diff)
+		}
+	}
+
+	c.Upsert(&Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+	})
+
+	// Push to all the new proxies.
+	c.SetProxies([]Proxy{{IP: "proxy-1", Incarnation: "a"}, {IP: "proxy-2", Incarnation: "a"}})
+	apply(2, map[string]int{"proxy-1": 1, "proxy-2": 1})
+
+	// All proxies are in-sync.
+	apply(2, map[string]int{"proxy-1": 1, "proxy-2": 1})
+
+	// Only push to the restarted proxy.
+	c.SetProxies([]Proxy{{IP: "proxy-1", Incarnation: "a"}, {IP: "proxy-2", Incarnation: "b"}})
+	apply(2, map[string]int{"proxy-1": 1, "proxy-2": 2})
+
+	// Push to all proxies once the configuration has changed.
+	c.Delete(&Service{Key: Key{Name: "service-1", Namespace: "test"}})
+	apply(2, map[string]int{"proxy-1": 2, "proxy-2": 3})
+
+	// Only push to the proxy that has become ready again.
+	c.SetProxies([]Proxy{{IP: "proxy-1", Incarnation: "a"}})
+	apply(1, map[string]int{"proxy-1": 2, "proxy-2": 3})
+	c.SetProxies([]Proxy{{IP: "proxy-1", Incarnation: "a"}, {IP: "proxy-2", Incarnation: "b"}})
+	apply(2, map[string]int{"proxy-1": 2, "proxy-2": 4})
+}
+
+func TestCaddyConfigurator_Push_Retry(t *testing.T) {
+	var mu sync.Mutex
+	pushes := make(map[string]int)
+	failing := map[string]bool{"proxy-2": true}
+	c := NewCaddyConfigurator(testLogger, testGetter, nil)
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		pushes[ip]++
+		if failing[ip] {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"oops"}`))
+		}
+	}, "proxy-1", "proxy-2", "proxy-3")
+
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.Upsert(&Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+	})
+	c.SetProxies([]Proxy{{IP: "proxy-1"}, {IP: "proxy-2"}, {IP: "proxy-3"}})
+
+	tests := []struct {
+		name           string
+		elapsed        time.Duration
+		recover        bool
+		wantSynced     int
+		wantErrors     int
+		wantRetryAfter time.Duration
+		wantPushes     map[string]int
+	}{
+		{
+			name:           "continue on error",
+			wantSynced:     2,
+			wantErrors:     1,
+			wantRetryAfter: time.Second,
+			wantPushes:     map[string]int{"proxy-1": 1, "proxy-2": 1, "proxy-3": 1},
+		},
+		{
+			name:           "still in backoff",
+			elapsed:        500 * time.Millisecond,
+			wantSynced:     2,
+			wantRetryAfter: 500 * time.Millisecond,
+			wantPushes:     map[string]int{"proxy-1": 1, "proxy-2": 1, "proxy-3": 1},
+		},
+		{
+			name:           "retry failed proxy only",
+			elapsed:        500 * time.Millisecond,
+			wantSynced:     2,
+			wantErrors:     1,
+			wantRetryAfter: 2 * time.Second,
+			wantPushes:     map[string]int{"proxy-1": 1, "proxy-2": 2, "proxy-3": 1},
+		},
+		{
+			name:       "converged",
+			elapsed:    2 * time.Second,
+			recover:    true,
+			wantSynced: 3,
+			wantPushes: map[string]int{"proxy-1": 1, "proxy-2": 3, "proxy-3": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.elapsed)
+			if tt.recover {
+				mu.Lock()
+				failing = nil
+				mu.Unlock()
+			}
+
+			result := c.Push(context.Background())
+			if result.Synced != tt.wantSynced {
+				t.Errorf("Synced: Got (%d) != Want (%d)", result.Synced, tt.wantSynced)
+			}
+			if len(result.Errors) != tt.wantErrors {
+				t.Errorf("Errors: Got (%v) != Want (%d)", result.Errors, tt.wantErrors)
+			}
+			if result.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("RetryAfter: Got (%v) != Want (%v)", result.RetryAfter, tt.wantRetryAfter)
+			}
+			if !cmp.Equal(pushes, tt.wantPushes) {
+				diff := cmp.Diff(pushes, tt.wantPushes)
+				t.Errorf("Want - Got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCaddyConfigurator_Report(t *testing.T) {
+	var mu sync.Mutex
+	failing := map[string]bool{"proxy-2": true}
+	recorder := new(testRecorder)
+	c := NewCaddyConfigurator(testLogger, testGetter, &PushOptions{Recorder: recorder})
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing[ip] {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"oops"}`))
+		}
+	}, "proxy-1", "proxy-2")
+
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	upsert := func(name, ip string) {
+		c.Upsert(&Service{
+			Key:   Key{Name: name, Namespace: "test"},
+			Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: ip, Port: 80}}}},
+		})
+	}
+	push := func(wantApplied, wantFailed []string) {
+		t.Helper()
+		recorder.applied, recorder.failed = nil, nil
+		c.report(c.Push(context.Background()))
+		if !cmp.Equal(recorder.applied, wantApplied) {
+			diff := cmp.Diff(recorder.applied, wantApplied)
+			t.Errorf("Applied: Want - Got: %s", diff)
+		}
+		if !cmp.Equal(recorder.failed, wantFailed) {
+			diff := cmp.Diff(recorder.failed, wantFailed)
+			t.Errorf("Failed: Want - Got: %s", diff)
+		}
+	}
+
+	upsert("service-1", "127.0.0.1")
+	upsert("service-2", "127.0.0.2")
+	c.SetProxies([]Proxy{{IP: "proxy-1"}, {IP: "proxy-2"}})
+
+	// A failure is reported once per generation.
+	push(nil, []string{"service-1@2 1/2", "service-2@2 1/2"})
+	now = now.Add(time.Second)
+	push(nil, nil)
+
+	// A service deleted in the meantime is not reported.
+	c.Delete(&Service{Key: Key{Name: "service-2", Namespace: "test"}})
+	now = now.Add(2 * time.Second)
+	push(nil, []string{"service-1@3 1/2"})
+
+	// Report the services once all proxies hold the configuration.
+	failing["proxy-2"] = false
+	now = now.Add(time.Minute)
+	push([]string{"service-1@3 2"}, nil)
+
+	// Only report the services that have been changed.
+	upsert("service-3", "127.0.0.3")
+	push([]string{"service-3@4 2"}, nil)
+	push(nil, nil)
+
+	// Nor are the changes of the endpoints alone.
+	upsert("service-3", "127.0.0.4")
+	push(nil, nil)
+}
+
+func TestCaddyConfigurator_Push_Incremental(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	rejectPatch := false
+	c := NewCaddyConfigurator(testLogger, testGetter, nil)
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if rejectPatch && r.Method == http.MethodPatch {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"unknown object ID"}`))
+		}
+	}, "proxy-1")
+
+	upsert := func(name string, port Port, ip string) {
+		c.Upsert(&Service{
+			Key:   Key{Name: name, Namespace: "test"},
+			Ports: []ServicePort{{Port: port, Upstreams: []Upstream{{IP: ip, Port: 80}}}},
+		})
+	}
+	apply := func(wantRequests ...string) {
+		t.Helper()
+		requests = nil
+		result := c.Push(context.Background())
+		if result.Synced != 1 {
+			t.Errorf("Synced: Got (%d) != Want (1)", result.Synced)
+		}
+		if !cmp.Equal(requests, wantRequests) {
+			diff := cmp.Diff(requests, wantRequests)
+			t.Errorf("Want - Got: %s", diff)
+		}
+	}
+
+	// Load the whole configuration into the new proxy.
+	upsert("service-1", 80, "127.0.0.1")
+	c.SetProxies([]Proxy{{IP: "proxy-1"}})
+	apply("POST /load")
+
+	// Update the changed upstreams only.
+	upsert("service-1", 80, "127.0.0.2")
+	apply("PATCH /id/service.test.service-1.80.proxy/upstreams")
+
+	// Fall back to loading once the structure has changed.
+	upsert("service-2", 8080, "127.0.0.3")
+	apply("POST /load")
+
+	// Fall back to loading if the update has failed.
+	rejectPatch = true
+	upsert("service-1", 80, "127.0.0.4")
+	apply("PATCH /id/service.test.service-1.80.proxy/upstreams", "POST /load")
+}
+
+func TestCaddyConfigurator_Coalesce(t *testing.T) {
+	c := NewCaddyConfigurator(testLogger, testGetter, &PushOptions{
+		CoalesceWindow:   time.Second,
+		CoalesceMaxDelay: 3 * time.Second,
+	})
+
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	upsert := func(name string) {
+		c.Upsert(&Service{
+			Key:   Key{Name: name, Namespace: "test"},
+			Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+		})
+	}
+
+	tests := []struct {
+		name           string
+		elapsed        time.Duration
+		upsert         string
+		wantWait       time.Duration
+		wantGeneration uint64
+	}{
+		{
+			name:     "first change",
+			upsert:   "service-1",
+			wantWait: time.Second,
+		},
+		{
+			name:     "window extended by another change",
+			elapsed:  800 * time.Millisecond,
+			upsert:   "service-2",
+			wantWait: time.Second,
+		},
+		{
+			name:           "window passed",
+			elapsed:        time.Second,
+			wantGeneration: 1,
+		},
+		{
+			name:           "nothing pending",
+			elapsed:        time.Second,
+			wantGeneration: 1,
+		},
+		{
+			name:           "another burst",
+			upsert:         "service-3",
+			wantWait:       time.Second,
+			wantGeneration: 1,
+		},
+		{
+			name:           "capped by max delay",
+			elapsed:        900 * time.Millisecond,
+			upsert:         "service-4",
+			wantWait:       time.Second,
+			wantGeneration: 1,
+		},
+		{
+			name:           "still capped by max delay",
+			elapsed:        900 * time.Millisecond,
+			upsert:         "service-5",
+			wantWait:       time.Second,
+			wantGeneration: 1,
+		},
+		{
+			name:           "max delay approaching",
+			elapsed:        900 * time.Millisecond,
+			upsert:         "service-6",
+			wantWait:       300 * time.Millisecond,
+			wantGeneration: 1,
+		},
+		{
+			name:           "max delay passed",
+			elapsed:        300 * time.Millisecond,
+			upsert:         "service-7",
+			wantGeneration: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.elapsed)
+			if tt.upsert != "" {
+				upsert(tt.upsert)
+			}
+
+			wait := c.commitIfDue()
+			if wait != tt.wantWait {
+				t.Errorf("Wait: Got (%s) != Want (%s)", wait, tt.wantWait)
+			}
+			if c.generation != tt.wantGeneration {
+				t.Errorf("Generation: Got (%d) != Want (%d)", c.generation, tt.wantGeneration)
+			}
+		})
+	}
+}
+
+func TestCaddyConfigurator_Push_Superseded(t *testing.T) {
+	var mu sync.Mutex
+	pushes := make(map[string]int)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := NewCaddyConfigurator(testLogger, testGetter, &PushOptions{Concurrency: 1})
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pushes[ip]++
+		first := ip == "proxy-1" && pushes[ip] == 1
+		mu.Unlock()
+
+		if first {
+			close(started)
+			<-release
+		}
+	}, "proxy-1", "proxy-2")
+
+	c.Upsert(&Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+	})
+	c.SetProxies([]Proxy{{IP: "proxy-1"}, {IP: "proxy-2"}})
+
+	resultC := make(chan PushResult)
+	go func() {
+		resultC <- c.Push(context.Background())
+	}()
+
+	// Create a newer snapshot while the first one is being pushed.
+	<-started
+	c.Upsert(&Service{
+		Key:   Key{Name: "service-2", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.3", Port: 80}}}},
+	})
+	close(release)
+
+	// The push of the intermediate snapshot to proxy-2 has been dropped.
+	result := <-resultC
+	if result.Synced != 1 || len(result.Errors) != 0 || result.RetryAfter != 0 {
+		t.Errorf("Got unexpected result: %+v", result)
+	}
+	if want := map[string]int{"proxy-1": 1}; !cmp.Equal(pushes, want) {
+		diff := cmp.Diff(pushes, want)
+		t.Errorf("Want - Got: %s", diff)
+	}
+
+	// The newest snapshot is pushed to all proxies.
+	result = c.Push(context.Background())
+	if result.Synced != 2 || result.Generation != 2 {
+		t.Errorf("Got unexpected result: %+v", result)
+	}
+	if want := map[string]int{"proxy-1": 2, "proxy-2": 1}; !cmp.Equal(pushes, want) {
+		diff := cmp.Diff(pushes, want)
+		t.Errorf("Want - Got: %s", diff)
+	}
+}
+
+func TestCaddyConfigurator_Run(t *testing.T) {
+	pushed := make(chan string, 10)
+	c := NewCaddyConfigurator(testLogger, testGetter, nil)
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		pushed <- ip
+	}, "proxy-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	c.SetProxies([]Proxy{{IP: "proxy-1"}})
+	c.Upsert(&Service{
+		Key:   Key{Name: "service-1", Namespace: "test"},
+		Ports: []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: "127.0.0.2", Port: 80}}}},
+	})
+
+	select {
+	case ip := <-pushed:
+		if ip != "proxy-1" {
+			t.Errorf("Got (%s) != Want (proxy-1)", ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the push")
+	}
+}
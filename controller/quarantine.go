@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Recorder records the noteworthy events about services.
+type Recorder interface {
+	// Applied is called when the configuration of generation, which contains
+	// the changes of the service identified by key, has been applied to all
+	// the Caddy instances.
+	Applied(key Key, generation uint64, proxies int)
+	// PushFailed is called when the configuration of generation, which contains
+	// the changes of the service identified by key, has not been applied to
+	// failed of the total Caddy instances.
+	PushFailed(key Key, generation uint64, failed, total int)
+	// Quarantined is called when the routes of the service identified by key
+	// have been quarantined, since they have been rejected by Caddy.
+	Quarantined(key Key, err error)
+}
+
+// rejectedError indicates that Caddy has rejected the configuration.
+type rejectedError struct {
+	msg string
+}
+
+func (e *rejectedError) Error() string {
+	return e.msg
+}
+
+func isRejected(err error) bool {
+	var rejected *rejectedError
+	return errors.As(err, &rejected)
+}
+
+// quarantinedRoute is a route rejected by Caddy, which will be replaced by its
+// last good version, or be removed if there's no such version.
+type quarantinedRoute struct {
+	// rest is the rejected route with the upstreams removed, since the route
+	// is most likely still rejected if only its upstreams have been changed.
+	rest []byte
+	good []byte
+}
+
+// applyQuarantines replaces every quarantined route in data, which is still the
+// same as the rejected one, with its last good version. The quarantine of the
+// routes that have been changed or removed is lifted. It must be called with
+// c.mu held.
+func (c *CaddyConfigurator) applyQuarantines(data []byte) ([]byte, *snapshotIndex, error) {
+	index, err := newSnapshotIndex(data)
+	if err != nil {
+		return data, nil, err
+	}
+
+	replacements := make(map[string][]byte)
+	for _, id := range sortedKeys(c.quarantined) {
+		q := c.quarantined[id]
+		route, ok := index.routes[id]
+		if !ok || !bytes.Equal(route.rest, q.rest) {
+			c.logger.Info("Lifting the quarantine of route", "id", id)
+			delete(c.quarantined, id)
+			continue
+		}
+		replacements[id] = q.good
+	}
+	if len(replacements) == 0 {
+		return data, index, nil
+	}
+
+	if data, err = replaceRoutes(data, replacements); err != nil {
+		return nil, nil, err
+	}
+	index, err = newSnapshotIndex(data)
+	return data, index, err
+}
+
+// isolate finds out the routes in snapshot that have been rejected by the Caddy
+// instance at ip, by bisecting the routes changed since the last good snapshot.
+// Each trial loads the last good configuration with a subset of the changed
+// routes, so the Caddy instance always holds a valid configuration. The routes
+// found are quarantined, and a new snapshot without them will be committed.
+func (c *CaddyConfigurator) isolate(ctx context.Context, ip string, snapshot *Snapshot) error {
+	if snapshot.index == nil {
+		return fmt.Errorf("could not isolate rejected routes from an unindexed snapshot")
+	}
+
+	c.mu.Lock()
+	good := c.good
+	c.mu.Unlock()
+
+	goodRoutes := make(map[string][]byte)
+	if good != nil && good.index != nil {
+		for id, r := range good.index.routes {
+			goodRoutes[id] = r.data
+		}
+	}
+
+	// Only the routes added or changed since the last good snapshot can be
+	// the culprits.
+	var candidates []string
+	for _, id := range sortedKeys(snapshot.index.routes) {
+		if !bytes.Equal(snapshot.index.routes[id].data, goodRoutes[id]) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	// try loads snapshot with all the candidates, except the included ones,
+	// reverted to their last good versions.
+	try := func(included []string) error {
+		in := make(map[string]bool, len(included))
+		for _, id := range included {
+			in[id] = true
+		}
+		replacements := make(map[string][]byte)
+		for _, id := range candidates {
+			if !in[id] {
+				replacements[id] = goodRoutes[id]
+			}
+		}
+
+		data, err := replaceRoutes(snapshot.Data, replacements)
+		if err != nil {
+			return err
+		}
+		return c.request(ctx, ip, http.MethodPost, "/load", data)
+	}
+
+	if err := try(nil); err != nil {
+		if isRejected(err) {
+			return fmt.Errorf("rejection not caused by any changed route: %w", err)
+		}
+		return err
+	}
+
+	var accepted, culprits []string
+	rejections := make(map[string]error)
+	var find func(ids []string) error
+	find = func(ids []string) error {
+		err := try(append(accepted[:len(accepted):len(accepted)], ids...))
+		switch {
+		case err == nil:
+			accepted = append(accepted, ids...)
+			return nil
+		case !isRejected(err):
+			return err
+		case len(ids) == 1:
+			culprits = append(culprits, ids[0])
+			rejections[ids[0]] = err
+			return nil
+		}
+
+		mid := len(ids) / 2
+		if err := find(ids[:mid]); err != nil {
+			return err
+		}
+		return find(ids[mid:])
+	}
+	if err := find(candidates); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	for _, id := range culprits {
+		c.quarantined[id] = &quarantinedRoute{
+			rest: snapshot.index.routes[id].rest,
+			good: goodRoutes[id],
+		}
+	}
+	if state, ok := c.proxies[ip]; ok {
+		// The Caddy instance holds the last trial configuration now.
+		state.applied = nil
+	}
+	for _, state := range c.proxies {
+		// Retry the rejected Caddy instances immediately.
+		state.retryAt = time.Time{}
+	}
+	c.commit()
+	c.mu.Unlock()
+
+	seen := make(map[Key]bool)
+	for _, id := range culprits {
+		_, key, _, _ := parseRouteID(id)
+		c.logger.Error(rejections[id], "Quarantined route rejected by Caddy", "id", id)
+		if seen[key] || c.options.Recorder == nil {
+			continue
+		}
+		seen[key] = true
+		c.options.Recorder.Quarantined(key, rejections[id])
+	}
+
+	return nil
+}
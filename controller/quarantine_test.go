@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testRecorder struct {
+	applied     []string
+	failed      []string
+	quarantined []Key
+}
+
+func (r *testRecorder) Applied(key Key, generation uint64, proxies int) {
+	r.applied = append(r.applied, fmt.Sprintf("%s@%d %d", key.Name, generation, proxies))
+}
+
+func (r *testRecorder) PushFailed(key Key, generation uint64, failed, total int) {
+	r.failed = append(r.failed, fmt.Sprintf("%s@%d %d/%d", key.Name, generation, failed, total))
+}
+
+func (r *testRecorder) Quarantined(key Key, err error) {
+	r.quarantined = append(r.quarantined, key)
+}
+
+func TestCaddyConfigurator_Quarantine(t *testing.T) {
+	var mu sync.Mutex
+	loads := 0
+	recorder := new(testRecorder)
+	c := NewCaddyConfigurator(testLogger, testGetter, &PushOptions{Recorder: recorder})
+	c.makeURL = testProxies(t, func(ip string, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte(`"bad"`)) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid expression"}`))
+			return
+		}
+		if r.URL.Path == "/load" {
+			loads++
+		}
+	}, "proxy-1", "proxy-2")
+
+	upsert := func(name, ip string, d *Definitions) {
+		c.Upsert(&Service{
+			Key:         Key{Name: name, Namespace: "test"},
+			Ports:       []ServicePort{{Port: 80, Upstreams: []Upstream{{IP: ip, Port: 80}}}},
+			Definitions: d,
+		})
+	}
+	push := func(wantSynced, wantErrors int) {
+		t.Helper()
+		result := c.Push(context.Background())
+		if result.Synced != wantSynced {
+			t.Errorf("Synced: Got (%d) != Want (%d)", result.Synced, wantSynced)
+		}
+		if len(result.Errors) != wantErrors {
+			t.Errorf("Errors: Got (%v) != Want (%d)", result.Errors, wantErrors)
+		}
+	}
+	contains := func(s string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return bytes.Contains(c.snapshot.Data, []byte(s))
+	}
+
+	upsert("service-1", "127.0.0.1", nil)
+	upsert("service-2", "127.0.0.2", &Definitions{RetryOn: "good"})
+	upsert("service-3", "127.0.0.3", nil)
+	c.SetProxies([]Proxy{{IP: "proxy-1"}, {IP: "proxy-2"}})
+	push(2, 0)
+
+	// A bad change is rejected, and then quarantined.
+	upsert("service-2", "127.0.0.2", &Definitions{RetryOn: "bad"})
+	upsert("service-3", "127.0.0.3", &Definitions{RetryCount: 2})
+	push(0, 2)
+	if want := []Key{{Name: "service-2", Namespace: "test"}}; !cmp.Equal(recorder.quarantined, want) {
+		t.Errorf("Quarantined: Got (%v) != Want (%v)", recorder.quarantined, want)
+	}
+
+	// The other changes can still converge, with the last good config kept
+	// for the quarantined service.
+	push(2, 0)
+	if contains(`"bad"`) || !contains(`"good"`) || !contains(`"retries":2`) {
+		t.Errorf("Unexpected config: %s", c.snapshot.Data)
+	}
+
+	// The quarantine is kept if only the upstreams have been changed.
+	loads = 0
+	upsert("service-2", "127.0.0.4", &Definitions{RetryOn: "bad"})
+	push(2, 0)
+	if contains(`"bad"`) || loads != 0 {
+		t.Errorf("Unexpected config (loads: %d): %s", loads, c.snapshot.Data)
+	}
+
+	// The quarantine is lifted once the service has been fixed.
+	upsert("service-2", "127.0.0.4", &Definitions{RetryOn: "better"})
+	push(2, 0)
+	if !contains(`"better"`) || !contains(`127.0.0.4:80`) {
+		t.Errorf("Unexpected config: %s", c.snapshot.Data)
+	}
+	if len(recorder.quarantined) != 1 {
+		t.Errorf("Quarantined: Got (%v) != Want (1 service)", recorder.quarantined)
+	}
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	smi "github.com/RussellLuo/caddy-mesh/api/smi/v1alpha4"
+)
+
+// applyTrafficSplit resolves the SMI TrafficSplit, if any, whose root is svc
+// into d, which takes precedence over the traffic-split annotations.
+func (c *Controller) applyTrafficSplit(ctx context.Context, svc *corev1.Service, d *Definitions) error {
+	if !c.config.EnableSMI || d == nil {
+		return nil
+	}
+
+	splits := &smi.TrafficSplitList{}
+	if err := c.client.List(ctx, splits, client.InNamespace(svc.Namespace)); err != nil {
+		return err
+	}
+	split := rootTrafficSplit(svc.Name, splits.Items)
+	if split == nil {
+		return nil
+	}
+
+	expr, err := c.trafficSplitMatches(ctx, split)
+	if err != nil {
+		return err
+	}
+	if expr != "" {
+		if err := validateExpression(expr); err != nil {
+			c.logger.Error(err, "bad matches of traffic split", "name", split.Name, "namespace", split.Namespace)
+			return nil
+		}
+	}
+
+	d.TrafficSplitExpression = expr
+	d.TrafficSplitNewService = ""
+	d.TrafficSplitOldService = ""
+	d.TrafficSplitBackends = nil
+	for _, b := range split.Spec.Backends {
+		d.TrafficSplitBackends = append(d.TrafficSplitBackends, TrafficSplitBackend{
+			Service: b.Service,
+			Weight:  b.Weight,
+		})
+	}
+	return nil
+}
+
+// rootTrafficSplit returns the TrafficSplit, among splits, whose root is the
+// Service of the given name. If there are more than one, the oldest one wins.
+func rootTrafficSplit(service string, splits []smi.TrafficSplit) *smi.TrafficSplit {
+	var root *smi.TrafficSplit
+	for i := range splits {
+		split := &splits[i]
+		if split.Spec.Service != service {
+			continue
+		}
+		if root == nil ||
+			split.CreationTimestamp.Before(&root.CreationTimestamp) ||
+			(split.CreationTimestamp.Equal(&root.CreationTimestamp) && split.Name < root.Name) {
+			root = split
+		}
+	}
+	return root
+}
+
+// trafficSplitMatches returns the expression matching the requests matched by
+// any HTTPRouteGroup referenced by split, or an empty string if split matches
+// all requests.
+func (c *Controller) trafficSplitMatches(ctx context.Context, split *smi.TrafficSplit) (string, error) {
+	if len(split.Spec.Matches) == 0 {
+		return "", nil
+	}
+
+	var groups []smi.HTTPRouteGroup
+	for _, ref := range split.Spec.Matches {
+		if ref.Kind != "HTTPRouteGroup" {
+			c.logger.Info("Ignoring unsupported match of traffic split", "name", split.Name, "namespace", split.Namespace, "kind", ref.Kind)
+			continue
+		}
+		group := &smi.HTTPRouteGroup{}
+		err := c.client.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: split.Namespace}, group)
+		if errors.IsNotFound(err) {
+			c.logger.Info("Ignoring missing HTTPRouteGroup of traffic split", "name", split.Name, "namespace", split.Namespace, "group", ref.Name)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		groups = append(groups, *group)
+	}
+
+	return routeGroupsExpression(groups), nil
+}
+
+// routeGroupsExpression returns the expression matching the requests matched
+// by any of the given groups. If there's no match at all, no request will be
+// matched, which is safer than matching all requests.
+func routeGroupsExpression(groups []smi.HTTPRouteGroup) string {
+	var exprs []string
+	for _, g := range groups {
+		for _, m := range g.Spec.Matches {
+			exprs = append(exprs, httpMatchExpression(m))
+		}
+	}
+
+	switch len(exprs) {
+	case 0:
+		return "false"
+	case 1:
+		return exprs[0]
+	}
+	for i, e := range exprs {
+		exprs[i] = "(" + e + ")"
+	}
+	return strings.Join(exprs, " || ")
+}
+
+// httpMatchExpression converts m into an expression, where all the regular
+// expressions are anchored to match the whole values.
+func httpMatchExpression(m smi.HTTPMatch) string {
+	var conditions []string
+
+	var methods []string
+	for _, method := range m.Methods {
+		if method == "*" {
+			methods = nil
+			break
+		}
+		methods = append(methods, strconv.Quote(strings.ToUpper(method)))
+	}
+	if len(methods) > 0 {
+		conditions = append(conditions, fmt.Sprintf("method(%s)", strings.Join(methods, ", ")))
+	}
+
+	if m.PathRegex != "" {
+		conditions = append(conditions, fmt.Sprintf("path_regexp(%s)", strconv.Quote(anchorRegexp(m.PathRegex))))
+	}
+
+	for _, name := range sortedKeys(m.Headers) {
+		conditions = append(conditions, fmt.Sprintf("header_regexp(%s, %s)", strconv.Quote(name), strconv.Quote(anchorRegexp(m.Headers[name]))))
+	}
+
+	if len(conditions) == 0 {
+		return "true"
+	}
+	return strings.Join(conditions, " && ")
+}
+
+func anchorRegexp(re string) string {
+	return "^(?:" + re + ")$"
+}
+
+// mapTrafficSplit maps a TrafficSplit to its root Service.
+func (c *Controller) mapTrafficSplit(obj client.Object) []reconcile.Request {
+	split, ok := obj.(*smi.TrafficSplit)
+	if !ok {
+		return nil
+	}
+	return c.eligibleService(split.Namespace, split.Spec.Service)
+}
+
+// mapHTTPRouteGroup maps an HTTPRouteGroup to the root Services of all the
+// TrafficSplits referencing it.
+func (c *Controller) mapHTTPRouteGroup(obj client.Object) []reconcile.Request {
+	splits := &smi.TrafficSplitList{}
+	if err := c.client.List(context.Background(), splits, client.InNamespace(obj.GetNamespace())); err != nil {
+		c.logger.Error(err, "could not list traffic splits", "namespace", obj.GetNamespace())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, split := range splits.Items {
+		for _, ref := range split.Spec.Matches {
+			if ref.Kind == "HTTPRouteGroup" && ref.Name == obj.GetName() {
+				requests = append(requests, c.eligibleService(split.Namespace, split.Spec.Service)...)
+				break
+			}
+		}
+	}
+	return requests
+}
+
+// eligibleService returns a request for the Service of the given name, if it
+// exists and is eligible.
+func (c *Controller) eligibleService(namespace, name string) []reconcile.Request {
+	key := client.ObjectKey{Name: name, Namespace: namespace}
+	svc := &corev1.Service{}
+	if err := c.client.Get(context.Background(), key, svc); err != nil {
+		if !errors.IsNotFound(err) {
+			c.logger.Error(err, "could not get service", "name", name, "namespace", namespace)
+		}
+		return nil
+	}
+	if !c.isEligible(svc) {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: key}}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	smi "github.com/RussellLuo/caddy-mesh/api/smi/v1alpha4"
+)
+
+func TestRouteGroupsExpression(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []smi.HTTPRouteGroup
+		want   string
+	}{
+		{
+			name: "no match",
+			want: "false",
+		},
+		{
+			name: "single match",
+			groups: []smi.HTTPRouteGroup{
+				{Spec: smi.HTTPRouteGroupSpec{Matches: []smi.HTTPMatch{
+					{
+						Name:      "firefox-users",
+						Methods:   []string{"get", "POST"},
+						PathRegex: "/api/.*",
+						Headers: map[string]string{
+							"User-Agent": ".*Firefox.*",
+							"Cookie":     `.*canary=\d.*`,
+						},
+					},
+				}}},
+			},
+			want: `method("GET", "POST") && path_regexp("^(?:/api/.*)$") && header_regexp("Cookie", "^(?:.*canary=\\d.*)$") && header_regexp("User-Agent", "^(?:.*Firefox.*)$")`,
+		},
+		{
+			name: "multiple matches",
+			groups: []smi.HTTPRouteGroup{
+				{Spec: smi.HTTPRouteGroupSpec{Matches: []smi.HTTPMatch{
+					{Name: "all", Methods: []string{"*"}},
+					{Name: "metrics", PathRegex: "/metrics"},
+				}}},
+				{Spec: smi.HTTPRouteGroupSpec{Matches: []smi.HTTPMatch{
+					{Name: "delete", Methods: []string{"DELETE"}},
+				}}},
+			},
+			want: `(true) || (path_regexp("^(?:/metrics)$")) || (method("DELETE"))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := routeGroupsExpression(tt.groups)
+			if got != tt.want {
+				t.Errorf("Got (%s) != Want (%s)", got, tt.want)
+			}
+			if err := validateExpression(got); err != nil {
+				t.Errorf("Err: %v", err)
+			}
+		})
+	}
+}
+
+func TestRootTrafficSplit(t *testing.T) {
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	newSplit := func(name, service string, age time.Duration) smi.TrafficSplit {
+		return smi.TrafficSplit{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "test",
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			},
+			Spec: smi.TrafficSplitSpec{Service: service},
+		}
+	}
+	splits := []smi.TrafficSplit{
+		newSplit("a", "other", 2*time.Hour),
+		newSplit("b", "server", 0),
+		newSplit("d", "server", time.Hour),
+		newSplit("c", "server", time.Hour),
+	}
+
+	if got := rootTrafficSplit("server", splits); got == nil || got.Name != "c" {
+		t.Errorf("Got (%v) != Want (c)", got)
+	}
+	if got := rootTrafficSplit("none", splits); got != nil {
+		t.Errorf("Got (%v) != Want (nil)", got)
+	}
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ValidateServicePath is the path on which ServiceValidator is served.
+const ValidateServicePath = "/validate-service"
+
+// ServiceValidator is a validating admission webhook, which rejects Services
+// with bad mesh annotations at creation and update time. Missing backends, and
+// those not granted, are only warned about, since they may be created, or
+// granted, later.
+type ServiceValidator struct {
+	client  client.Reader
+	mode    AnnotationMode
+	decoder *admission.Decoder
+}
+
+func NewServiceValidator(c client.Reader, mode AnnotationMode) *ServiceValidator {
+	return &ServiceValidator{client: c, mode: mode}
+}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *ServiceValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (v *ServiceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	svc := &corev1.Service{}
+	if err := v.decoder.Decode(req, svc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	var old *corev1.Service
+	if req.Operation == admissionv1.Update {
+		old = &corev1.Service{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+
+	errs, warnings, err := v.validate(ctx, svc, old)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(errs) > 0 {
+		status := apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("Service").GroupKind(), svc.Name, errs).ErrStatus
+		return admission.Response{
+			AdmissionResponse: admissionv1.AdmissionResponse{
+				Allowed:  false,
+				Result:   &status,
+				Warnings: warnings,
+			},
+		}
+	}
+
+	resp := admission.Allowed("")
+	if v.mode != AnnotationModeReject {
+		if err := CheckAnnotations(svc.Annotations); err != nil {
+			warnings = append(strings.Split(err.Error(), "; "), warnings...)
+		}
+	}
+	if len(warnings) > 0 {
+		resp = resp.WithWarnings(warnings...)
+	}
+	return resp
+}
+
+// validate returns the errors in the annotations of svc, along with warnings
+// about its backends. The annotations, as well as the backends, are only checked
+// if they have been changed since old, which is nil on creation, so that a
+// Service with a bad annotation or a gone backend can still be updated (e.g. by
+// the controller itself).
+func (v *ServiceValidator) validate(ctx context.Context, svc, old *corev1.Service) (field.ErrorList, []string, error) {
+	changed := func(name string) bool {
+		return svc.Annotations[name] != "" && (old == nil || old.Annotations[name] != svc.Annotations[name])
+	}
+
+	// Only the changed annotations are validated, so that a Service with an
+	// annotation that was invalid beforehand (e.g. before the webhook was
+	// enabled) can still be updated otherwise. The status annotation, written
+	// by the controller, is never validated.
+	annotations := make(map[string]string)
+	for name, value := range svc.Annotations {
+		if name != StatusAnnotation && changed(name) {
+			annotations[name] = value
+		}
+	}
+	errs := ValidateAnnotations(annotations, v.mode)
+
+	// Check that the traffic-split backends, and the mirror service, exist,
+	// and that those in other namespaces are granted. A missing or not granted
+	// backend is only warned about, since it will be routed around by the
+	// controller, until the backend is created or the grant is added.
+	path := field.NewPath("metadata", "annotations")
+	type backend struct {
+		annotation string
+		ref        string
+	}
+	var backends []backend
+	for _, name := range []string{
+		"mesh.caddyserver.com/traffic-split-new-service",
+		"mesh.caddyserver.com/traffic-split-old-service",
+		"mesh.caddyserver.com/mirror-service",
+	} {
+		if changed(name) {
+			backends = append(backends, backend{annotation: name, ref: svc.Annotations[name]})
+		}
+	}
+	// An invalid list of weighted backends has been reported above.
+	// Only the newly added weighted backends are checked, since the weights
+	// alone are changed frequently (e.g. during a canary release).
+	name := "mesh.caddyserver.com/traffic-split-backends"
+	if changed(name) {
+		checked := make(map[string]bool)
+		if old != nil {
+			oldWeighted, _ := parseTrafficSplitBackends(old.Annotations[name])
+			for _, b := range oldWeighted {
+				checked[b.Service] = true
+			}
+		}
+		weighted, _ := parseTrafficSplitBackends(svc.Annotations[name])
+		for _, b := range weighted {
+			if !checked[b.Service] {
+				backends = append(backends, backend{annotation: name, ref: b.Service})
+			}
+		}
+	}
+
+	var warnings []string
+	for _, b := range backends {
+		ref, err := parseBackendRef(b.ref)
+		if err != nil {
+			continue // Reported above.
+		}
+		key := ref.Key(svc.Namespace)
+		err = v.client.Get(ctx, client.ObjectKey{Name: key.Name, Namespace: key.Namespace}, &corev1.Service{})
+		switch {
+		case apierrors.IsNotFound(err):
+			warnings = append(warnings, fmt.Sprintf("%s: service %q not found", path.Key(b.annotation), b.ref))
+			continue
+		case err != nil:
+			return nil, nil, err
+		}
+
+		if key.Namespace == svc.Namespace {
+			continue
+		}
+		ns := &corev1.Namespace{}
+		if err := v.client.Get(ctx, client.ObjectKey{Name: key.Namespace}, ns); err != nil {
+			return nil, nil, err
+		}
+		if !grantsReference(ns.Annotations, svc.Namespace) {
+			warnings = append(warnings, fmt.Sprintf("%s: namespace %q does not grant references from namespace %q", path.Key(b.annotation), key.Namespace, svc.Namespace))
+		}
+	}
+
+	return errs, warnings, nil
+}
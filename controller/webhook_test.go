@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestServiceValidator_Handle(t *testing.T) {
+	existing := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service-1", Namespace: "test"}}
+	granted := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service-2", Namespace: "canary"}}
+	notGranted := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service-2", Namespace: "staging"}}
+	namespaces := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "canary", Annotations: map[string]string{ReferenceGrantAnnotation: "test"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "staging"}},
+	}
+	c := fake.NewClientBuilder().WithObjects(existing, granted, notGranted).WithObjects(namespaces...).Build()
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		inMode          AnnotationMode
+		inOldAnnotation map[string]string
+		inAnnotation    map[string]string
+		wantAllowed     bool
+		wantCauses      []metav1.StatusCause
+		wantWarnings    []string
+	}{
+		{
+			name:        "no annotations",
+			inMode:      AnnotationModeWarn,
+			wantAllowed: true,
+		},
+		{
+			name:   "valid",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-count":               "2",
+				"mesh.caddyserver.com/traffic-split-expression":  "header({'User-Agent': '*Chrome*'})",
+				"mesh.caddyserver.com/traffic-split-new-service": "service-1",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+			},
+			wantAllowed: true,
+		},
+		{
+			name:   "invalid",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-count":               "two",
+				"mesh.caddyserver.com/traffic-split-expression":  "header(",
+				"mesh.caddyserver.com/traffic-split-new-service": "service-2",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+			},
+			wantCauses: []metav1.StatusCause{
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: `Invalid value: "two": strconv.Atoi: parsing "two": invalid syntax`,
+					Field:   "metadata.annotations[mesh.caddyserver.com/retry-count]",
+				},
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: `Invalid value: "header(": invalid expression: 1:8: Syntax error: mismatched input '<EOF>' expecting {'[', '{', '(', ')', '.', '-', '!', 'true', 'false', 'null', NUM_FLOAT, NUM_INT, NUM_UINT, STRING, BYTES, IDENTIFIER}`,
+					Field:   "metadata.annotations[mesh.caddyserver.com/traffic-split-expression]",
+				},
+			},
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/traffic-split-new-service]: service "service-2" not found`},
+		},
+		{
+			name:   "missing backend",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "header({'User-Agent': '*Chrome*'})",
+				"mesh.caddyserver.com/traffic-split-new-service": "service-2",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+			},
+			wantAllowed:  true,
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/traffic-split-new-service]: service "service-2" not found`},
+		},
+		{
+			name:   "missing backend unchanged",
+			inMode: AnnotationModeWarn,
+			inOldAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "header({'User-Agent': '*Chrome*'})",
+				"mesh.caddyserver.com/traffic-split-new-service": "service-2",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+			},
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "header({'User-Agent': '*Firefox*'})",
+				"mesh.caddyserver.com/traffic-split-new-service": "service-2",
+				"mesh.caddyserver.com/traffic-split-old-service": "service-1",
+			},
+			wantAllowed: true,
+		},
+		{
+			name:   "invalid unchanged",
+			inMode: AnnotationModeReject,
+			inOldAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-count": "two",
+				"mesh.caddyserver.com/retry-cout":  "2",
+			},
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-count": "two",
+				"mesh.caddyserver.com/retry-cout":  "2",
+				StatusAnnotation:                   `{"appliedGeneration":1,"proxies":1}`,
+			},
+			wantAllowed: true,
+		},
+		{
+			name:   "weighted backends",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=95,service-2=5",
+				"mesh.caddyserver.com/traffic-split-sticky":   "yes",
+			},
+			wantCauses: []metav1.StatusCause{
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: `Invalid value: "yes": strconv.ParseBool: parsing "yes": invalid syntax`,
+					Field:   "metadata.annotations[mesh.caddyserver.com/traffic-split-sticky]",
+				},
+			},
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/traffic-split-backends]: service "service-2" not found`},
+		},
+		{
+			name:   "weighted backends with new weights",
+			inMode: AnnotationModeWarn,
+			inOldAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=95,service-2=5",
+			},
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-backends": "service-1=90,service-2=10,service-3=0",
+			},
+			wantAllowed:  true,
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/traffic-split-backends]: service "service-3" not found`},
+		},
+		{
+			name:   "backends in other namespaces",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/traffic-split-expression":  "header({'User-Agent': '*Chrome*'})",
+				"mesh.caddyserver.com/traffic-split-new-service": "canary/service-2:8080",
+				"mesh.caddyserver.com/traffic-split-old-service": "staging/service-2",
+			},
+			wantAllowed:  true,
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/traffic-split-old-service]: namespace "staging" does not grant references from namespace "test"`},
+		},
+		{
+			name:   "mirror",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/mirror-service":    "staging/service-2",
+				"mesh.caddyserver.com/mirror-percentage": "150",
+			},
+			wantCauses: []metav1.StatusCause{
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: `Invalid value: "150": invalid percentage in 'mesh.caddyserver.com/mirror-percentage': 150, want 0 to 100`,
+					Field:   "metadata.annotations[mesh.caddyserver.com/mirror-percentage]",
+				},
+			},
+			wantWarnings: []string{`metadata.annotations[mesh.caddyserver.com/mirror-service]: namespace "staging" does not grant references from namespace "test"`},
+		},
+		{
+			name:   "unknown in warn mode",
+			inMode: AnnotationModeWarn,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-cout": "2",
+			},
+			wantAllowed:  true,
+			wantWarnings: []string{"unknown annotation 'mesh.caddyserver.com/retry-cout' (did you mean 'mesh.caddyserver.com/retry-count'?)"},
+		},
+		{
+			name:   "unknown in reject mode",
+			inMode: AnnotationModeReject,
+			inAnnotation: map[string]string{
+				"mesh.caddyserver.com/retry-cout": "2",
+			},
+			wantCauses: []metav1.StatusCause{
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: `Invalid value: "2": unknown annotation (did you mean 'mesh.caddyserver.com/retry-count'?)`,
+					Field:   "metadata.annotations[mesh.caddyserver.com/retry-cout]",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewServiceValidator(c, tt.inMode)
+			if err := v.InjectDecoder(decoder); err != nil {
+				t.Fatal(err)
+			}
+
+			encode := func(annotations map[string]string) []byte {
+				svc := &corev1.Service{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+					ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "test", Annotations: annotations},
+				}
+				raw, err := json.Marshal(svc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return raw
+			}
+
+			req := admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: encode(tt.inAnnotation)},
+				},
+			}
+			if tt.inOldAnnotation != nil {
+				req.Operation = admissionv1.Update
+				req.OldObject = runtime.RawExtension{Raw: encode(tt.inOldAnnotation)}
+			}
+			resp := v.Handle(context.Background(), req)
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed: Got (%v) != Want (%v), result: %v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			var causes []metav1.StatusCause
+			if !resp.Allowed {
+				causes = resp.Result.Details.Causes
+			}
+			if !cmp.Equal(causes, tt.wantCauses) {
+				diff := cmp.Diff(causes, tt.wantCauses)
+				t.Errorf("Causes: Want - Got: %s", diff)
+			}
+			if !cmp.Equal(resp.Warnings, tt.wantWarnings) {
+				diff := cmp.Diff(resp.Warnings, tt.wantWarnings)
+				t.Errorf("Warnings: Want - Got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package mirror provides a Caddy HTTP handler, which sends a copy of the
+// requests to another set of upstreams before passing them on to the next
+// handler (e.g. reverse_proxy).
+//
+// Caddy has no built-in handler for traffic mirroring (or shadowing), thus this
+// module is built into the Caddy image of Caddy Mesh.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Mirror{})
+}
+
+// Mirror mirrors the requests to Upstreams in a fire-and-forget manner, and the
+// mirrored responses are discarded. The requests themselves are always passed
+// on to the next handler, no matter whether they are mirrored or not.
+type Mirror struct {
+	// Upstreams are the upstreams to which the requests are mirrored in turn.
+	Upstreams []*Upstream `json:"upstreams,omitempty"`
+	// Percentage is the percentage of the requests to be mirrored, where zero
+	// means none. Default: 100.
+	Percentage *float64 `json:"percentage,omitempty"`
+	// Timeout is how long to wait for the response of a mirrored request.
+	// Default: 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// MaxBodySize is the maximum size of the request body that is mirrored,
+	// since the body has to be buffered. Larger requests, and requests whose
+	// body length is unknown (e.g. chunked ones), are not mirrored.
+	// Default: 1MiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// MaxInFlight is the maximum number of the mirrored requests in flight,
+	// beyond which the requests are not mirrored. Default: 100.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	logger     *zap.Logger
+	client     *http.Client
+	percentage float64
+	inFlight   chan struct{}
+	// next is the index of the upstream to which the next request is mirrored.
+	next   uint32
+	random func() float64
+}
+
+// Upstream is the network address of an upstream.
+type Upstream struct {
+	Dial string `json:"dial,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Mirror) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirror",
+		New: func() caddy.Module { return new(Mirror) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *Mirror) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	m.init()
+	return nil
+}
+
+// init sets the defaults, and prepares the client to send mirrored requests.
+func (m *Mirror) init() {
+	m.percentage = 100
+	if m.Percentage != nil {
+		m.percentage = *m.Percentage
+	}
+	if m.Timeout == 0 {
+		m.Timeout = caddy.Duration(10 * time.Second)
+	}
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = 1 << 20
+	}
+	if m.MaxInFlight == 0 {
+		m.MaxInFlight = 100
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The upstreams are always dialed directly.
+	transport.Proxy = nil
+	m.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(m.Timeout),
+		// Never follow redirects, which are meant for the client.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	m.inFlight = make(chan struct{}, m.MaxInFlight)
+	m.random = rand.Float64
+}
+
+// Validate implements caddy.Validator.
+func (m *Mirror) Validate() error {
+	for _, u := range m.Upstreams {
+		if u == nil || u.Dial == "" {
+			return fmt.Errorf("empty upstream")
+		}
+	}
+	if p := m.Percentage; p != nil && (*p < 0 || *p > 100) {
+		return fmt.Errorf("invalid percentage %v, want 0 to 100", *p)
+	}
+	if m.MaxBodySize < 0 {
+		return fmt.Errorf("invalid max body size %d", m.MaxBodySize)
+	}
+	if m.MaxInFlight < 0 {
+		return fmt.Errorf("invalid max in flight %d", m.MaxInFlight)
+	}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *Mirror) Cleanup() error {
+	if m.client != nil {
+		m.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.sampled(r) {
+		m.mirror(r)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// sampled reports whether r should be mirrored.
+func (m *Mirror) sampled(r *http.Request) bool {
+	if len(m.Upstreams) == 0 {
+		return false
+	}
+	// Protocol upgrades (e.g. WebSocket) can not be mirrored.
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return m.random()*100 < m.percentage
+}
+
+// mirror sends a copy of r to the next upstream in the background.
+func (m *Mirror) mirror(r *http.Request) {
+	// Check the capacity first, so that no body is buffered in vain.
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.logger.Debug("too many mirrored requests in flight",
+			zap.String("method", r.Method),
+			zap.String("uri", r.RequestURI),
+		)
+		return
+	}
+
+	body, ok := m.bufferBody(r)
+	if !ok {
+		<-m.inFlight
+		m.logger.Debug("request body too large or of unknown length to mirror",
+			zap.String("method", r.Method),
+			zap.String("uri", r.RequestURI),
+		)
+		return
+	}
+
+	req := m.newRequest(r, body)
+	go func() {
+		defer func() { <-m.inFlight }()
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			m.logger.Debug("could not mirror request",
+				zap.String("upstream", req.URL.Host),
+				zap.Error(err),
+			)
+			return
+		}
+		// Drain the body, so that the connection can be reused.
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+}
+
+// bufferBody reads the body of r into memory, and puts it back so that the body
+// can still be read by the next handler. It reports false if the body is larger
+// than m.MaxBodySize, is of unknown length or could not be read.
+//
+// A body of unknown length is not read at all, since reading it in advance
+// would delay the request until the client has sent up to m.MaxBodySize bytes.
+func (m *Mirror) bufferBody(r *http.Request) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength < 0 || r.ContentLength > m.MaxBodySize {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBodySize+1))
+	// Put back what has been read, followed by the rest of the body, if any.
+	r.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		Closer: r.Body,
+	}
+	if err != nil || int64(len(body)) > m.MaxBodySize {
+		return nil, false
+	}
+	return body, true
+}
+
+// newRequest returns a copy of r, with the given body, that is sent to the
+// next upstream.
+func (m *Mirror) newRequest(r *http.Request, body []byte) *http.Request {
+	// The mirrored request must outlive r.
+	req := r.Clone(context.Background())
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = m.nextUpstream().Dial
+	req.Host = r.Host
+
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(body))
+	req.Body = nil
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	removeHopByHopHeaders(req.Header)
+	return req
+}
+
+// nextUpstream returns the upstreams in turn.
+func (m *Mirror) nextUpstream() *Upstream {
+	i := atomic.AddUint32(&m.next, 1) - 1
+	return m.Upstreams[int(i%uint32(len(m.Upstreams)))]
+}
+
+// hopByHopHeaders are the headers that are meaningful only for a single
+// connection, which must not be forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Mirror)(nil)
+	_ caddy.Validator             = (*Mirror)(nil)
+	_ caddy.CleanerUpper          = (*Mirror)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Mirror)(nil)
+)
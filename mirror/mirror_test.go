@@ -0,0 +1,240 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+type mirroredRequest struct {
+	Method string
+	Host   string
+	URI    string
+	Body   string
+	Header http.Header
+}
+
+func newMirror(t *testing.T, upstreams ...string) *Mirror {
+	m := &Mirror{MaxBodySize: 8}
+	for _, u := range upstreams {
+		m.Upstreams = append(m.Upstreams, &Upstream{Dial: u})
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	m.init()
+	m.logger = zap.NewNop()
+	t.Cleanup(func() { _ = m.Cleanup() })
+	return m
+}
+
+func TestMirror_ServeHTTP(t *testing.T) {
+	mirroredC := make(chan mirroredRequest, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirroredC <- mirroredRequest{
+			Method: r.Method,
+			Host:   r.Host,
+			URI:    r.RequestURI,
+			Body:   string(body),
+			Header: r.Header,
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name         string
+		body         string
+		chunked      bool
+		wantMirrored bool
+	}{
+		{
+			name:         "small body",
+			body:         "hello",
+			wantMirrored: true,
+		},
+		{
+			name:         "large body",
+			body:         "hello world",
+			wantMirrored: false,
+		},
+		{
+			name:         "body of unknown length",
+			body:         "hello",
+			chunked:      true,
+			wantMirrored: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMirror(t, strings.TrimPrefix(upstream.URL, "http://"))
+
+			r := httptest.NewRequest(http.MethodPost, "http://server.test.svc/api?id=1", strings.NewReader(tt.body))
+			if tt.chunked {
+				r.Body = io.NopCloser(strings.NewReader(tt.body))
+				r.ContentLength = -1
+				r.TransferEncoding = []string{"chunked"}
+			}
+			r.Header.Set("X-Request-Id", "1")
+			r.Header.Set("Connection", "X-Hop")
+			r.Header.Set("X-Hop", "1")
+			w := httptest.NewRecorder()
+
+			var gotBody string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				body, err := io.ReadAll(r.Body)
+				gotBody = string(body)
+				w.WriteHeader(http.StatusOK)
+				return err
+			})
+			if err := m.ServeHTTP(w, r, next); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			// The request must be intact for the next handler.
+			if gotBody != tt.body {
+				t.Errorf("Body: Got (%s) != Want (%s)", gotBody, tt.body)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("Status: Got (%d) != Want (%d)", w.Code, http.StatusOK)
+			}
+
+			if !tt.wantMirrored {
+				if len(m.inFlight) != 0 {
+					t.Errorf("Got a mirrored request, Want none")
+				}
+				return
+			}
+
+			select {
+			case got := <-mirroredC:
+				if got.Method != http.MethodPost || got.Host != "server.test.svc" || got.URI != "/api?id=1" || got.Body != tt.body {
+					t.Errorf("Got (%+v)", got)
+				}
+				if got.Header.Get("X-Request-Id") != "1" {
+					t.Errorf("X-Request-Id: Got (%s) != Want (1)", got.Header.Get("X-Request-Id"))
+				}
+				if got.Header.Get("X-Hop") != "" {
+					t.Errorf("X-Hop: Got (%s) != Want ()", got.Header.Get("X-Hop"))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for the mirrored request")
+			}
+		})
+	}
+}
+
+func TestMirror_Sampled(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstreams  []string
+		percentage *float64
+		random     float64
+		upgrade    string
+		want       bool
+	}{
+		{
+			name:      "no upstream",
+			upstreams: nil,
+			random:    0,
+			want:      false,
+		},
+		{
+			name:      "all requests",
+			upstreams: []string{"127.0.0.1:80"},
+			random:    0.99,
+			want:      true,
+		},
+		{
+			name:       "sampled request",
+			upstreams:  []string{"127.0.0.1:80"},
+			percentage: percentage(10),
+			random:     0.05,
+			want:       true,
+		},
+		{
+			name:       "unsampled request",
+			upstreams:  []string{"127.0.0.1:80"},
+			percentage: percentage(10),
+			random:     0.1,
+			want:       false,
+		},
+		{
+			name:       "no requests",
+			upstreams:  []string{"127.0.0.1:80"},
+			percentage: percentage(0),
+			random:     0,
+			want:       false,
+		},
+		{
+			name:      "upgrade",
+			upstreams: []string{"127.0.0.1:80"},
+			random:    0,
+			upgrade:   "websocket",
+			want:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMirror(t, tt.upstreams...)
+			if tt.percentage != nil {
+				m.Percentage = tt.percentage
+				m.init()
+			}
+			m.random = func() float64 { return tt.random }
+
+			r := httptest.NewRequest(http.MethodGet, "http://server.test.svc/", nil)
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			if got := m.sampled(r); got != tt.want {
+				t.Errorf("Got (%v) != Want (%v)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMirror_TooManyInFlight(t *testing.T) {
+	m := newMirror(t, "127.0.0.1:80")
+	for i := 0; i < cap(m.inFlight); i++ {
+		m.inFlight <- struct{}{}
+	}
+
+	body := strings.NewReader("hello")
+	r := httptest.NewRequest(http.MethodPost, "http://server.test.svc/", body)
+	m.mirror(r)
+
+	// The body is left intact, since the request is not mirrored.
+	if body.Len() != len("hello") {
+		t.Errorf("Body: Got (%d bytes read) != Want (none)", len("hello")-body.Len())
+	}
+	if got := len(m.inFlight); got != cap(m.inFlight) {
+		t.Errorf("InFlight: Got (%d) != Want (%d)", got, cap(m.inFlight))
+	}
+}
+
+func TestMirror_NextUpstream(t *testing.T) {
+	m := newMirror(t, "127.0.0.1:80", "127.0.0.2:80")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, m.nextUpstream().Dial)
+	}
+	want := []string{"127.0.0.1:80", "127.0.0.2:80", "127.0.0.1:80"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Got (%v) != Want (%v)", got, want)
+	}
+}
+
+func percentage(p float64) *float64 {
+	return &p
+}